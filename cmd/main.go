@@ -19,7 +19,7 @@ func main() {
 
 	// Add a text layer.
 	textStyle := layers.NewTextStyle()
-	doc.AddTextLayer("Hello, Krita!\nThis is a text layer.", "Text Layer", 10, 10, 255, textStyle)
+	doc.AddTextLayer("Hello, Krita!\nThis is a text layer.", "Text Layer", 10, 10, layers.Opaque, textStyle)
 
 	// Add a shape layer with a rectangle.
 	shapeStyle := shapes.NewShapeStyle()
@@ -27,11 +27,11 @@ func main() {
 		BaseShape: shapes.BaseShape{Style: shapeStyle, Transform: ""},
 		X:         50, Y: 50, Width: 200, Height: 100,
 	}
-	doc.AddShapeLayer([]shapes.Shape{rect}, "Shape Layer", 0, 0, 255, &shapeStyle)
+	doc.AddShapeLayer([]shapes.Shape{rect}, "Shape Layer", 0, 0, layers.Opaque, &shapeStyle)
 
 	// (Optional) Create and add an image layer.
 	img := createDummyImage(1024, 1024)
-	doc.AddImageLayer(img, "dummy.png", "Image Layer", 0, 0, 255)
+	doc.AddImageLayer(img, "dummy.png", "Image Layer", 0, 0, layers.Opaque)
 
 	// Save the document.
 	if err := doc.Save("output.kra"); err != nil {
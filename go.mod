@@ -2,7 +2,4 @@ module github.com/cozy-creator/kritago
 
 go 1.23.0
 
-require (
-	github.com/google/uuid v1.6.0 // indirect
-	github.com/zhuyie/golzf v0.0.0-20161112031142-8387b0307ade // indirect
-)
+require github.com/google/uuid v1.6.0
@@ -0,0 +1,149 @@
+// Package lzf implements the LZF compression format of Marc Lehmann's
+// liblzf, which Krita uses for the pixel data of paint device tiles.
+//
+// An LZF stream is a sequence of chunks, each starting with a control
+// byte. A control byte below 32 is followed by that many plus one literal
+// bytes. Otherwise its top three bits hold a match length less two (7
+// meaning another byte of length follows), and its low five bits with the
+// next byte the distance back to the match, less one.
+package lzf
+
+import "errors"
+
+var (
+	// ErrShortBuffer means the output does not fit in the destination.
+	ErrShortBuffer = errors.New("lzf: output buffer too small")
+	// ErrCorrupt means the input is not a valid LZF stream.
+	ErrCorrupt = errors.New("lzf: corrupt input")
+)
+
+const (
+	hashLog = 14
+	maxLit  = 1 << 5              // longest literal run
+	maxOff  = 1 << 13             // farthest match distance
+	maxRef  = (1 << 8) + (1 << 3) // longest match
+)
+
+// Compress compresses src into dst and returns the number of bytes
+// written. It returns ErrShortBuffer if the result does not fit, which for
+// data that does not compress happens whenever dst is no larger than src.
+func Compress(src, dst []byte) (int, error) {
+	// table holds one plus the last position of each 3-byte hash.
+	var table [1 << hashLog]int32
+	// The control byte of the pending literal run sits before its lit
+	// bytes; position 0 is reserved for the first run.
+	op, lit := 1, 0
+	ip := 0
+	for ip < len(src) {
+		if ip+2 < len(src) {
+			h := hash(src[ip:])
+			ref := int(table[h]) - 1
+			table[h] = int32(ip + 1)
+			if off := ip - ref - 1; ref >= 0 && off < maxOff &&
+				src[ref] == src[ip] && src[ref+1] == src[ip+1] && src[ref+2] == src[ip+2] {
+				n := 3
+				for limit := min(len(src)-ip, maxRef); n < limit && src[ref+n] == src[ip+n]; n++ {
+				}
+				// End the literal run, dropping its control byte if empty.
+				if lit > 0 {
+					dst[op-lit-1] = byte(lit - 1)
+				} else {
+					op--
+				}
+				size := 2
+				if n-2 >= 7 {
+					size = 3
+				}
+				if op+size > len(dst) {
+					return 0, ErrShortBuffer
+				}
+				if n-2 < 7 {
+					dst[op] = byte(off>>8 | (n-2)<<5)
+				} else {
+					dst[op] = byte(off>>8 | 7<<5)
+					op++
+					dst[op] = byte(n - 2 - 7)
+				}
+				dst[op+1] = byte(off)
+				op += 2
+				// Hash the positions inside the match so later data can
+				// refer back to them.
+				for i := ip + 1; i < ip+n && i+2 < len(src); i++ {
+					table[hash(src[i:])] = int32(i + 1)
+				}
+				ip += n
+				op, lit = op+1, 0 // start a new run
+				continue
+			}
+		}
+		if op >= len(dst) {
+			return 0, ErrShortBuffer
+		}
+		dst[op] = src[ip]
+		op, ip, lit = op+1, ip+1, lit+1
+		if lit == maxLit {
+			dst[op-lit-1] = byte(lit - 1)
+			op, lit = op+1, 0
+		}
+	}
+	if lit > 0 {
+		dst[op-lit-1] = byte(lit - 1)
+	} else {
+		op--
+	}
+	return op, nil
+}
+
+// Decompress decompresses src into dst and returns the number of bytes
+// written. It returns ErrShortBuffer if the output does not fit and
+// ErrCorrupt if src is malformed.
+func Decompress(src, dst []byte) (int, error) {
+	ip, op := 0, 0
+	for ip < len(src) {
+		ctrl := int(src[ip])
+		ip++
+		if ctrl < 1<<5 {
+			n := ctrl + 1
+			if ip+n > len(src) {
+				return op, ErrCorrupt
+			}
+			if op+n > len(dst) {
+				return op, ErrShortBuffer
+			}
+			copy(dst[op:], src[ip:ip+n])
+			ip, op = ip+n, op+n
+			continue
+		}
+		n := ctrl >> 5
+		if n == 7 {
+			if ip >= len(src) {
+				return op, ErrCorrupt
+			}
+			n += int(src[ip])
+			ip++
+		}
+		n += 2
+		if ip >= len(src) {
+			return op, ErrCorrupt
+		}
+		ref := op - (ctrl&0x1f)<<8 - int(src[ip]) - 1
+		ip++
+		if ref < 0 {
+			return op, ErrCorrupt
+		}
+		if op+n > len(dst) {
+			return op, ErrShortBuffer
+		}
+		// The match may overlap the output it produces, so copy bytewise.
+		for i := 0; i < n; i++ {
+			dst[op+i] = dst[ref+i]
+		}
+		op += n
+	}
+	return op, nil
+}
+
+func hash(p []byte) uint32 {
+	v := uint32(p[0])<<16 | uint32(p[1])<<8 | uint32(p[2])
+	return v * 2654435761 >> (32 - hashLog)
+}
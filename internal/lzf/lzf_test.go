@@ -0,0 +1,65 @@
+package lzf
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add([]byte(""))
+	f.Add([]byte("a"))
+	f.Add([]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"))
+	f.Add([]byte("abcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabc"))
+	f.Add(bytes.Repeat([]byte{0, 0, 0, 0xff}, 4096))
+	f.Fuzz(func(t *testing.T, src []byte) {
+		// Room for incompressible input: one control byte per 32 literals.
+		compressed := make([]byte, len(src)+len(src)/32+1)
+		n, err := Compress(src, compressed)
+		if err != nil {
+			t.Fatalf("Compress: %v", err)
+		}
+		out := make([]byte, len(src))
+		m, err := Decompress(compressed[:n], out)
+		if err != nil {
+			t.Fatalf("Decompress: %v", err)
+		}
+		if m != len(src) || !bytes.Equal(out, src) {
+			t.Fatalf("round trip gave %d bytes %x, want %x", m, out[:m], src)
+		}
+
+		// A destination one byte short of the compressed size must fail
+		// cleanly rather than write past the end.
+		if n > 0 {
+			if _, err := Compress(src, make([]byte, n-1)); err != ErrShortBuffer {
+				t.Fatalf("Compress into %d bytes: got %v, want ErrShortBuffer", n-1, err)
+			}
+		}
+	})
+}
+
+func FuzzDecompress(f *testing.F) {
+	f.Add([]byte{0x00, 'a'}, 16)
+	f.Add([]byte{0x02, 'a', 'b', 'c', 0x20, 0x02}, 16)
+	f.Add([]byte{0xe0, 0xff, 0x00}, 300)
+	f.Fuzz(func(t *testing.T, src []byte, size int) {
+		if size < 0 || size > 1<<16 {
+			return
+		}
+		// Arbitrary input must never panic, and a stream that decodes
+		// must compress and decode back to the same bytes.
+		out := make([]byte, size)
+		n, err := Decompress(src, out)
+		if err != nil {
+			return
+		}
+		compressed := make([]byte, n+n/32+1)
+		c, err := Compress(out[:n], compressed)
+		if err != nil {
+			t.Fatalf("Compress: %v", err)
+		}
+		again := make([]byte, n)
+		if m, err := Decompress(compressed[:c], again); err != nil || m != n || !bytes.Equal(again, out[:n]) {
+			t.Fatalf("round trip of decoded data failed: %v", err)
+		}
+	})
+}
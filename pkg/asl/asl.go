@@ -3,18 +3,17 @@ package asl
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
 	"strings"
 
 	"github.com/cozy-creator/kritago/pkg/layers"
+	"github.com/google/uuid"
 )
 
-// CreateLayerStylesASL creates the ASL data for layer styles.
-func CreateLayerStylesASL(layerInfos []struct {
-	Layer     interface{}
-	UUID      string
-	LayerName string
-}) ([]byte, error) {
+// CreateLayerStylesASL creates the ASL data for the styles of layers.
+func CreateLayerStylesASL(styled []layers.StyledLayer) ([]byte, error) {
 	var asl bytes.Buffer
 	// Write ASL header.
 	if err := binary.Write(&asl, binary.BigEndian, uint16(2)); err != nil {
@@ -28,8 +27,8 @@ func CreateLayerStylesASL(layerInfos []struct {
 		return nil, err
 	}
 	numStyles := 0
-	for _, li := range layerInfos {
-		if sl, ok := li.Layer.(*layers.ShapeLayer); ok && sl.LayerStyle != nil {
+	for _, sl := range styled {
+		if sl.GetLayerStyle() != nil {
 			numStyles++
 		}
 	}
@@ -37,9 +36,9 @@ func CreateLayerStylesASL(layerInfos []struct {
 		return nil, err
 	}
 	// Write each style.
-	for _, li := range layerInfos {
-		sl, ok := li.Layer.(*layers.ShapeLayer)
-		if !ok || sl.LayerStyle == nil {
+	for _, sl := range styled {
+		style := sl.GetLayerStyle()
+		if style == nil {
 			continue
 		}
 		styleStartPos := asl.Len()
@@ -49,13 +48,13 @@ func CreateLayerStylesASL(layerInfos []struct {
 		asl.Write([]byte("null"))
 		asl.Write([]byte("Nm  "))
 		asl.Write([]byte("TEXT"))
-		name := fmt.Sprintf("<%s> (embedded)", sl.Name)
+		name := fmt.Sprintf("<%s> (embedded)", sl.GetName())
 		if err := writeASLString(&asl, name, "embedded"); err != nil {
 			return nil, err
 		}
 		asl.Write([]byte("Idnt"))
 		asl.Write([]byte("TEXT"))
-		uuidStr := strings.ReplaceAll(sl.LayerStyleUUID, "-", "")
+		uuidStr := strings.ReplaceAll(sl.GetLayerStyleUUID(), "-", "")
 		uuidStr = "%" + uuidStr
 		if err := writeASLString(&asl, uuidStr, "embedded"); err != nil {
 			return nil, err
@@ -69,17 +68,17 @@ func CreateLayerStylesASL(layerInfos []struct {
 		asl.Write([]byte("Lefx"))
 		asl.Write([]byte("Scl "))
 		asl.Write([]byte("UntF#Prc"))
-		if err := binary.Write(&asl, binary.BigEndian, sl.LayerStyle.Scale); err != nil {
+		if err := binary.Write(&asl, binary.BigEndian, style.Scale); err != nil {
 			return nil, err
 		}
 		asl.Write([]byte("masterFXSwitch"))
 		asl.Write([]byte("bool"))
 		var masterByte byte = 0
-		if sl.LayerStyle.Enabled {
+		if style.Enabled {
 			masterByte = 1
 		}
 		asl.Write([]byte{masterByte})
-		if sl.LayerStyle.StrokeEnabled {
+		if style.StrokeEnabled {
 			asl.Write([]byte("FrFX"))
 			asl.Write([]byte("Objc"))
 			asl.Write([]byte("FrFX"))
@@ -100,12 +99,12 @@ func CreateLayerStylesASL(layerInfos []struct {
 			asl.Write([]byte("Nrml"))
 			asl.Write([]byte("Opct"))
 			asl.Write([]byte("UntF#Prc"))
-			if err := binary.Write(&asl, binary.BigEndian, sl.LayerStyle.StrokeOpacity); err != nil {
+			if err := binary.Write(&asl, binary.BigEndian, style.StrokeOpacity); err != nil {
 				return nil, err
 			}
 			asl.Write([]byte("Sz  "))
 			asl.Write([]byte("UntF#Pxl"))
-			if err := binary.Write(&asl, binary.BigEndian, sl.LayerStyle.StrokeSize); err != nil {
+			if err := binary.Write(&asl, binary.BigEndian, style.StrokeSize); err != nil {
 				return nil, err
 			}
 			asl.Write([]byte("Clr "))
@@ -115,7 +114,7 @@ func CreateLayerStylesASL(layerInfos []struct {
 			for i, ch := range channels {
 				asl.Write([]byte(ch))
 				asl.Write([]byte("doub"))
-				if err := binary.Write(&asl, binary.BigEndian, sl.LayerStyle.StrokeColor[i]); err != nil {
+				if err := binary.Write(&asl, binary.BigEndian, style.StrokeColor[i]); err != nil {
 					return nil, err
 				}
 			}
@@ -149,3 +148,148 @@ func writeASLString(buf *bytes.Buffer, s string, stringType string) error {
 	}
 	return nil
 }
+
+// ParseLayerStylesASL reads ASL data written by CreateLayerStylesASL and
+// returns the styles keyed by their layer style UUID. Other ASL data, such
+// as the full Photoshop descriptors Krita writes, is reported as an error.
+func ParseLayerStylesASL(data []byte) (map[string]*layers.LayerStyle, error) {
+	r := &aslReader{data: data}
+	if r.uint16() != 2 || !r.expect("8BSL") || r.uint16() != 3 {
+		return nil, errors.New("asl: invalid header")
+	}
+	r.uint32()
+	numStyles := int(r.uint32())
+	styles := make(map[string]*layers.LayerStyle)
+	for i := 0; i < numStyles && r.err == nil; i++ {
+		size := int(r.uint32())
+		end := r.pos + size
+		if size < 0 || end > len(r.data) {
+			return nil, errors.New("asl: truncated style")
+		}
+		style := &layers.LayerStyle{StrokeStyle: "OutF", StrokeBlendMode: "Nrml"}
+		r.expect("null")
+		r.expect("Nm  ")
+		r.expect("TEXT")
+		r.string()
+		r.expect("Idnt")
+		r.expect("TEXT")
+		id, err := uuid.Parse(strings.TrimPrefix(r.string(), "%"))
+		if err != nil {
+			return nil, fmt.Errorf("asl: invalid style id: %w", err)
+		}
+		style.LayerStyleUUID = id.String()
+		for _, tag := range []string{"StyL", "documentMode", "Objc", "documentMode", "Lefx", "Objc", "Lefx", "Scl ", "UntF#Prc"} {
+			r.expect(tag)
+		}
+		style.Scale = r.float64()
+		r.expect("masterFXSwitch")
+		r.expect("bool")
+		style.Enabled = r.byte() != 0
+		if r.pos < end {
+			for _, tag := range []string{"FrFX", "Objc", "FrFX", "enab", "bool"} {
+				r.expect(tag)
+			}
+			style.StrokeEnabled = r.byte() != 0
+			for _, tag := range []string{"Style", "enum", "FStl"} {
+				r.expect(tag)
+			}
+			style.StrokeStyle = string(r.bytes(4))
+			for _, tag := range []string{"PntT", "enum", "FrFl", "SClr", "Md  ", "enum", "BlnM"} {
+				r.expect(tag)
+			}
+			style.StrokeBlendMode = string(r.bytes(4))
+			r.expect("Opct")
+			r.expect("UntF#Prc")
+			style.StrokeOpacity = r.float64()
+			r.expect("Sz  ")
+			r.expect("UntF#Pxl")
+			style.StrokeSize = r.float64()
+			for _, tag := range []string{"Clr ", "Objc", "RGBC"} {
+				r.expect(tag)
+			}
+			for c, ch := range []string{"Rd  ", "Grn ", "Bl  "} {
+				r.expect(ch)
+				r.expect("doub")
+				style.StrokeColor[c] = r.float64()
+			}
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		r.pos = end
+		styles[style.LayerStyleUUID] = style
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return styles, nil
+}
+
+// aslReader is a cursor over ASL data that records the first error.
+type aslReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+// bytes returns the next n bytes, or nil once a read has failed. Lengths
+// are checked against the data left before anything is allocated.
+func (r *aslReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data)-r.pos {
+		r.err = errors.New("asl: unexpected end of data")
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+// fixed returns the next n bytes of a fixed-size value, or n zero bytes
+// once a read has failed.
+func (r *aslReader) fixed(n int) []byte {
+	if b := r.bytes(n); b != nil {
+		return b
+	}
+	return make([]byte, n)
+}
+
+func (r *aslReader) expect(tag string) bool {
+	if string(r.bytes(len(tag))) != tag && r.err == nil {
+		r.err = fmt.Errorf("asl: expected %q at offset %d", tag, r.pos-len(tag))
+	}
+	return r.err == nil
+}
+
+func (r *aslReader) byte() byte {
+	return r.fixed(1)[0]
+}
+
+func (r *aslReader) uint16() uint16 {
+	return binary.BigEndian.Uint16(r.fixed(2))
+}
+
+func (r *aslReader) uint32() uint32 {
+	return binary.BigEndian.Uint32(r.fixed(4))
+}
+
+func (r *aslReader) float64() float64 {
+	return math.Float64frombits(binary.BigEndian.Uint64(r.fixed(8)))
+}
+
+// string reads an "embedded" string as written by writeASLString.
+func (r *aslReader) string() string {
+	n := int(r.uint32())
+	encoded := r.bytes(n)
+	r.bytes((4 - n%4) % 4)
+	var sb strings.Builder
+	for i := 0; i+1 < len(encoded); i += 2 {
+		if encoded[i] == 0 && encoded[i+1] == 0 {
+			break
+		}
+		sb.WriteByte(encoded[i])
+	}
+	return sb.String()
+}
@@ -0,0 +1,30 @@
+package asl_test
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/cozy-creator/kritago/pkg/asl"
+)
+
+// TestParseRejectsBadLengths checks that lengths read from the data are
+// checked before anything is allocated for them.
+func TestParseRejectsBadLengths(t *testing.T) {
+	header := func(numStyles uint32) []byte {
+		b := []byte{0, 2, '8', 'B', 'S', 'L', 0, 3, 0, 0, 0, 16}
+		return binary.BigEndian.AppendUint32(b, numStyles)
+	}
+	style := func(nameLen uint32) []byte {
+		body := append([]byte("nullNm  TEXT"), binary.BigEndian.AppendUint32(nil, nameLen)...)
+		return append(binary.BigEndian.AppendUint32(nil, uint32(len(body))), body...)
+	}
+	for name, data := range map[string][]byte{
+		"style count": header(0xffffffff),
+		"string":      append(header(1), style(0xfffffff0)...),
+		"truncated":   append(header(1), style(8)...),
+	} {
+		if _, err := asl.ParseLayerStylesASL(data); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
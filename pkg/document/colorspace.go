@@ -0,0 +1,268 @@
+package document
+
+import (
+	"encoding/binary"
+	"image/color"
+	"math"
+
+	"github.com/cozy-creator/kritago/pkg/layers"
+)
+
+// encodePixel stores c in dst using the pixel layout Krita uses for cs.
+// Channels are little-endian; integer RGB is stored B, G, R, A and float
+// RGB R, G, B, A, as in Krita's color space traits. Float RGB is linear
+// light, matching the profile those color spaces are written with.
+func encodePixel(cs layers.ColorSpace, c color.NRGBA64, dst []byte) {
+	switch cs {
+	case layers.RGBA8:
+		dst[0], dst[1], dst[2], dst[3] = uint8(c.B>>8), uint8(c.G>>8), uint8(c.R>>8), uint8(c.A>>8)
+	case layers.RGBA16:
+		put16(dst, c.B, c.G, c.R, c.A)
+	case layers.RGBAF16, layers.RGBAF32:
+		encodeFloatPixel(cs, layers.FloatModel.Convert(c).(layers.FloatColor), dst)
+	case layers.GrayA8:
+		dst[0], dst[1] = uint8(luma(c)>>8), uint8(c.A>>8)
+	case layers.GrayA16:
+		put16(dst, luma(c), c.A)
+	case layers.CMYKA8, layers.CMYKA16:
+		cy, m, y, k := rgbToCMYK(c)
+		if cs == layers.CMYKA8 {
+			dst[0], dst[1], dst[2], dst[3], dst[4] = uint8(cy>>8), uint8(m>>8), uint8(y>>8), uint8(k>>8), uint8(c.A>>8)
+		} else {
+			put16(dst, cy, m, y, k, c.A)
+		}
+	case layers.LabA8, layers.LabA16:
+		l, a, b := rgbToLab(c)
+		if cs == layers.LabA8 {
+			dst[0] = uint8(math.Round(clamp01(l/100) * 255))
+			dst[1] = uint8(math.Round(math.Max(0, math.Min(255, a+128))))
+			dst[2] = uint8(math.Round(math.Max(0, math.Min(255, b+128))))
+			dst[3] = uint8(c.A >> 8)
+		} else {
+			put16(dst, uint16(math.Round(clamp01(l/100)*0xffff)), labAxis16(a), labAxis16(b), c.A)
+		}
+	case layers.Alpha:
+		dst[0] = uint8(c.A >> 8)
+	}
+}
+
+// decodePixel reads one pixel stored in cs, the inverse of encodePixel.
+func decodePixel(cs layers.ColorSpace, src []byte) color.NRGBA64 {
+	switch cs {
+	case layers.RGBA8:
+		return color.NRGBA64{R: widen(src[2]), G: widen(src[1]), B: widen(src[0]), A: widen(src[3])}
+	case layers.RGBA16:
+		v := get16(src, 4)
+		return color.NRGBA64{R: v[2], G: v[1], B: v[0], A: v[3]}
+	case layers.RGBAF16, layers.RGBAF32:
+		f := decodeFloatPixel(cs, src)
+		ch := func(v float32) uint16 { return fromUnit(layers.LinearToSRGB(float64(v))) }
+		return color.NRGBA64{R: ch(f.R), G: ch(f.G), B: ch(f.B), A: fromUnit(float64(f.A))}
+	case layers.GrayA8:
+		y := widen(src[0])
+		return color.NRGBA64{R: y, G: y, B: y, A: widen(src[1])}
+	case layers.GrayA16:
+		v := get16(src, 2)
+		return color.NRGBA64{R: v[0], G: v[0], B: v[0], A: v[1]}
+	case layers.CMYKA8:
+		return cmykToRGB(widen(src[0]), widen(src[1]), widen(src[2]), widen(src[3]), widen(src[4]))
+	case layers.CMYKA16:
+		v := get16(src, 5)
+		return cmykToRGB(v[0], v[1], v[2], v[3], v[4])
+	case layers.LabA8:
+		return labToRGB(float64(src[0])/255*100, float64(src[1])-128, float64(src[2])-128, widen(src[3]))
+	case layers.LabA16:
+		v := get16(src, 4)
+		return labToRGB(float64(v[0])/0xffff*100, float64(v[1])/257-128, float64(v[2])/257-128, v[3])
+	case layers.Alpha:
+		return color.NRGBA64{R: 0xffff, G: 0xffff, B: 0xffff, A: widen(src[0])}
+	}
+	return color.NRGBA64{}
+}
+
+// encodeFloatPixel stores c in dst in the float RGB color space cs,
+// keeping values outside [0, 1].
+func encodeFloatPixel(cs layers.ColorSpace, c layers.FloatColor, dst []byte) {
+	for i, v := range [4]float32{c.R, c.G, c.B, c.A} {
+		if cs == layers.RGBAF16 {
+			binary.LittleEndian.PutUint16(dst[2*i:], halfBits(float64(v)))
+		} else {
+			binary.LittleEndian.PutUint32(dst[4*i:], math.Float32bits(v))
+		}
+	}
+}
+
+// decodeFloatPixel reads one pixel stored in the float RGB color space cs.
+func decodeFloatPixel(cs layers.ColorSpace, src []byte) layers.FloatColor {
+	var v [4]float32
+	for i := range v {
+		if cs == layers.RGBAF16 {
+			v[i] = float32(halfValue(binary.LittleEndian.Uint16(src[2*i:])))
+		} else {
+			v[i] = math.Float32frombits(binary.LittleEndian.Uint32(src[4*i:]))
+		}
+	}
+	return layers.FloatColor{R: v[0], G: v[1], B: v[2], A: v[3]}
+}
+
+func put16(dst []byte, values ...uint16) {
+	for i, v := range values {
+		binary.LittleEndian.PutUint16(dst[2*i:], v)
+	}
+}
+
+func get16(src []byte, n int) []uint16 {
+	v := make([]uint16, n)
+	for i := range v {
+		v[i] = binary.LittleEndian.Uint16(src[2*i:])
+	}
+	return v
+}
+
+func widen(v uint8) uint16 { return uint16(v) * 0x101 }
+
+func unit(v uint16) float64 { return float64(v) / 0xffff }
+
+func fromUnit(v float64) uint16 {
+	if math.IsNaN(v) {
+		return 0
+	}
+	return uint16(math.Round(clamp01(v) * 0xffff))
+}
+
+// luma returns the gray level of c with the weights image/color uses.
+func luma(c color.NRGBA64) uint16 {
+	return uint16((19595*uint32(c.R) + 38470*uint32(c.G) + 7471*uint32(c.B) + 1<<15) >> 16)
+}
+
+// rgbToCMYK converts with the naive formula of image/color.
+func rgbToCMYK(c color.NRGBA64) (cy, m, y, k uint16) {
+	w := max(c.R, c.G, c.B)
+	if w == 0 {
+		return 0, 0, 0, 0xffff
+	}
+	ink := func(v uint16) uint16 { return uint16((uint32(w-v) * 0xffff) / uint32(w)) }
+	return ink(c.R), ink(c.G), ink(c.B), 0xffff - w
+}
+
+func cmykToRGB(cy, m, y, k, a uint16) color.NRGBA64 {
+	w := uint32(0xffff - k)
+	ch := func(v uint16) uint16 { return uint16((0xffff - uint32(v)) * w / 0xffff) }
+	return color.NRGBA64{R: ch(cy), G: ch(m), B: ch(y), A: a}
+}
+
+// halfBits converts v to IEEE 754 half precision, rounding to nearest.
+func halfBits(v float64) uint16 {
+	bits := math.Float32bits(float32(v))
+	sign := uint16(bits>>16) & 0x8000
+	exp := int((bits>>23)&0xff) - 127 + 15
+	mant := bits & 0x7fffff
+	switch {
+	case exp >= 31:
+		return sign | 0x7c00
+	case exp <= 0:
+		if exp < -10 {
+			return sign
+		}
+		mant |= 0x800000
+		shift := uint(14 - exp)
+		return sign | uint16((mant+(1<<(shift-1)))>>shift)
+	}
+	h := sign | uint16(exp)<<10 | uint16(mant>>13)
+	if mant&0x1000 != 0 {
+		h++ // round half up; a carry into the exponent stays correct
+	}
+	return h
+}
+
+// halfValue converts IEEE 754 half precision bits to a float.
+func halfValue(h uint16) float64 {
+	sign := 1.0
+	if h&0x8000 != 0 {
+		sign = -1
+	}
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	switch exp {
+	case 0:
+		return sign * math.Ldexp(mant, -24)
+	case 31:
+		if mant != 0 {
+			return math.NaN()
+		}
+		return sign * math.Inf(1)
+	}
+	return sign * math.Ldexp(1+mant/1024, exp-15)
+}
+
+// D50 white point and the matrix from linear sRGB to D50 XYZ, matching the
+// colorants of the built-in sRGB profile.
+var (
+	d50         = [3]float64{0.9642, 1.0, 0.8249}
+	srgbToXYZ50 = [3][3]float64{
+		{0.436066, 0.385147, 0.143066},
+		{0.222488, 0.716873, 0.060608},
+		{0.013916, 0.097076, 0.714096},
+	}
+	xyz50ToSRGB = invert3(srgbToXYZ50)
+)
+
+const (
+	labEpsilon = 216.0 / 24389
+	labKappa   = 24389.0 / 27
+)
+
+// rgbToLab converts an sRGB color to CIE Lab relative to D50.
+func rgbToLab(c color.NRGBA64) (l, a, b float64) {
+	rgb := [3]float64{layers.SRGBToLinear(unit(c.R)), layers.SRGBToLinear(unit(c.G)), layers.SRGBToLinear(unit(c.B))}
+	var f [3]float64
+	for i := range f {
+		t := (srgbToXYZ50[i][0]*rgb[0] + srgbToXYZ50[i][1]*rgb[1] + srgbToXYZ50[i][2]*rgb[2]) / d50[i]
+		if t > labEpsilon {
+			f[i] = math.Cbrt(t)
+		} else {
+			f[i] = (labKappa*t + 16) / 116
+		}
+	}
+	return 116*f[1] - 16, 500 * (f[0] - f[1]), 200 * (f[1] - f[2])
+}
+
+func labToRGB(l, a, b float64, alpha uint16) color.NRGBA64 {
+	fy := (l + 16) / 116
+	f := [3]float64{fy + a/500, fy, fy - b/200}
+	var xyz [3]float64
+	for i, v := range f {
+		t := v * v * v
+		if t <= labEpsilon {
+			t = (116*v - 16) / labKappa
+		}
+		xyz[i] = t * d50[i]
+	}
+	var rgb [3]uint16
+	for i := range rgb {
+		lin := xyz50ToSRGB[i][0]*xyz[0] + xyz50ToSRGB[i][1]*xyz[1] + xyz50ToSRGB[i][2]*xyz[2]
+		rgb[i] = fromUnit(layers.LinearToSRGB(clamp01(lin)))
+	}
+	return color.NRGBA64{R: rgb[0], G: rgb[1], B: rgb[2], A: alpha}
+}
+
+// labAxis16 encodes an a or b coordinate the way lcms stores 16-bit Lab.
+func labAxis16(v float64) uint16 {
+	return uint16(math.Round(math.Max(0, math.Min(0xffff, (v+128)*257))))
+}
+
+func invert3(m [3][3]float64) [3][3]float64 {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	var inv [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			// Cofactor of m[j][i], giving the transposed adjugate.
+			a, b := (j+1)%3, (j+2)%3
+			c, d := (i+1)%3, (i+2)%3
+			inv[i][j] = (m[a][c]*m[b][d] - m[a][d]*m[b][c]) / det
+		}
+	}
+	return inv
+}
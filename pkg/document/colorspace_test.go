@@ -0,0 +1,141 @@
+package document_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/cozy-creator/kritago/pkg/document"
+	"github.com/cozy-creator/kritago/pkg/layers"
+)
+
+// deviceRoundTrip encodes img in cs and decodes it again.
+func deviceRoundTrip(t *testing.T, img image.Image, cs layers.ColorSpace) image.Image {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := document.EncodePaintDevice(&buf, img, cs, nil); err != nil {
+		t.Fatalf("encode %s: %v", cs, err)
+	}
+	got, _, err := document.DecodePaintDevice(&buf, cs, nil)
+	if err != nil {
+		t.Fatalf("decode %s: %v", cs, err)
+	}
+	return got
+}
+
+func TestFloatColorSpacesKeepHDRValues(t *testing.T) {
+	img := layers.NewFloatRGBA(image.Rect(0, 0, 2, 1))
+	img.SetFloat(0, 0, layers.FloatColor{R: 2.5, G: 0.5, B: 0.1, A: 1})
+	img.SetFloat(1, 0, layers.FloatColor{R: 16, G: 0, B: 1.0 / 3, A: 0.25})
+	for _, tt := range []struct {
+		cs  layers.ColorSpace
+		tol float64
+	}{
+		{layers.RGBAF16, 1.0 / 1024},
+		{layers.RGBAF32, 0},
+	} {
+		got, ok := deviceRoundTrip(t, img, tt.cs).(*layers.FloatRGBA)
+		if !ok {
+			t.Fatalf("%s decoded as %T, want *layers.FloatRGBA", tt.cs, got)
+		}
+		for x := 0; x < 2; x++ {
+			want, c := img.FloatAt(x, 0), got.FloatAt(x, 0)
+			for i, pair := range [][2]float32{{c.R, want.R}, {c.G, want.G}, {c.B, want.B}, {c.A, want.A}} {
+				if d := math.Abs(float64(pair[0] - pair[1])); d > tt.tol*math.Max(1, float64(pair[1])) {
+					t.Errorf("%s pixel %d channel %d = %v, want %v", tt.cs, x, i, pair[0], pair[1])
+				}
+			}
+		}
+	}
+}
+
+// TestFloatColorSpacesAreLinear checks that 8-bit sRGB values are stored as
+// linear light, matching the g10 profile of the float color spaces.
+func TestFloatColorSpacesAreLinear(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{128, 128, 128, 255})
+	var buf bytes.Buffer
+	if err := document.EncodePaintDevice(&buf, img, layers.RGBAF32, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := document.DecodePaintDevice(&buf, layers.RGBAF32, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := got.(*layers.FloatRGBA).FloatAt(0, 0).R; math.Abs(float64(r)-0.2158) > 1e-4 {
+		t.Errorf("stored value = %v, want 0.2158", r)
+	}
+	if c := color.NRGBAModel.Convert(got.At(0, 0)).(color.NRGBA); c != (color.NRGBA{128, 128, 128, 255}) {
+		t.Errorf("read back as %v", c)
+	}
+}
+
+func TestFloatLayerRoundTrip(t *testing.T) {
+	img := layers.NewFloatRGBA(image.Rect(0, 0, 4, 4))
+	img.SetFloat(1, 2, layers.FloatColor{R: 4, G: 2, B: 1, A: 1})
+	doc := document.NewKritaDocument(4, 4)
+	doc.AddImageLayer(img, "", "HDR", 0, 0, layers.Opaque)
+	layer := doc.Layers[0].(*layers.PaintLayer)
+	layer.DefaultPixel = layers.FloatColor{R: 0.5, A: 0.5}
+
+	got := roundTrip(t, doc).Layers[0].(*layers.PaintLayer)
+	if got.ColorSpace != layers.RGBAF32 {
+		t.Errorf("color space = %q, want %q", got.ColorSpace, layers.RGBAF32)
+	}
+	if c := got.Image.(*layers.FloatRGBA).FloatAt(1, 2); c != (layers.FloatColor{R: 4, G: 2, B: 1, A: 1}) {
+		t.Errorf("pixel = %+v", c)
+	}
+	if c := got.DefaultPixel; c != color.Color(layers.FloatColor{R: 0.5, A: 0.5}) {
+		t.Errorf("default pixel = %+v", c)
+	}
+}
+
+func TestLabRoundTrip(t *testing.T) {
+	src := gradient(64)
+	got := deviceRoundTrip(t, src, layers.LabA16)
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			want := src.NRGBAAt(x, y)
+			c := color.NRGBAModel.Convert(got.At(x, y)).(color.NRGBA)
+			for i, pair := range [][2]uint8{{c.R, want.R}, {c.G, want.G}, {c.B, want.B}, {c.A, want.A}} {
+				if d := int(pair[0]) - int(pair[1]); d > 1 || d < -1 {
+					t.Fatalf("(%d,%d) channel %d = %d, want %d", x, y, i, pair[0], pair[1])
+				}
+			}
+		}
+	}
+}
+
+// TestBundledProfiles checks the profiles written for documents that do not
+// supply their own against the checksums of the bundled .icc files.
+func TestBundledProfiles(t *testing.T) {
+	for _, tt := range []struct {
+		cs           layers.ColorSpace
+		name, sha256 string
+	}{
+		{layers.RGBA8, "sRGB-elle-V2-srgbtrc.icc", "1be44fc4de9bc7db6c47c13ea635a4809cf586d0e9a4d40ca34f0ec49f5b6705"},
+		{layers.RGBAF32, "sRGB-elle-V2-g10.icc", "b3e25194ba9711bf6f91491938f389100192749d5fda5cb0f0ab089eb86bd966"},
+		{layers.GrayA8, "Gray-D50-elle-V2-srgbtrc.icc", "559c0aff996dfd3544be69c9e56074f52112de6bc389b76aa497c6a3f085ae37"},
+	} {
+		doc := document.NewKritaDocument(16, 16)
+		doc.ColorSpace = tt.cs
+		files := archiveFiles(t, doc)
+		var icc string
+		for name, data := range files {
+			if strings.HasSuffix(name, "/annotations/icc") {
+				icc = data
+			}
+		}
+		if sum := sha256.Sum256([]byte(icc)); hex.EncodeToString(sum[:]) != tt.sha256 {
+			t.Errorf("%s: profile checksum = %x, want %s", tt.cs, sum, tt.sha256)
+		}
+		if !strings.Contains(files["maindoc.xml"], `profile="`+tt.name+`"`) {
+			t.Errorf("%s: maindoc.xml does not name %s", tt.cs, tt.name)
+		}
+	}
+}
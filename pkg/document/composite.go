@@ -0,0 +1,827 @@
+package document
+
+import (
+	"image"
+	"image/draw"
+	"math"
+
+	"github.com/cozy-creator/kritago/pkg/layers"
+)
+
+// Composite flattens the document's visible layers into a Width x Height
+// image, honoring layer offsets, opacity and blend modes. Shape layers are
+// not rasterized and do not contribute, and composite ops without a formula
+// here, such as those for normal maps, composite as BlendNormal. Paint
+// layers whose Source fails to produce pixels are left out. Transparency masks apply to paint
+// layers and groups, but not to pass-through groups. Filters are not
+// rendered: adjustment layers and filter masks are skipped, and generator
+// layers contribute their Preview. Layers of kinds the package does not
+// model, read as a RawLayer, are left out.
+//
+// Composite holds the whole canvas in memory; saving composites the merged
+// image in bands of rows instead.
+func (doc *KritaDocument) Composite() *image.RGBA {
+	canvas := doc.compositeRegion(image.Rect(0, 0, doc.Width, doc.Height))
+	out := image.NewRGBA(canvas.Bounds())
+	draw.Draw(out, out.Bounds(), canvas, canvas.Bounds().Min, draw.Src)
+	return out
+}
+
+// compositeRegion flattens the part r of the canvas. Layers only render
+// and read from their sources the pixels inside r.
+func (doc *KritaDocument) compositeRegion(r image.Rectangle) *image.NRGBA {
+	canvas := image.NewNRGBA(r)
+	compositeLayers(canvas, doc.Layers, image.Point{})
+	return canvas
+}
+
+// compositeBand is the number of rows saving composites at a time.
+const compositeBand = tileSize
+
+// compositeBands flattens the canvas a band of compositeBand rows at a time,
+// top to bottom, and passes each band to fn. The bands share one buffer, so
+// fn must not keep them.
+func (doc *KritaDocument) compositeBands(fn func(band *image.NRGBA) error) error {
+	band := image.NewNRGBA(image.Rect(0, 0, doc.Width, min(compositeBand, doc.Height)))
+	buf := band.Pix
+	for top := 0; top < doc.Height; top += compositeBand {
+		band.Rect = image.Rect(0, top, doc.Width, min(top+compositeBand, doc.Height))
+		band.Pix = buf[:band.Rect.Dy()*band.Stride]
+		clear(band.Pix)
+		compositeLayers(band, doc.Layers, image.Point{})
+		if err := fn(band); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// thumbnail downscales the bands of an image, fed to add in any order, by
+// averaging the pixels that fall into each thumbnail pixel.
+type thumbnail struct {
+	src  image.Rectangle
+	dst  image.Rectangle
+	sums [][4]uint64 // premultiplied R, G, B and A
+	n    []uint64
+}
+
+func newThumbnail(src, dst image.Rectangle) *thumbnail {
+	return &thumbnail{
+		src:  src,
+		dst:  dst,
+		sums: make([][4]uint64, dst.Dx()*dst.Dy()),
+		n:    make([]uint64, dst.Dx()*dst.Dy()),
+	}
+}
+
+func (t *thumbnail) add(band *image.NRGBA) {
+	b := band.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := (y - t.src.Min.Y) * t.dst.Dy() / t.src.Dy() * t.dst.Dx()
+		for x := b.Min.X; x < b.Max.X; x++ {
+			i := row + (x-t.src.Min.X)*t.dst.Dx()/t.src.Dx()
+			p := band.Pix[band.PixOffset(x, y):]
+			a := uint64(p[3])
+			t.sums[i][0] += uint64(p[0]) * a
+			t.sums[i][1] += uint64(p[1]) * a
+			t.sums[i][2] += uint64(p[2]) * a
+			t.sums[i][3] += a
+			t.n[i]++
+		}
+	}
+}
+
+// image returns the averaged pixels.
+func (t *thumbnail) image() *image.NRGBA {
+	img := image.NewNRGBA(t.dst)
+	for i, sum := range t.sums {
+		if t.n[i] == 0 || sum[3] == 0 {
+			continue
+		}
+		p := img.Pix[4*i:]
+		for c := 0; c < 3; c++ {
+			p[c] = uint8((sum[c] + sum[3]/2) / sum[3])
+		}
+		p[3] = uint8((sum[3] + t.n[i]/2) / t.n[i])
+	}
+	return img
+}
+
+// compositeLayers draws a level of the layer tree onto dst, bottommost
+// layer first.
+func compositeLayers(dst *image.NRGBA, list []layers.Layer, offset image.Point) {
+	for i := len(list) - 1; i >= 0; i-- {
+		compositeLayer(dst, list[i], offset)
+	}
+}
+
+func compositeLayer(dst *image.NRGBA, layer layers.Layer, offset image.Point) {
+	if !layer.IsVisible() {
+		return
+	}
+	x, y := layer.Offset()
+	at := offset.Add(image.Pt(x, y))
+	switch l := layer.(type) {
+	case *layers.PaintLayer:
+		img, area := l.Image, image.Rectangle{}
+		if l.Source != nil {
+			// Only the part of the source on the canvas is read.
+			area = l.Source.Bounds().Intersect(dst.Bounds().Sub(at))
+			img = image.Transparent
+			if !area.Empty() {
+				var err error
+				if img, err = l.Source.Region(area); err != nil {
+					return
+				}
+			}
+		} else if img != nil {
+			area = img.Bounds().Intersect(dst.Bounds().Sub(at))
+		}
+		if img == nil {
+			return
+		}
+		// Image coordinates are layer coordinates, and the default pixel
+		// covers the rest of the canvas.
+		bounds := area.Add(at)
+		if l.DefaultPixel != nil {
+			bounds = dst.Bounds()
+		}
+		src := image.NewNRGBA(bounds)
+		if l.DefaultPixel != nil {
+			draw.Draw(src, bounds, image.NewUniform(l.DefaultPixel), image.Point{}, draw.Src)
+		}
+		draw.Draw(src, area.Add(at), img, area.Min, draw.Src)
+		applyMasks(src, l.GetMasks(), offset)
+		blendInto(dst, src, l.GetOpacity(), l.GetBlendMode())
+	case *layers.GeneratorLayer:
+		if l.Preview == nil {
+			return
+		}
+		bounds := l.Preview.Bounds().Add(at).Intersect(dst.Bounds())
+		src := image.NewNRGBA(bounds)
+		draw.Draw(src, bounds, l.Preview, bounds.Min.Sub(at), draw.Src)
+		applyMasks(src, l.GetMasks(), offset)
+		blendInto(dst, src, l.GetOpacity(), l.GetBlendMode())
+	case layers.Container:
+		// Pass-through groups blend their children straight into the
+		// parent; other groups are flattened first and blended as one.
+		if g, ok := l.(*layers.GroupLayer); ok && g.Passthrough {
+			compositeLayers(dst, l.ChildLayers(), at)
+			return
+		}
+		group := image.NewNRGBA(dst.Bounds())
+		compositeLayers(group, l.ChildLayers(), at)
+		applyMasks(group, l.GetMasks(), offset)
+		blendInto(dst, group, l.GetOpacity(), l.GetBlendMode())
+	}
+}
+
+// applyMasks scales the alpha of src, a layer rendered in a group at
+// offset, by the values of its visible transparency masks.
+func applyMasks(src *image.NRGBA, masks []layers.Mask, offset image.Point) {
+	for _, m := range masks {
+		tm, ok := m.(*layers.TransparencyMask)
+		if !ok || !tm.IsVisible() {
+			continue
+		}
+		at := offset.Add(image.Pt(tm.X, tm.Y))
+		var view image.Image
+		if tm.Image != nil {
+			view = layers.AlphaView(tm.Image)
+		}
+		b := src.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				v := uint32(tm.DefaultAlpha)
+				if p := image.Pt(x, y).Sub(at); view != nil && p.In(view.Bounds()) {
+					_, _, _, a := view.At(p.X, p.Y).RGBA()
+					v = a >> 8
+				}
+				i := src.PixOffset(x, y) + 3
+				src.Pix[i] = uint8((uint32(src.Pix[i])*v + 127) / 255)
+			}
+		}
+	}
+}
+
+// blendInto composites src over dst where they overlap. Opacity scales the
+// source alpha.
+func blendInto(dst, src *image.NRGBA, opacity layers.Opacity, mode layers.BlendMode) {
+	r := dst.Bounds().Intersect(src.Bounds())
+	separable := separableBlends[mode]
+	nonSeparable := nonSeparableBlends[mode]
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			s := src.Pix[src.PixOffset(x, y):]
+			d := dst.Pix[dst.PixOffset(x, y):]
+			as := float64(s[3]) / 255 * float64(opacity)
+			ab := float64(d[3]) / 255
+			var cs, cb [3]float64
+			for c := 0; c < 3; c++ {
+				cs[c] = float64(s[c]) / 255
+				cb[c] = float64(d[c]) / 255
+			}
+
+			switch mode {
+			case layers.BlendErase:
+				d[3] = uint8(math.Round(ab * (1 - as) * 255))
+				continue
+			case layers.BlendBehind:
+				// The source goes underneath the backdrop.
+				ao := ab + as*(1-ab)
+				if ao == 0 {
+					continue
+				}
+				for c := 0; c < 3; c++ {
+					d[c] = uint8(math.Round((ab*cb[c] + as*cs[c]*(1-ab)) / ao * 255))
+				}
+				d[3] = uint8(math.Round(ao * 255))
+				continue
+			case layers.BlendCopy:
+				for c := 0; c < 3; c++ {
+					d[c] = s[c]
+				}
+				d[3] = uint8(math.Round(as * 255))
+				continue
+			case layers.BlendCopyRed, layers.BlendCopyGreen, layers.BlendCopyBlue:
+				// One channel moves towards the source; alpha is kept.
+				c := copyChannels[mode]
+				d[c] = uint8(math.Round((cb[c] + (cs[c]-cb[c])*as) * 255))
+				continue
+			case layers.BlendDissolve:
+				// Pixels show the source opaquely, at random with a
+				// chance of its alpha.
+				if as > 0 && dissolveNoise(x, y) < as {
+					copy(d[:3], s[:3])
+					d[3] = 255
+				}
+				continue
+			case layers.BlendAlphaDarken:
+				// The color moves towards the source and the alpha up to
+				// the opacity, as Krita's brush-like alpha darken does.
+				if as == 0 {
+					continue
+				}
+				for c := 0; c < 3; c++ {
+					if ab == 0 {
+						d[c] = s[c]
+					} else {
+						d[c] = uint8(math.Round((cb[c] + (cs[c]-cb[c])*as) * 255))
+					}
+				}
+				if o := float64(opacity); o > ab {
+					d[3] = uint8(math.Round((ab + (o-ab)*float64(s[3])/255) * 255))
+				}
+				continue
+			case layers.BlendGreater:
+				greater(d, cb, cs, ab, as)
+				continue
+			}
+			if as == 0 {
+				continue
+			}
+
+			mixed := cs
+			switch {
+			case separable != nil:
+				for c := 0; c < 3; c++ {
+					mixed[c] = clamp01(separable(cb[c], cs[c]))
+				}
+			case nonSeparable != nil:
+				mixed = nonSeparable(cb, cs)
+			}
+			ao := as + ab*(1-as)
+			for c := 0; c < 3; c++ {
+				v := (1-ab)*cs[c] + ab*mixed[c]
+				d[c] = uint8(math.Round(clamp01((as*v+ab*cb[c]*(1-as))/ao) * 255))
+			}
+			d[3] = uint8(math.Round(ao * 255))
+		}
+	}
+}
+
+// copyChannels maps the channel copying blend modes to the RGB channel
+// they copy.
+var copyChannels = map[layers.BlendMode]int{
+	layers.BlendCopyRed:   0,
+	layers.BlendCopyGreen: 1,
+	layers.BlendCopyBlue:  2,
+}
+
+// dissolveNoise returns a value in [0, 1) that is fixed for each pixel, so
+// dissolve gives the same result on every save.
+func dissolveNoise(x, y int) float64 {
+	h := uint32(x)*0x9e3779b1 ^ uint32(y)*0x85ebca77
+	h ^= h >> 15
+	h *= 0x2c1b3c6d
+	h ^= h >> 12
+	h *= 0x297a2d39
+	h ^= h >> 15
+	return float64(h>>8) / (1 << 24)
+}
+
+// greater composites the pixel d with backdrop color cb and alpha ab and
+// source color cs and alpha as the way Krita's greater op does: the
+// result takes the larger of the two alphas, with a smooth step between
+// them, and the source color in proportion to the alpha it adds.
+func greater(d []uint8, cb, cs [3]float64, ab, as float64) {
+	if as == 0 {
+		return
+	}
+	w := 1 / (1 + math.Exp(-40*(ab-as)))
+	a := math.Max(ab, clamp01(ab*w+as*(1-w)))
+	if a == 0 {
+		return
+	}
+	fakeOpacity := 1 - (1-a)/(1-ab+1e-9)
+	for c := 0; c < 3; c++ {
+		v := cb[c]*ab + (cs[c]-cb[c]*ab)*fakeOpacity
+		d[c] = uint8(math.Round(clamp01(v/a) * 255))
+	}
+	d[3] = uint8(math.Round(a * 255))
+}
+
+// separableBlends holds the blend functions that work on each channel of
+// the backdrop b and source s independently.
+var separableBlends = map[layers.BlendMode]func(b, s float64) float64{
+	layers.BlendMultiply:        func(b, s float64) float64 { return b * s },
+	layers.BlendScreen:          screen,
+	layers.BlendOverlay:         func(b, s float64) float64 { return hardLight(s, b) },
+	layers.BlendDarken:          math.Min,
+	layers.BlendLighten:         math.Max,
+	layers.BlendAdd:             func(b, s float64) float64 { return b + s },
+	layers.BlendLinearDodge:     func(b, s float64) float64 { return b + s },
+	layers.BlendSubtract:        func(b, s float64) float64 { return b - s },
+	layers.BlendInverseSubtract: func(b, s float64) float64 { return s - b },
+	layers.BlendDifference:      func(b, s float64) float64 { return math.Abs(b - s) },
+	layers.BlendEquivalence:     func(b, s float64) float64 { return math.Abs(b - s) },
+	layers.BlendExclusion:       func(b, s float64) float64 { return b + s - 2*b*s },
+	layers.BlendNegation:        func(b, s float64) float64 { return 1 - math.Abs(1-b-s) },
+	layers.BlendGrainMerge:      func(b, s float64) float64 { return b + s - 0.5 },
+	layers.BlendGrainExtract:    func(b, s float64) float64 { return b - s + 0.5 },
+	layers.BlendGeometricMean:   func(b, s float64) float64 { return math.Sqrt(b * s) },
+	layers.BlendAllanon:         func(b, s float64) float64 { return (b + s) / 2 },
+	layers.BlendLinearBurn:      func(b, s float64) float64 { return b + s - 1 },
+	layers.BlendLinearLight:     func(b, s float64) float64 { return b + 2*s - 1 },
+	layers.BlendDivide: func(b, s float64) float64 {
+		if s == 0 {
+			if b == 0 {
+				return 0
+			}
+			return 1
+		}
+		return b / s
+	},
+	layers.BlendColorDodge: colorDodge,
+	layers.BlendColorBurn:  colorBurn,
+	layers.BlendHardLight:  hardLight,
+	layers.BlendSoftLight: func(b, s float64) float64 {
+		if s <= 0.5 {
+			return b - (1-2*s)*b*(1-b)
+		}
+		return b + (2*s-1)*(math.Sqrt(b)-b)
+	},
+	layers.BlendSoftLightSVG: func(b, s float64) float64 {
+		if s <= 0.5 {
+			return b - (1-2*s)*b*(1-b)
+		}
+		d := math.Sqrt(b)
+		if b <= 0.25 {
+			d = ((16*b-12)*b + 4) * b
+		}
+		return b + (2*s-1)*(d-b)
+	},
+	layers.BlendVividLight: func(b, s float64) float64 {
+		if s <= 0.5 {
+			return colorBurn(b, 2*s)
+		}
+		return colorDodge(b, 2*s-1)
+	},
+	layers.BlendPinLight: func(b, s float64) float64 {
+		if s <= 0.5 {
+			return math.Min(b, 2*s)
+		}
+		return math.Max(b, 2*s-1)
+	},
+	layers.BlendHardMix: func(b, s float64) float64 {
+		if b > 0.5 {
+			return colorDodge(b, s)
+		}
+		return colorBurn(b, s)
+	},
+	layers.BlendHardMixPhotoshop: func(b, s float64) float64 {
+		if b+s > 1 {
+			return 1
+		}
+		return 0
+	},
+	layers.BlendHardMixSofter: func(b, s float64) float64 { return 3*b - 2*(1-s) },
+	layers.BlendGammaDark: func(b, s float64) float64 {
+		if s == 0 {
+			return 0
+		}
+		return math.Pow(b, 1/s)
+	},
+	layers.BlendGammaLight: math.Pow,
+	layers.BlendShadeIFSIllusions: func(b, s float64) float64 {
+		return 1 - (math.Sqrt(1-s) + (1-b)*s)
+	},
+	layers.BlendParallel: func(b, s float64) float64 {
+		if b == 0 || s == 0 {
+			return 0
+		}
+		return 2 / (1/b + 1/s)
+	},
+	layers.BlendArcTangent: func(b, s float64) float64 {
+		if b == 0 {
+			if s == 0 {
+				return 0
+			}
+			return 1
+		}
+		return 2 * math.Atan(s/b) / math.Pi
+	},
+	layers.BlendAdditiveSubtractive: func(b, s float64) float64 {
+		return math.Abs(math.Sqrt(b) - math.Sqrt(s))
+	},
+	layers.BlendModulo: func(b, s float64) float64 {
+		// Offset like Krita, so a zero source leaves no division by zero.
+		return modulo(b, s+1e-9)
+	},
+	layers.BlendAnd:            bitwise(func(b, s uint8) uint8 { return b & s }),
+	layers.BlendOr:             bitwise(func(b, s uint8) uint8 { return b | s }),
+	layers.BlendXor:            bitwise(func(b, s uint8) uint8 { return b ^ s }),
+	layers.BlendNand:           bitwise(func(b, s uint8) uint8 { return ^(b & s) }),
+	layers.BlendNor:            bitwise(func(b, s uint8) uint8 { return ^(b | s) }),
+	layers.BlendXnor:           bitwise(func(b, s uint8) uint8 { return ^(b ^ s) }),
+	layers.BlendImplication:    bitwise(func(b, s uint8) uint8 { return ^s | b }),
+	layers.BlendNotImplication: bitwise(func(b, s uint8) uint8 { return s &^ b }),
+	layers.BlendConverse:       bitwise(func(b, s uint8) uint8 { return s | ^b }),
+	layers.BlendNotConverse:    bitwise(func(b, s uint8) uint8 { return ^s & b }),
+
+	layers.BlendGammaIllumination: func(b, s float64) float64 {
+		if s == 1 {
+			return 1
+		}
+		return 1 - math.Pow(1-b, 1/(1-s))
+	},
+	layers.BlendEasyDodge: func(b, s float64) float64 {
+		return math.Pow(b, (1-math.Min(s, 0.999999999999))*1.04)
+	},
+	layers.BlendEasyBurn: func(b, s float64) float64 {
+		return 1 - math.Pow(1-math.Min(s, 0.999999999999), b*1.04)
+	},
+	layers.BlendTintIFSIllusions: func(b, s float64) float64 { return b*(1-s) + math.Sqrt(s) },
+	layers.BlendFogLightenIFSIllusions: func(b, s float64) float64 {
+		if s < 0.5 {
+			return 1 - (1-s)*s - (1-b)*(1-s)
+		}
+		return s - (1-b)*(1-s) + (1-s)*(1-s)
+	},
+	layers.BlendFogDarkenIFSIllusions: func(b, s float64) float64 {
+		if s < 0.5 {
+			return (1-s)*s + s*b
+		}
+		return s*b + s - s*s
+	},
+	layers.BlendHardOverlay: func(b, s float64) float64 {
+		if s == 1 {
+			return 1
+		}
+		if s > 0.5 {
+			return b / (2 - 2*s)
+		}
+		return 2 * s * b
+	},
+	layers.BlendSoftLightPegtopDelphi: func(b, s float64) float64 { return b*screen(b, s) + s*b*(1-b) },
+	layers.BlendSoftLightIFSIllusions: func(b, s float64) float64 { return math.Pow(b, math.Pow(2, 2*(0.5-s))) },
+	layers.BlendFlatLight: func(b, s float64) float64 {
+		if s == 0 {
+			return 0
+		}
+		if b > s {
+			return penumbraB(b, s)
+		}
+		return penumbraB(s, b)
+	},
+	layers.BlendSuperLight: func(b, s float64) float64 {
+		if s < 0.5 {
+			return 1 - pNorm(1-b, 1-2*s, 2.875)
+		}
+		return pNorm(b, 2*s-1, 2.875)
+	},
+	layers.BlendPNormA:        func(b, s float64) float64 { return pNorm(b, s, 7.0/3) },
+	layers.BlendPNormB:        func(b, s float64) float64 { return pNorm(b, s, 4) },
+	layers.BlendInterpolation: interpolation,
+	layers.BlendInterpolation2X: func(b, s float64) float64 {
+		v := interpolation(b, s)
+		return interpolation(v, v)
+	},
+	layers.BlendPenumbraA: func(b, s float64) float64 { return penumbraB(s, b) },
+	layers.BlendPenumbraB: penumbraB,
+	layers.BlendPenumbraC: func(b, s float64) float64 { return penumbraD(s, b) },
+	layers.BlendPenumbraD: penumbraD,
+	layers.BlendModuloShift: func(b, s float64) float64 {
+		if s == 1 && b == 0 {
+			return 0
+		}
+		return modulo(b+s, 1+1e-9)
+	},
+	layers.BlendDivisiveModulo: func(b, s float64) float64 {
+		return modulo(b/math.Max(s, 1e-9), 1+1e-9)
+	},
+	layers.BlendReflect: func(b, s float64) float64 { return glow(s, b) },
+	layers.BlendGlow:    glow,
+	layers.BlendHeat:    heat,
+	layers.BlendFreeze:  func(b, s float64) float64 { return heat(s, b) },
+	layers.BlendGleat:   gleat,
+	layers.BlendReeze:   func(b, s float64) float64 { return gleat(s, b) },
+	layers.BlendHelow:   helow,
+	layers.BlendFrect:   frect,
+	layers.BlendFhyrd:   func(b, s float64) float64 { return (frect(b, s) + helow(b, s)) / 2 },
+}
+
+// nonSeparableBlends holds the blend functions that mix whole colors. The
+// HSY modes follow the W3C compositing spec's luma-based hue, saturation,
+// color and luminosity; the others work in HSL, HSV or HSI like Krita's.
+var nonSeparableBlends = map[layers.BlendMode]func(b, s [3]float64) [3]float64{
+	layers.BlendHue:        hsy.hue,
+	layers.BlendSaturation: hsy.saturation,
+	layers.BlendColor:      hsy.color,
+	layers.BlendLuminosity: hsy.lightness,
+	layers.BlendDarkerColor: func(b, s [3]float64) [3]float64 {
+		if lum(s) < lum(b) {
+			return s
+		}
+		return b
+	},
+	layers.BlendLighterColor: func(b, s [3]float64) [3]float64 {
+		if lum(s) > lum(b) {
+			return s
+		}
+		return b
+	},
+	layers.BlendIncSaturation: func(b, s [3]float64) [3]float64 {
+		sb := hsy.sat(b)
+		return hsy.setLightness(setSat(b, sb+(1-sb)*hsy.sat(s)), hsy.light(b))
+	},
+	layers.BlendDecSaturation: func(b, s [3]float64) [3]float64 {
+		return hsy.setLightness(setSat(b, hsy.sat(b)*hsy.sat(s)), hsy.light(b))
+	},
+	layers.BlendIncLuminosity: func(b, s [3]float64) [3]float64 {
+		return hsy.addLightness(b, hsy.light(s))
+	},
+	layers.BlendDecLuminosity: func(b, s [3]float64) [3]float64 {
+		return hsy.addLightness(b, hsy.light(s)-1)
+	},
+	layers.BlendHueHSL:        hsl.hue,
+	layers.BlendSaturationHSL: hsl.saturation,
+	layers.BlendColorHSL:      hsl.color,
+	layers.BlendLightness:     hsl.lightness,
+	layers.BlendHueHSV:        hsv.hue,
+	layers.BlendSaturationHSV: hsv.saturation,
+	layers.BlendColorHSV:      hsv.color,
+	layers.BlendValue:         hsv.lightness,
+	layers.BlendHueHSI:        hsi.hue,
+	layers.BlendSaturationHSI: hsi.saturation,
+	layers.BlendColorHSI:      hsi.color,
+	layers.BlendIntensity:     hsi.lightness,
+}
+
+func screen(b, s float64) float64 { return b + s - b*s }
+
+func hardLight(b, s float64) float64 {
+	if s <= 0.5 {
+		return b * 2 * s
+	}
+	return screen(b, 2*s-1)
+}
+
+func colorDodge(b, s float64) float64 {
+	if b == 0 {
+		return 0
+	}
+	if s >= 1 {
+		return 1
+	}
+	return b / (1 - s)
+}
+
+func colorBurn(b, s float64) float64 {
+	if b >= 1 {
+		return 1
+	}
+	if s <= 0 {
+		return 0
+	}
+	return 1 - (1-b)/s
+}
+
+func modulo(v, m float64) float64 { return v - m*math.Floor(v/m) }
+
+func pNorm(b, s, p float64) float64 {
+	return math.Pow(math.Pow(b, p)+math.Pow(s, p), 1/p)
+}
+
+func interpolation(b, s float64) float64 {
+	if b == 0 && s == 0 {
+		return 0
+	}
+	return 0.5 - 0.25*math.Cos(math.Pi*s) - 0.25*math.Cos(math.Pi*b)
+}
+
+// penumbraB and penumbraD are two of Krita's penumbra ops; swapping the
+// arguments gives penumbra A and C.
+func penumbraB(b, s float64) float64 {
+	switch {
+	case b == 1:
+		return 1
+	case b+s < 1:
+		return clamp01(s/(1-b)) / 2
+	case s == 0:
+		return 0
+	}
+	return 1 - clamp01((1-b)/s)/2
+}
+
+func penumbraD(b, s float64) float64 {
+	if b == 1 {
+		return 1
+	}
+	return 2 * math.Atan(s/(1-b)) / math.Pi
+}
+
+// glow and heat are Krita's quadratic ops; swapping the arguments gives
+// reflect and freeze. gleat, helow and frect pick between them by whether
+// b+s exceeds 1.
+func glow(b, s float64) float64 {
+	if b == 1 {
+		return 1
+	}
+	return s * s / (1 - b)
+}
+
+func heat(b, s float64) float64 {
+	if s == 1 {
+		return 1
+	}
+	if b == 0 {
+		return 0
+	}
+	return 1 - (1-s)*(1-s)/b
+}
+
+func gleat(b, s float64) float64 {
+	if b == 1 {
+		return 1
+	}
+	if b+s > 1 {
+		return glow(b, s)
+	}
+	return heat(b, s)
+}
+
+func helow(b, s float64) float64 {
+	if b+s > 1 {
+		return heat(b, s)
+	}
+	if s == 0 {
+		return 0
+	}
+	return glow(b, s)
+}
+
+func frect(b, s float64) float64 {
+	if b+s > 1 {
+		return heat(s, b)
+	}
+	if b == 0 {
+		return 0
+	}
+	return glow(s, b)
+}
+
+// bitwise applies op to the 8-bit values of each channel.
+func bitwise(op func(b, s uint8) uint8) func(b, s float64) float64 {
+	return func(b, s float64) float64 {
+		return float64(op(uint8(math.Round(b*255)), uint8(math.Round(s*255)))) / 255
+	}
+}
+
+// hsxModel is a hue, saturation and lightness model the component blend
+// modes work in, given by its lightness and saturation of a color.
+type hsxModel struct {
+	light func(c [3]float64) float64
+	sat   func(c [3]float64) float64
+}
+
+var (
+	hsy = hsxModel{lum, sat}
+	hsl = hsxModel{
+		light: func(c [3]float64) float64 { return (maxOf(c) + minOf(c)) / 2 },
+		sat: func(c [3]float64) float64 {
+			l := (maxOf(c) + minOf(c)) / 2
+			if d := 1 - math.Abs(2*l-1); d > 1e-9 {
+				return sat(c) / d
+			}
+			return 1
+		},
+	}
+	hsv = hsxModel{
+		light: maxOf,
+		sat: func(c [3]float64) float64 {
+			if v := maxOf(c); v > 1e-9 {
+				return sat(c) / v
+			}
+			return 0
+		},
+	}
+	hsi = hsxModel{
+		light: func(c [3]float64) float64 { return (c[0] + c[1] + c[2]) / 3 },
+		sat: func(c [3]float64) float64 {
+			if i := (c[0] + c[1] + c[2]) / 3; sat(c) > 1e-9 {
+				return 1 - minOf(c)/i
+			}
+			return 0
+		},
+	}
+)
+
+// hue takes the hue of s and the saturation and lightness of b.
+func (m hsxModel) hue(b, s [3]float64) [3]float64 {
+	return m.setLightness(setSat(s, m.sat(b)), m.light(b))
+}
+
+// saturation takes the saturation of s and the hue and lightness of b.
+func (m hsxModel) saturation(b, s [3]float64) [3]float64 {
+	return m.setLightness(setSat(b, m.sat(s)), m.light(b))
+}
+
+// color takes the hue and saturation of s and the lightness of b.
+func (m hsxModel) color(b, s [3]float64) [3]float64 {
+	return m.setLightness(s, m.light(b))
+}
+
+// lightness takes the lightness of s and the hue and saturation of b.
+func (m hsxModel) lightness(b, s [3]float64) [3]float64 {
+	return m.setLightness(b, m.light(s))
+}
+
+func (m hsxModel) setLightness(c [3]float64, l float64) [3]float64 {
+	return m.addLightness(c, l-m.light(c))
+}
+
+// addLightness shifts every channel of c by d, then clips the color back
+// into gamut while keeping its lightness.
+func (m hsxModel) addLightness(c [3]float64, d float64) [3]float64 {
+	for i := range c {
+		c[i] += d
+	}
+	l := m.light(c)
+	n, x := minOf(c), maxOf(c)
+	for i := range c {
+		if n < 0 && l-n > 1e-9 {
+			c[i] = l + (c[i]-l)*l/(l-n)
+		}
+		if x > 1 && x-l > 1e-9 {
+			c[i] = l + (c[i]-l)*(1-l)/(x-l)
+		}
+	}
+	return c
+}
+
+func lum(c [3]float64) float64 {
+	return 0.3*c[0] + 0.59*c[1] + 0.11*c[2]
+}
+
+func sat(c [3]float64) float64 {
+	return maxOf(c) - minOf(c)
+}
+
+func maxOf(c [3]float64) float64 { return math.Max(c[0], math.Max(c[1], c[2])) }
+
+func minOf(c [3]float64) float64 { return math.Min(c[0], math.Min(c[1], c[2])) }
+
+func setSat(c [3]float64, s float64) [3]float64 {
+	// Order the channel indices by value: min, mid, max.
+	lo, mid, hi := 0, 1, 2
+	if c[lo] > c[mid] {
+		lo, mid = mid, lo
+	}
+	if c[mid] > c[hi] {
+		mid, hi = hi, mid
+	}
+	if c[lo] > c[mid] {
+		lo, mid = mid, lo
+	}
+	var out [3]float64
+	if c[hi] > c[lo] {
+		out[mid] = (c[mid] - c[lo]) * s / (c[hi] - c[lo])
+		out[hi] = s
+	}
+	return out
+}
+
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
@@ -0,0 +1,302 @@
+package document_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"sync"
+	"testing"
+
+	"github.com/cozy-creator/kritago/pkg/document"
+	"github.com/cozy-creator/kritago/pkg/layers"
+)
+
+// blend composites a one pixel source over a one pixel backdrop and returns
+// the result.
+func blend(mode layers.BlendMode, backdrop, source color.NRGBA, opacity layers.Opacity) color.NRGBA {
+	pixel := func(c color.NRGBA) *image.NRGBA {
+		img := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+		img.SetNRGBA(0, 0, c)
+		return img
+	}
+	doc := document.NewKritaDocument(1, 1)
+	top := layers.NewPaintLayer(pixel(source), "Source", 0, 0, opacity)
+	top.BlendMode = mode
+	doc.AddLayer(top)
+	doc.AddLayer(layers.NewPaintLayer(pixel(backdrop), "Backdrop", 0, 0, layers.Opaque))
+	return color.NRGBAModel.Convert(doc.Composite().At(0, 0)).(color.NRGBA)
+}
+
+func TestCompositeBlendModes(t *testing.T) {
+	b := color.NRGBA{51, 102, 204, 255}
+	s := color.NRGBA{153, 51, 102, 255}
+	tests := []struct {
+		mode layers.BlendMode
+		want color.NRGBA
+	}{
+		{layers.BlendNormal, s},
+		{layers.BlendMultiply, color.NRGBA{31, 20, 82, 255}},
+		{layers.BlendScreen, color.NRGBA{173, 133, 224, 255}},
+		{layers.BlendEquivalence, color.NRGBA{102, 51, 102, 255}},
+		{layers.BlendParallel, color.NRGBA{77, 68, 136, 255}},
+		{layers.BlendArcTangent, color.NRGBA{203, 75, 75, 255}},
+		{layers.BlendAdditiveSubtractive, color.NRGBA{83, 47, 67, 255}},
+		{layers.BlendModulo, color.NRGBA{51, 51, 102, 255}},
+		{layers.BlendAnd, color.NRGBA{51 & 153, 102 & 51, 204 & 102, 255}},
+		{layers.BlendOr, color.NRGBA{51 | 153, 102 | 51, 204 | 102, 255}},
+		{layers.BlendXor, color.NRGBA{51 ^ 153, 102 ^ 51, 204 ^ 102, 255}},
+		{layers.BlendLightness, color.NRGBA{26, 77, 179, 255}},
+		{layers.BlendValue, color.NRGBA{0, 51, 153, 255}},
+		{layers.BlendIntensity, color.NRGBA{34, 85, 187, 255}},
+		{layers.BlendHueHSV, color.NRGBA{204, 13, 108, 255}},
+		{layers.BlendCopyRed, color.NRGBA{153, 102, 204, 255}},
+		{layers.BlendCopyBlue, color.NRGBA{51, 102, 102, 255}},
+		{layers.BlendGlow, color.NRGBA{115, 17, 204, 255}},
+		{layers.BlendHeat, color.NRGBA{51, 0, 140, 255}},
+		{layers.BlendPNormB, color.NRGBA{153, 104, 207, 255}},
+		{layers.BlendGammaIllumination, color.NRGBA{109, 120, 238, 255}},
+		{layers.BlendPenumbraD, color.NRGBA{104, 52, 180, 255}},
+		{layers.BlendImplication, color.NRGBA{119, 238, 221, 255}},
+		{layers.BlendLuminositySAI, s},
+		{layers.BlendTangentNormalMap, s},
+		{layers.BlendDissolve, s},
+	}
+	for _, tt := range tests {
+		if got := blend(tt.mode, b, s, layers.Opaque); !near(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.mode, got, tt.want)
+		}
+	}
+}
+
+// solid returns a size x size image filled with c.
+func solid(size int, c color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	return img
+}
+
+func TestCompositeLayers(t *testing.T) {
+	red := color.NRGBA{255, 0, 0, 255}
+	blue := color.NRGBA{0, 0, 255, 255}
+	tests := []struct {
+		name  string
+		setup func(doc *document.KritaDocument)
+		at    image.Point
+		want  color.NRGBA
+	}{
+		{"empty", func(doc *document.KritaDocument) {}, image.Pt(1, 1), color.NRGBA{}},
+		{"top layer wins", func(doc *document.KritaDocument) {
+			doc.AddLayer(layers.NewPaintLayer(solid(4, red), "Top", 0, 0, layers.Opaque))
+			doc.AddLayer(layers.NewPaintLayer(solid(4, blue), "Bottom", 0, 0, layers.Opaque))
+		}, image.Pt(1, 1), red},
+		{"hidden layer", func(doc *document.KritaDocument) {
+			top := layers.NewPaintLayer(solid(4, red), "Top", 0, 0, layers.Opaque)
+			top.Visible = false
+			doc.AddLayer(top)
+			doc.AddLayer(layers.NewPaintLayer(solid(4, blue), "Bottom", 0, 0, layers.Opaque))
+		}, image.Pt(1, 1), blue},
+		{"opacity", func(doc *document.KritaDocument) {
+			doc.AddLayer(layers.NewPaintLayer(solid(4, red), "Top", 0, 0, 0.5))
+			doc.AddLayer(layers.NewPaintLayer(solid(4, blue), "Bottom", 0, 0, layers.Opaque))
+		}, image.Pt(1, 1), color.NRGBA{128, 0, 127, 255}},
+		{"inside offset layer", func(doc *document.KritaDocument) {
+			doc.AddLayer(layers.NewPaintLayer(solid(2, red), "Top", 2, 2, layers.Opaque))
+		}, image.Pt(3, 3), red},
+		{"outside offset layer", func(doc *document.KritaDocument) {
+			doc.AddLayer(layers.NewPaintLayer(solid(2, red), "Top", 2, 2, layers.Opaque))
+		}, image.Pt(1, 1), color.NRGBA{}},
+		{"group opacity", func(doc *document.KritaDocument) {
+			group := doc.AddGroupLayer("Group", layers.NewPaintLayer(solid(4, red), "Child", 0, 0, layers.Opaque))
+			group.Opacity = 0.5
+		}, image.Pt(1, 1), color.NRGBA{255, 0, 0, 128}},
+		{"shape layers are skipped", func(doc *document.KritaDocument) {
+			doc.AddTextLayer("Text", "Text", 0, 0, layers.Opaque, nil)
+			doc.AddLayer(layers.NewPaintLayer(solid(4, blue), "Bottom", 0, 0, layers.Opaque))
+		}, image.Pt(1, 1), blue},
+	}
+	for _, tt := range tests {
+		doc := document.NewKritaDocument(4, 4)
+		tt.setup(doc)
+		got := color.NRGBAModel.Convert(doc.Composite().At(tt.at.X, tt.at.Y)).(color.NRGBA)
+		if !near(got, tt.want) {
+			t.Errorf("%s: pixel = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestCompositeBlendModesImplemented checks that every mode changes the
+// result somewhere, so none silently falls back to another.
+func TestCompositeBlendModesImplemented(t *testing.T) {
+	b := color.NRGBA{51, 102, 204, 255}
+	s := color.NRGBA{153, 51, 102, 255}
+	normal := blend(layers.BlendNormal, b, s, layers.Opaque)
+	for _, mode := range []layers.BlendMode{
+		layers.BlendHue, layers.BlendSaturation, layers.BlendColor, layers.BlendLuminosity,
+		layers.BlendIncSaturation, layers.BlendDecSaturation, layers.BlendIncLuminosity, layers.BlendDecLuminosity,
+		layers.BlendHueHSL, layers.BlendSaturationHSL, layers.BlendColorHSL,
+		layers.BlendSaturationHSV, layers.BlendColorHSV,
+		layers.BlendHueHSI, layers.BlendSaturationHSI, layers.BlendColorHSI,
+		layers.BlendNand, layers.BlendNor, layers.BlendXnor,
+		layers.BlendShadeIFSIllusions, layers.BlendCopyGreen,
+		layers.BlendFogDarkenIFSIllusions, layers.BlendEasyBurn, layers.BlendTintIFSIllusions,
+		layers.BlendFogLightenIFSIllusions, layers.BlendEasyDodge, layers.BlendHardOverlay,
+		layers.BlendSoftLightPegtopDelphi, layers.BlendSoftLightIFSIllusions, layers.BlendFlatLight,
+		layers.BlendSuperLight, layers.BlendPNormA, layers.BlendHardMixSofter,
+		layers.BlendInterpolation, layers.BlendInterpolation2X,
+		layers.BlendPenumbraA, layers.BlendPenumbraB, layers.BlendPenumbraC,
+		layers.BlendDivisiveModulo, layers.BlendModuloShift,
+		layers.BlendReflect, layers.BlendFreeze, layers.BlendGleat, layers.BlendHelow,
+		layers.BlendReeze, layers.BlendFrect, layers.BlendFhyrd,
+		layers.BlendNotImplication, layers.BlendConverse, layers.BlendNotConverse,
+	} {
+		if got := blend(mode, b, s, layers.Opaque); near(got, normal) {
+			t.Errorf("%s composites like normal: %v", mode, got)
+		}
+	}
+}
+
+func TestCompositeAlphaBlendModes(t *testing.T) {
+	// Greater keeps the backdrop where it is more opaque than the source
+	// and takes the source where the source is more opaque.
+	b := color.NRGBA{200, 0, 0, 204}
+	s := color.NRGBA{0, 0, 200, 102}
+	if got := blend(layers.BlendGreater, b, s, layers.Opaque); !near(got, b) {
+		t.Errorf("greater under a more opaque backdrop = %v, want %v", got, b)
+	}
+	b.A, s.A = 51, 255
+	if got := blend(layers.BlendGreater, b, s, layers.Opaque); !near(got, s) {
+		t.Errorf("greater over a less opaque backdrop = %v, want %v", got, s)
+	}
+
+	// Alpha darken raises the alpha only up to the layer opacity.
+	b = color.NRGBA{200, 0, 0, 64}
+	s = color.NRGBA{0, 0, 200, 255}
+	if got := blend(layers.BlendAlphaDarken, b, s, 0.5); got.A < 127 || got.A > 128 {
+		t.Errorf("alpha darken alpha = %d, want 128", got.A)
+	}
+}
+
+func near(a, b color.NRGBA) bool {
+	d := func(x, y uint8) bool { return x-y <= 1 || y-x <= 1 }
+	return d(a.R, b.R) && d(a.G, b.G) && d(a.B, b.B) && d(a.A, b.A)
+}
+
+// bandSource is a TileSource that records the tallest region read from it.
+type bandSource struct {
+	layers.ImageSource
+	mu      sync.Mutex
+	tallest int
+}
+
+func (s *bandSource) Region(r image.Rectangle) (image.Image, error) {
+	s.mu.Lock()
+	s.tallest = max(s.tallest, r.Dy())
+	s.mu.Unlock()
+	return s.Image, nil
+}
+
+// TestSaveCompositesInBands checks that saving reads tile sources a band at
+// a time and writes the same merged image Composite returns.
+func TestSaveCompositesInBands(t *testing.T) {
+	src := &bandSource{ImageSource: layers.ImageSource{Image: gradient(200)}}
+	doc := document.NewKritaDocument(200, 200)
+	layer := layers.NewPaintLayer(nil, "Source", 0, 0, layers.Opaque)
+	layer.Source = src
+	doc.AddLayer(layer)
+	doc.AddLayer(layers.NewColorFillLayer(color.NRGBA{255, 0, 0, 255}, "Fill"))
+
+	var buf bytes.Buffer
+	if err := doc.Encode(&buf, document.WithPreviewSize(50)); err != nil {
+		t.Fatal(err)
+	}
+	if src.tallest > 64 {
+		t.Errorf("read a region %d rows tall", src.tallest)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decode := func(name string) image.Image {
+		rc, err := zr.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		img, err := png.Decode(rc)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		return img
+	}
+	merged, want := decode("mergedimage.png"), doc.Composite()
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 200; x++ {
+			if a, b := color.NRGBAModel.Convert(merged.At(x, y)), color.NRGBAModel.Convert(want.At(x, y)); a != b {
+				t.Fatalf("mergedimage.png (%d,%d) = %v, want %v", x, y, a, b)
+			}
+		}
+	}
+	preview := decode("preview.png")
+	if b := preview.Bounds(); b.Dx() != 50 || b.Dy() != 50 {
+		t.Errorf("preview bounds = %v", b)
+	}
+	// The thumbnail averages 4x4 blocks of the merged image.
+	if c := color.NRGBAModel.Convert(preview.At(10, 20)).(color.NRGBA); !near(c, color.NRGBA{41, 81, 122, 255}) {
+		t.Errorf("preview pixel = %v", c)
+	}
+}
+
+func TestPreviewSize(t *testing.T) {
+	tests := []struct {
+		width, height int
+		opts          []document.SaveOption
+		want          image.Point // zero means no preview
+	}{
+		{512, 256, nil, image.Pt(256, 128)},
+		{100, 400, nil, image.Pt(64, 256)},
+		{100, 50, nil, image.Pt(100, 50)}, // never upscaled
+		{1000, 3, nil, image.Pt(256, 1)},  // at least one pixel
+		{512, 256, []document.SaveOption{document.WithPreviewSize(64)}, image.Pt(64, 32)},
+		{512, 256, []document.SaveOption{document.WithoutPreview()}, image.Point{}},
+	}
+	for _, tt := range tests {
+		doc := document.NewKritaDocument(tt.width, tt.height)
+		doc.AddLayer(layers.NewColorFillLayer(color.NRGBA{0, 128, 255, 255}, "Fill"))
+		var buf bytes.Buffer
+		if err := doc.Encode(&buf, tt.opts...); err != nil {
+			t.Fatal(err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc, err := zr.Open("preview.png")
+		if tt.want == (image.Point{}) {
+			if err == nil {
+				rc.Close()
+				t.Errorf("%dx%d: preview.png written", tt.width, tt.height)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%dx%d: %v", tt.width, tt.height, err)
+		}
+		img, err := png.Decode(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := img.Bounds().Size(); got != tt.want {
+			t.Errorf("%dx%d: preview size = %v, want %v", tt.width, tt.height, got, tt.want)
+		}
+		// The preview is taken from the composite, not from a single layer.
+		if c := color.NRGBAModel.Convert(img.At(0, 0)).(color.NRGBA); !near(c, color.NRGBA{0, 128, 255, 255}) {
+			t.Errorf("%dx%d: preview pixel = %v", tt.width, tt.height, c)
+		}
+	}
+}
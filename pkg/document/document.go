@@ -2,119 +2,334 @@ package document
 
 import (
 	"archive/zip"
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"image"
+	"image/color"
 	"image/draw"
 	"image/png"
-	"io/ioutil"
+	"io"
 	"math"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
-	"time"
+	"strings"
+	"unicode"
 
-	"github.com/google/uuid"
+	"github.com/cozy-creator/kritago/internal/lzf"
 	"github.com/cozy-creator/kritago/pkg/asl"
 	"github.com/cozy-creator/kritago/pkg/layers"
 	"github.com/cozy-creator/kritago/pkg/shapes"
 	"github.com/cozy-creator/kritago/pkg/xmlhelper"
-	"github.com/zhuyie/golzf"
+	"github.com/google/uuid"
+)
+
+// Defaults for the maindoc.xml document properties.
+const (
+	defaultImageName     = "Unnamed" // the name Krita gives new documents
+	defaultKritaVersion  = "5.2.9"
+	defaultSyntaxVersion = "2.0"
 )
 
 // KritaDocument represents a Krita document.
 type KritaDocument struct {
 	Width, Height int
-	Layers        []interface{} // each is either *layers.ShapeLayer or *layers.PaintLayer
-	TempDir       string
+	Layers        []layers.Layer // in stack order, topmost first
+	// Name is the image name, also used as the archive's data directory.
+	// Empty means "Unnamed".
+	Name        string
+	Description string
+	// Resolution is in pixels per inch; 0 means 300.
+	Resolution float64
+	// KritaVersion and SyntaxVersion identify the Krita release the file
+	// targets, e.g. "4.4.8" for Krita 4. Empty means Krita 5.2.9 and
+	// syntax 2.0. Vector text is written in the format of that release.
+	KritaVersion  string
+	SyntaxVersion string
+	// ColorSpace is the image color space and the default for paint
+	// layers; empty means 8-bit RGBA.
+	ColorSpace layers.ColorSpace
+	// ICCProfile is the document's color profile; nil means the default
+	// profile for ColorSpace.
+	ICCProfile []byte
+	Info       DocumentInfo
+}
+
+// Option configures a KritaDocument created by NewKritaDocument.
+type Option func(*KritaDocument)
+
+// WithICCProfile sets the ICC profile embedded in the document and used by
+// layers that do not carry their own.
+func WithICCProfile(profile []byte) Option {
+	return func(doc *KritaDocument) {
+		doc.ICCProfile = profile
+	}
+}
+
+// WithColorSpace sets the document's color space.
+func WithColorSpace(cs layers.ColorSpace) Option {
+	return func(doc *KritaDocument) {
+		doc.ColorSpace = cs
+	}
 }
 
 // NewKritaDocument creates a new KritaDocument.
-func NewKritaDocument(width, height int) *KritaDocument {
-	return &KritaDocument{
-		Width:   width,
-		Height:  height,
-		Layers:  []interface{}{},
-		TempDir: "krita_temp",
+func NewKritaDocument(width, height int, opts ...Option) *KritaDocument {
+	doc := &KritaDocument{
+		Width:  width,
+		Height: height,
+		Layers: []layers.Layer{},
+		Info:   DocumentInfo{InitialCreator: "Unknown", EditingCycles: 1},
+	}
+	for _, opt := range opts {
+		opt(doc)
+	}
+	return doc
+}
+
+func (doc *KritaDocument) name() string {
+	if doc.Name == "" {
+		return defaultImageName
 	}
+	return doc.Name
 }
 
-// AddTextLayer adds a text layer.
-func (doc *KritaDocument) AddTextLayer(text, name string, x, y float64, opacity int, style *layers.TextStyle) {
+func (doc *KritaDocument) resolution() float64 {
+	if doc.Resolution == 0 {
+		return defaultResolution
+	}
+	return doc.Resolution
+}
+
+func (doc *KritaDocument) colorSpace() layers.ColorSpace {
+	if doc.ColorSpace == "" {
+		return layers.RGBA8
+	}
+	return doc.ColorSpace
+}
+
+func (doc *KritaDocument) kritaVersion() string {
+	if doc.KritaVersion == "" {
+		return defaultKritaVersion
+	}
+	return doc.KritaVersion
+}
+
+func (doc *KritaDocument) syntaxVersion() string {
+	if doc.SyntaxVersion == "" {
+		return defaultSyntaxVersion
+	}
+	return doc.SyntaxVersion
+}
+
+// validate checks the document properties before saving.
+func (doc *KritaDocument) validate() error {
+	if doc.Width <= 0 || doc.Height <= 0 {
+		return fmt.Errorf("invalid document size %dx%d", doc.Width, doc.Height)
+	}
+	name := doc.name()
+	if name == "." || name == ".." || strings.ContainsAny(name, "/\\") || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return fmt.Errorf("invalid document name %q", name)
+	}
+	if res := doc.resolution(); res <= 0 || math.IsInf(res, 0) || math.IsNaN(res) {
+		return fmt.Errorf("invalid resolution %v", res)
+	}
+	if cs := doc.colorSpace(); !cs.Valid() || cs == layers.Alpha {
+		return fmt.Errorf("unsupported color space %q", doc.ColorSpace)
+	}
+	if !versionPattern.MatchString(doc.kritaVersion()) {
+		return fmt.Errorf("invalid Krita version %q", doc.kritaVersion())
+	}
+	if !versionPattern.MatchString(doc.syntaxVersion()) {
+		return fmt.Errorf("invalid syntax version %q", doc.syntaxVersion())
+	}
+	return nil
+}
+
+// versionPattern matches dotted version numbers such as "5.2.9".
+var versionPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*$`)
+
+// profile returns the document's ICC profile, or nil when its color space
+// uses a profile built into Krita.
+func (doc *KritaDocument) profile() []byte {
+	if doc.ICCProfile == nil {
+		return defaultProfile(doc.colorSpace())
+	}
+	return doc.ICCProfile
+}
+
+// AddTextLayer adds a text layer below the existing layers.
+func (doc *KritaDocument) AddTextLayer(text, name string, x, y int, opacity layers.Opacity, style *layers.TextStyle) {
 	layer := layers.FromText(text, name, x, y, opacity, style)
 	doc.Layers = append(doc.Layers, layer)
 }
 
-// AddShapeLayer adds a shape layer.
-func (doc *KritaDocument) AddShapeLayer(shapesArr []shapes.Shape, name string, x, y float64, opacity int, style *shapes.ShapeStyle) {
+// AddRichTextLayer adds a text layer made of formatted runs, one slice of
+// runs per line, below the existing layers.
+func (doc *KritaDocument) AddRichTextLayer(lines [][]layers.TextSpan, name string, x, y int, opacity layers.Opacity, style *layers.TextStyle) {
+	layer := layers.FromRichText(lines, name, x, y, opacity, style)
+	doc.Layers = append(doc.Layers, layer)
+}
+
+// AddGroupLayer adds a group layer holding children below the existing
+// layers and returns it so further layers can be added to it.
+func (doc *KritaDocument) AddGroupLayer(name string, children ...layers.Layer) *layers.GroupLayer {
+	group := layers.NewGroupLayer(name, children...)
+	doc.Layers = append(doc.Layers, group)
+	return group
+}
+
+// AddAdjustmentLayer adds an adjustment layer below the existing layers
+// and returns it. It applies filter to the layers that end up below it.
+func (doc *KritaDocument) AddAdjustmentLayer(filter layers.FilterConfig, name string) *layers.AdjustmentLayer {
+	layer := layers.NewAdjustmentLayer(filter, name)
+	doc.Layers = append(doc.Layers, layer)
+	return layer
+}
+
+// AddShapeLayer adds a shape layer below the existing layers.
+func (doc *KritaDocument) AddShapeLayer(shapesArr []shapes.Shape, name string, x, y int, opacity layers.Opacity, style *shapes.ShapeStyle) {
 	layer := layers.FromShapes(shapesArr, name, x, y, opacity, style)
 	doc.Layers = append(doc.Layers, layer)
 }
 
-// AddImageLayer adds an image layer.
-func (doc *KritaDocument) AddImageLayer(img image.Image, imagePath, name string, x, y, opacity int) {
-	layer := &layers.PaintLayer{
-		Image:     img,
-		ImagePath: imagePath,
-		Name:      name,
-		Visible:   true,
-		Opacity:   opacity,
-		X:         x,
-		Y:         y,
-	}
+// AddImageLayer adds an image layer below the existing layers.
+func (doc *KritaDocument) AddImageLayer(img image.Image, imagePath, name string, x, y int, opacity layers.Opacity) {
+	layer := layers.NewPaintLayer(img, name, x, y, opacity)
+	layer.ImagePath = imagePath
+	layer.ColorSpace = layers.ColorSpaceOf(img)
+	doc.Layers = append(doc.Layers, layer)
+}
+
+// AddLayer adds a layer of any kind below the existing ones. Layers are
+// kept topmost first, so to add a layer on top, insert it at the front of
+// Layers instead.
+func (doc *KritaDocument) AddLayer(layer layers.Layer) {
 	doc.Layers = append(doc.Layers, layer)
 }
 
-// Save writes the document as a .kra file.
-func (doc *KritaDocument) Save(outputPath string) error {
-	// Create temporary directories.
-	if err := os.MkdirAll(filepath.Join(doc.TempDir, "layers"), os.ModePerm); err != nil {
+// Save writes the document as a .kra file. The file is written to a
+// temporary file next to outputPath and renamed into place, so a failed
+// save never leaves a partial document behind.
+func (doc *KritaDocument) Save(outputPath string, opts ...SaveOption) (err error) {
+	dir, base := filepath.Split(outputPath)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, "."+base+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if err = doc.Encode(f, opts...); err != nil {
+		return err
+	}
+	if err = f.Chmod(0644); err != nil {
 		return err
 	}
-	if err := os.MkdirAll(filepath.Join(doc.TempDir, "annotations"), os.ModePerm); err != nil {
+	if err = f.Sync(); err != nil {
 		return err
 	}
-	if err := os.MkdirAll(filepath.Join(doc.TempDir, "animation"), os.ModePerm); err != nil {
+	if err = f.Close(); err != nil {
 		return err
 	}
+	return os.Rename(f.Name(), outputPath)
+}
 
-	// Prepare layer info.
-	type LayerInfo struct {
-		Layer     interface{}
-		UUID      string
-		LayerName string
-	}
-	var layerInfos []LayerInfo
-	for i, layer := range doc.Layers {
-		var uuidStr string
-		var layerName string
-		switch l := layer.(type) {
-		case *layers.ShapeLayer:
-			if l.UUID == "" {
-				l.UUID = "{" + uuid.New().String() + "}"
-			}
-			uuidStr = l.UUID
-			layerName = fmt.Sprintf("layer%d", i+2)
-		case *layers.PaintLayer:
-			uuidStr = "{" + uuid.New().String() + "}"
-			layerName = fmt.Sprintf("layer%d", i+2)
-		}
-		layerInfos = append(layerInfos, LayerInfo{Layer: layer, UUID: uuidStr, LayerName: layerName})
+// WriteTo writes the document as a .kra archive to w with the default save
+// options. It implements io.WriterTo.
+func (doc *KritaDocument) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	err := doc.Encode(cw)
+	return cw.n, err
+}
+
+// Encode writes the document as a .kra archive to w.
+func (doc *KritaDocument) Encode(w io.Writer, opts ...SaveOption) error {
+	o := saveOptions{previewSize: defaultPreviewSize}
+	for _, opt := range opts {
+		opt(&o)
 	}
+	return doc.writeArchive(w, o)
+}
+
+// defaultPreviewSize is the largest preview.png dimension Krita writes.
+const defaultPreviewSize = 256
+
+// SaveOption configures how Save and Encode write a document.
+type SaveOption func(*saveOptions)
+
+type saveOptions struct {
+	previewSize int
+}
+
+// WithPreviewSize bounds preview.png to size pixels on its longer side.
+// A size of 0 or less omits the preview.
+func WithPreviewSize(size int) SaveOption {
+	return func(o *saveOptions) {
+		o.previewSize = size
+	}
+}
 
-	// Create the output zip.
-	outFile, err := os.Create(outputPath)
+// WithoutPreview omits preview.png from the archive.
+func WithoutPreview() SaveOption {
+	return WithPreviewSize(0)
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeArchive streams the document's zip archive to w.
+func (doc *KritaDocument) writeArchive(w io.Writer, opts saveOptions) error {
+	if err := doc.validate(); err != nil {
+		return err
+	}
+	profileName, err := profileName(doc.profile(), doc.colorSpace())
 	if err != nil {
 		return err
 	}
-	defer outFile.Close()
 
-	zipWriter := zip.NewWriter(outFile)
-	defer zipWriter.Close()
+	// Prepare layer info.
+	next := 2
+	layerInfos := buildLayerInfos(doc.Layers, &next)
+	if err := validateLayers(layerInfos); err != nil {
+		return err
+	}
+
+	zipWriter := zip.NewWriter(w)
 
-	// 1. Write mimetype.
-	if err := writeZipFile(zipWriter, "mimetype", []byte("application/x-krita")); err != nil {
+	// 1. Write mimetype. It must be the first entry and stored
+	// uncompressed so the file type can be sniffed.
+	mimetype := []byte("application/x-krita")
+	mw, err := zipWriter.CreateRaw(&zip.FileHeader{
+		Name:               "mimetype",
+		Method:             zip.Store,
+		CRC32:              crc32.ChecksumIEEE(mimetype),
+		CompressedSize64:   uint64(len(mimetype)),
+		UncompressedSize64: uint64(len(mimetype)),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := mw.Write(mimetype); err != nil {
 		return err
 	}
 
@@ -125,7 +340,7 @@ func (doc *KritaDocument) Save(outputPath string) error {
 	}
 
 	// 3. Write maindoc.xml.
-	mainDoc := doc.createMainDoc(layerInfos)
+	mainDoc := doc.createMainDoc(layerInfos, profileName)
 	if err := writeZipFile(zipWriter, "maindoc.xml", []byte(mainDoc)); err != nil {
 		return err
 	}
@@ -137,45 +352,47 @@ func (doc *KritaDocument) Save(outputPath string) error {
 
 	// 5. Write animation metadata.
 	animMeta := doc.createAnimationMetadata()
-	if err := writeZipFile(zipWriter, filepath.Join(doc.TempDir, "animation", "index.xml"), []byte(animMeta)); err != nil {
+	if err := writeZipFile(zipWriter, doc.archivePath("animation/index.xml"), []byte(animMeta)); err != nil {
 		return err
 	}
 
 	// 6. Add ICC profile.
-	iccData, err := ioutil.ReadFile("layer3.icc")
-	if err != nil {
-		return err
-	}
-	if err := writeZipFile(zipWriter, filepath.Join(doc.TempDir, "annotations", "icc"), iccData); err != nil {
-		return err
+	if profile := doc.profile(); profile != nil {
+		if err := writeZipFile(zipWriter, doc.archivePath("annotations/icc"), profile); err != nil {
+			return err
+		}
 	}
 
-	// 7. Create preview image.
-	if err := doc.createPreview(zipWriter); err != nil {
+	// 7. Create merged and preview images.
+	if err := doc.createPreview(zipWriter, opts.previewSize); err != nil {
 		return err
 	}
 
 	// 8. Write layer styles if any.
-	var hasStyle bool
-	for _, li := range layerInfos {
-		if sl, ok := li.Layer.(*layers.ShapeLayer); ok && sl.LayerStyle != nil {
-			hasStyle = true
-			break
+	var styled []layers.StyledLayer
+	walkLayerInfos(layerInfos, func(li LayerInfo) {
+		if sl, ok := li.Layer.(layers.StyledLayer); ok && sl.GetLayerStyle() != nil {
+			styled = append(styled, sl)
 		}
-	}
-	if hasStyle {
-		aslBytes, err := asl.CreateLayerStylesASL(layerInfos)
+	})
+	if len(styled) > 0 {
+		aslBytes, err := asl.CreateLayerStylesASL(styled)
 		if err != nil {
 			return err
 		}
-		if err := writeZipFile(zipWriter, filepath.Join(doc.TempDir, "annotations", "layerstyles.asl"), aslBytes); err != nil {
+		if err := writeZipFile(zipWriter, doc.archivePath("annotations/layerstyles.asl"), aslBytes); err != nil {
 			return err
 		}
 	}
 
-	fmt.Printf("Successfully created Krita file: %s\n", outputPath)
-	os.RemoveAll(doc.TempDir)
-	return nil
+	return zipWriter.Close()
+}
+
+// archivePath returns the archive entry name of a document data file.
+// Krita keeps layers, annotations and animation data in a directory named
+// after the image, as in maindoc.xml.
+func (doc *KritaDocument) archivePath(name string) string {
+	return doc.name() + "/" + name
 }
 
 // Helper: writeZipFile writes data to the zip archive.
@@ -188,62 +405,85 @@ func writeZipFile(zf *zip.Writer, name string, data []byte) error {
 	return err
 }
 
-// createDocumentInfo creates documentinfo.xml.
-func (doc *KritaDocument) createDocumentInfo() string {
-	now := time.Now().Format("2006-01-02T15:04:05")
-	root := &xmlhelper.XMLNode{
-		Tag:   "document-info",
-		Attrs: map[string]string{"xmlns": "http://www.calligra.org/DTD/document-info"},
-	}
-	about := &xmlhelper.XMLNode{Tag: "about"}
-	about.Children = append(about.Children, &xmlhelper.XMLNode{Tag: "title"})
-	about.Children = append(about.Children, &xmlhelper.XMLNode{Tag: "description"})
-	about.Children = append(about.Children, &xmlhelper.XMLNode{Tag: "subject"})
-	abstract := &xmlhelper.XMLNode{Tag: "abstract", Text: "\n"}
-	about.Children = append(about.Children, abstract)
-	about.Children = append(about.Children, &xmlhelper.XMLNode{Tag: "keyword"})
-	creator := &xmlhelper.XMLNode{Tag: "initial-creator", Text: "Unknown"}
-	about.Children = append(about.Children, creator)
-	cycles := &xmlhelper.XMLNode{Tag: "editing-cycles", Text: "1"}
-	about.Children = append(about.Children, cycles)
-	about.Children = append(about.Children, &xmlhelper.XMLNode{Tag: "editing-time"})
-	date := &xmlhelper.XMLNode{Tag: "date", Text: now}
-	about.Children = append(about.Children, date)
-	creation := &xmlhelper.XMLNode{Tag: "creation-date", Text: now}
-	about.Children = append(about.Children, creation)
-	about.Children = append(about.Children, &xmlhelper.XMLNode{Tag: "language"})
-	about.Children = append(about.Children, &xmlhelper.XMLNode{Tag: "license"})
-	root.Children = append(root.Children, about)
-
-	author := &xmlhelper.XMLNode{Tag: "author"}
-	author.Children = append(author.Children, &xmlhelper.XMLNode{Tag: "full-name"})
-	author.Children = append(author.Children, &xmlhelper.XMLNode{Tag: "creator-first-name"})
-	author.Children = append(author.Children, &xmlhelper.XMLNode{Tag: "creator-last-name"})
-	author.Children = append(author.Children, &xmlhelper.XMLNode{Tag: "initial"})
-	author.Children = append(author.Children, &xmlhelper.XMLNode{Tag: "author-title"})
-	author.Children = append(author.Children, &xmlhelper.XMLNode{Tag: "position"})
-	author.Children = append(author.Children, &xmlhelper.XMLNode{Tag: "company"})
-	root.Children = append(root.Children, author)
-
-	out := `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + root.ToString("")
-	return out
-}
-
 // LayerInfo represents layer metadata
 type LayerInfo struct {
-	Layer     interface{}
+	Layer     layers.Layer
 	UUID      string
 	LayerName string
+	Children  []LayerInfo // for group layers
+	Masks     []MaskInfo
+}
+
+// MaskInfo represents mask metadata
+type MaskInfo struct {
+	Mask     layers.Mask
+	UUID     string
+	MaskName string
+}
+
+// buildLayerInfos assigns file names and UUIDs to layers depth first,
+// numbering file names from *next the way Krita does.
+func buildLayerInfos(layerList []layers.Layer, next *int) []LayerInfo {
+	var infos []LayerInfo
+	for _, layer := range layerList {
+		li := LayerInfo{Layer: layer, UUID: layer.GetUUID(), LayerName: fmt.Sprintf("layer%d", *next)}
+		*next++
+		if li.UUID == "" {
+			li.UUID = "{" + uuid.New().String() + "}"
+		}
+		if c, ok := layer.(layers.Container); ok {
+			li.Children = buildLayerInfos(c.ChildLayers(), next)
+		}
+		// Krita numbers a layer's masks after its children.
+		for _, mask := range layer.GetMasks() {
+			mi := MaskInfo{Mask: mask, UUID: mask.GetUUID(), MaskName: fmt.Sprintf("mask%d", *next)}
+			*next++
+			if mi.UUID == "" {
+				mi.UUID = "{" + uuid.New().String() + "}"
+			}
+			li.Masks = append(li.Masks, mi)
+		}
+		infos = append(infos, li)
+	}
+	return infos
+}
+
+// validateLayers checks the layer properties Krita would reject.
+func validateLayers(layerInfos []LayerInfo) error {
+	var err error
+	walkLayerInfos(layerInfos, func(li LayerInfo) {
+		if err != nil {
+			return
+		}
+		if opacity := li.Layer.GetOpacity(); !opacity.Valid() {
+			err = fmt.Errorf("layer %q: opacity %v outside [0, 1]", li.Layer.GetName(), opacity)
+		} else if mode := li.Layer.GetBlendMode(); !mode.Valid() {
+			err = fmt.Errorf("layer %q: unknown blend mode %q", li.Layer.GetName(), mode)
+		} else if label := li.Layer.GetColorLabel(); !label.Valid() {
+			err = fmt.Errorf("layer %q: color label %d out of range", li.Layer.GetName(), label)
+		} else if pl, ok := li.Layer.(*layers.PaintLayer); ok && pl.ColorSpace != "" && (!pl.ColorSpace.Valid() || pl.ColorSpace == layers.Alpha) {
+			err = fmt.Errorf("layer %q: unsupported color space %q", li.Layer.GetName(), pl.ColorSpace)
+		}
+	})
+	return err
+}
+
+// walkLayerInfos calls fn for every layer, parents before their children.
+func walkLayerInfos(infos []LayerInfo, fn func(LayerInfo)) {
+	for _, li := range infos {
+		fn(li)
+		walkLayerInfos(li.Children, fn)
+	}
 }
 
 // createMainDoc creates maindoc.xml.
-func (doc *KritaDocument) createMainDoc(layerInfos []LayerInfo) string {
+func (doc *KritaDocument) createMainDoc(layerInfos []LayerInfo, profileName string) string {
 	root := &xmlhelper.XMLNode{
 		Tag: "DOC",
 		Attrs: map[string]string{
 			"xmlns":         "http://www.calligra.org/DTD/krita",
-			"kritaVersion":  "5.2.9",
-			"syntaxVersion": "2.0",
+			"kritaVersion":  doc.kritaVersion(),
+			"syntaxVersion": doc.syntaxVersion(),
 			"editor":        "Krita",
 		},
 	}
@@ -251,64 +491,69 @@ func (doc *KritaDocument) createMainDoc(layerInfos []LayerInfo) string {
 		"width":          strconv.Itoa(doc.Width),
 		"height":         strconv.Itoa(doc.Height),
 		"mime":           "application/x-kra",
-		"description":    "",
-		"name":           "Unnamed",
-		"y-res":          "300",
-		"colorspacename": "RGBA",
-		"x-res":          "300",
-		"profile":        "sRGB-elle-V2-srgbtrc.icc",
+		"description":    doc.Description,
+		"name":           doc.name(),
+		"y-res":          fmt.Sprintf("%v", doc.resolution()),
+		"colorspacename": string(doc.colorSpace()),
+		"x-res":          fmt.Sprintf("%v", doc.resolution()),
+		"profile":        profileName,
 	}
 	imageNode := &xmlhelper.XMLNode{Tag: "IMAGE", Attrs: imageAttrs}
 
+	imageNode.Children = append(imageNode.Children, doc.layerNodes(layerInfos))
+	// Additional elements omitted for brevity.
+	root.Children = append(root.Children, imageNode)
+	header := `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+		"<!DOCTYPE DOC PUBLIC '-//KDE//DTD krita 2.0//EN' 'http://www.calligra.org/DTD/krita-2.0.dtd'>\n"
+	return header + root.ToString("")
+}
+
+// layerNodes builds the <layers> element for a level of the layer tree.
+func (doc *KritaDocument) layerNodes(layerInfos []LayerInfo) *xmlhelper.XMLNode {
 	layersNode := &xmlhelper.XMLNode{Tag: "layers"}
-	// Build layer nodes (simplified).
 	for _, li := range layerInfos {
-		switch layer := li.Layer.(type) {
-		case *layers.ShapeLayer:
-			attrs := map[string]string{
-				"collapsed":   "0",
-				"visible":     "1",
-				"locked":      "0",
-				"y":           fmt.Sprintf("%v", layer.Y),
-				"filename":    li.LayerName,
-				"name":        layer.Name,
-				"nodetype":    "shapelayer",
-				"colorlabel":  "0",
-				"compositeop": "normal",
-				"x":           fmt.Sprintf("%v", layer.X),
-				"uuid":        li.UUID,
-				"intimeline":  "0",
-				"opacity":     fmt.Sprintf("%v", layer.Opacity),
+		attrs := li.Layer.MainDocAttributes()
+		attrs["filename"] = li.LayerName
+		attrs["uuid"] = li.UUID
+		attrs["nodetype"] = li.Layer.NodeType()
+		switch li.Layer.(type) {
+		case *layers.PaintLayer, *layers.GeneratorLayer:
+			if attrs["colorspacename"] == "" {
+				attrs["colorspacename"] = string(doc.colorSpace())
 			}
-			if layer.LayerStyle != nil {
-				attrs["layerstyle"] = "{" + layer.LayerStyleUUID + "}"
+		}
+		if f, ok := li.Layer.(layers.ChannelFlagger); ok {
+			cs := doc.colorSpace()
+			if name := attrs["colorspacename"]; name != "" {
+				cs = layers.ColorSpace(name)
 			}
-			layersNode.Children = append(layersNode.Children, &xmlhelper.XMLNode{Tag: "layer", Attrs: attrs})
-		case *layers.PaintLayer:
-			attrs := map[string]string{
-				"intimeline":      "0",
-				"visible":         "1",
-				"locked":          "0",
-				"y":               fmt.Sprintf("%v", layer.Y),
-				"uuid":            li.UUID,
-				"x":               fmt.Sprintf("%v", layer.X),
-				"collapsed":       "0",
-				"filename":        li.LayerName,
-				"opacity":         fmt.Sprintf("%v", layer.Opacity),
-				"name":            layer.Name,
-				"nodetype":        "paintlayer",
-				"colorspacename":  "RGBA",
-				"compositeop":     "normal",
+			for k, v := range f.ChannelFlagAttributes(cs) {
+				attrs[k] = v
 			}
-			layersNode.Children = append(layersNode.Children, &xmlhelper.XMLNode{Tag: "layer", Attrs: attrs})
 		}
+		node := &xmlhelper.XMLNode{Tag: "layer", Attrs: attrs}
+		if _, ok := li.Layer.(layers.Container); ok {
+			node.Children = append(node.Children, doc.layerNodes(li.Children))
+		}
+		if len(li.Masks) > 0 {
+			node.Children = append(node.Children, maskNodes(li.Masks))
+		}
+		layersNode.Children = append(layersNode.Children, node)
 	}
-	imageNode.Children = append(imageNode.Children, layersNode)
-	// Additional elements omitted for brevity.
-	root.Children = append(root.Children, imageNode)
-	header := `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
-		"<!DOCTYPE DOC PUBLIC '-//KDE//DTD krita 2.0//EN' 'http://www.calligra.org/DTD/krita-2.0.dtd'>\n"
-	return header + root.ToString("")
+	return layersNode
+}
+
+// maskNodes builds the <masks> element for the masks of a layer.
+func maskNodes(maskInfos []MaskInfo) *xmlhelper.XMLNode {
+	masksNode := &xmlhelper.XMLNode{Tag: "masks"}
+	for _, mi := range maskInfos {
+		attrs := mi.Mask.MainDocAttributes()
+		attrs["filename"] = mi.MaskName
+		attrs["uuid"] = mi.UUID
+		attrs["nodetype"] = mi.Mask.NodeType()
+		masksNode.Children = append(masksNode.Children, &xmlhelper.XMLNode{Tag: "mask", Attrs: attrs})
+	}
+	return masksNode
 }
 
 // createAnimationMetadata returns animation metadata XML.
@@ -326,40 +571,70 @@ func (doc *KritaDocument) createAnimationMetadata() string {
 </animation-metadata>`
 }
 
-// createPreview creates a preview image and writes it into the zip.
-func (doc *KritaDocument) createPreview(zf *zip.Writer) error {
-	var preview image.Image
-	// Use the last paint layer if available.
-	if len(doc.Layers) > 0 {
-		if pl, ok := doc.Layers[len(doc.Layers)-1].(*layers.PaintLayer); ok {
-			if pl.Image != nil {
-				preview = pl.Image.(image.Image)
-			}
+// createPreview writes the flattened image as mergedimage.png and, unless
+// previewSize is 0, a thumbnail of it fitting previewSize as preview.png.
+// The image is composited and encoded in bands of rows, and the thumbnail
+// is gathered from the same bands, so the canvas is never held in memory
+// at once.
+func (doc *KritaDocument) createPreview(zf *zip.Writer, previewSize int) error {
+	var thumb *thumbnail
+	if previewSize > 0 {
+		thumb = newThumbnail(image.Rect(0, 0, doc.Width, doc.Height), previewBounds(doc.Width, doc.Height, previewSize))
+	}
+	w, err := zf.Create("mergedimage.png")
+	if err != nil {
+		return err
+	}
+	enc, err := newPNGWriter(w, doc.Width, doc.Height)
+	if err != nil {
+		return err
+	}
+	err = doc.compositeBands(func(band *image.NRGBA) error {
+		if thumb != nil {
+			thumb.add(band)
 		}
+		return enc.writeBand(band)
+	})
+	if err != nil {
+		return err
 	}
-	if preview == nil {
-		preview = image.NewRGBA(image.Rect(0, 0, doc.Width, doc.Height))
-		draw.Draw(preview.(*image.RGBA), preview.Bounds(), &image.Uniform{C: image.Transparent}, image.Point{}, draw.Src)
+	if err := enc.close(); err != nil {
+		return err
+	}
+	if thumb == nil {
+		return nil
 	}
-	thumb := image.NewRGBA(image.Rect(0, 0, 256, 256))
-	draw.ApproxBiLinear.Scale(thumb, thumb.Bounds(), preview, preview.Bounds(), draw.Over, nil)
 	var buf bytes.Buffer
-	if err := png.Encode(&buf, thumb); err != nil {
+	if err := png.Encode(&buf, thumb.image()); err != nil {
 		return err
 	}
 	return writeZipFile(zf, "preview.png", buf.Bytes())
 }
 
+// previewBounds returns the thumbnail size for a width x height image: its
+// longer side is at most size, keeping the aspect ratio and never upscaling.
+func previewBounds(width, height, size int) image.Rectangle {
+	scale := math.Min(float64(size)/float64(width), float64(size)/float64(height))
+	if scale >= 1 {
+		return image.Rect(0, 0, width, height)
+	}
+	w := int(math.Max(1, math.Round(float64(width)*scale)))
+	h := int(math.Max(1, math.Round(float64(height)*scale)))
+	return image.Rect(0, 0, w, h)
+}
+
 // processLayers processes each layer and writes it to the zip.
 func (doc *KritaDocument) processLayers(zf *zip.Writer, layerInfos []LayerInfo) error {
+	archive := &layerArchive{doc: doc, zf: zf}
 	for _, li := range layerInfos {
-		switch layer := li.Layer.(type) {
-		case *layers.ShapeLayer:
-			if err := doc.addShapeLayerToZip(zf, layer, li.LayerName); err != nil {
-				return err
-			}
-		case *layers.PaintLayer:
-			if err := doc.addPaintLayerToZip(zf, layer, li.LayerName); err != nil {
+		if err := li.Layer.WriteToArchive(archive, li.LayerName); err != nil {
+			return err
+		}
+		if err := doc.processLayers(zf, li.Children); err != nil {
+			return err
+		}
+		for _, mi := range li.Masks {
+			if err := mi.Mask.WriteToArchive(archive, mi.MaskName); err != nil {
 				return err
 			}
 		}
@@ -367,131 +642,305 @@ func (doc *KritaDocument) processLayers(zf *zip.Writer, layerInfos []LayerInfo)
 	return nil
 }
 
-// addShapeLayerToZip writes a shape layer's SVG content.
-func (doc *KritaDocument) addShapeLayerToZip(zf *zip.Writer, layer *layers.ShapeLayer, layerName string) error {
-	dirName := filepath.Join(doc.TempDir, "layers", layerName+".shapelayer")
-	if err := os.MkdirAll(dirName, os.ModePerm); err != nil {
-		return err
+// layerArchive is the layers.ArchiveWriter handed to layers while saving.
+type layerArchive struct {
+	doc *KritaDocument
+	zf  *zip.Writer
+}
+
+func (a *layerArchive) WriteFile(name string, data []byte) error {
+	return writeZipFile(a.zf, a.doc.archivePath("layers/"+name), data)
+}
+
+func (a *layerArchive) CanvasSize() (width, height int) {
+	return a.doc.Width, a.doc.Height
+}
+
+func (a *layerArchive) Resolution() float64 {
+	return a.doc.resolution()
+}
+
+func (a *layerArchive) KritaVersion() string {
+	return a.doc.kritaVersion()
+}
+
+// WritePaintDevice writes a paint layer's data.
+func (a *layerArchive) WritePaintDevice(name string, src layers.TileSource, cs layers.ColorSpace, defaultPixel color.Color, profile []byte) error {
+	if cs == "" {
+		cs = a.doc.colorSpace()
+	}
+	if !cs.Valid() {
+		return fmt.Errorf("layer %s: unsupported color space %q", name, cs)
 	}
-	
-	svgContent, err := GenerateSVGContent(layer, doc.Width, doc.Height)
+	// Layers in the document's color space share its profile.
+	if profile == nil && cs == a.doc.colorSpace() {
+		profile = a.doc.profile()
+	} else if profile == nil {
+		profile = defaultProfile(cs)
+	}
+	// Stream the tiles straight into the archive.
+	fw, err := a.zf.Create(a.doc.archivePath("layers/" + name))
 	if err != nil {
 		return err
 	}
-	svgPath := filepath.Join(dirName, "content.svg")
-	if err := ioutil.WriteFile(svgPath, []byte(svgContent), 0644); err != nil {
+	if err := EncodeTileSource(fw, src, cs, defaultPixel); err != nil {
+		return err
+	}
+	if err := a.WriteFile(name+".defaultpixel", encodeDefaultPixel(cs, defaultPixel)); err != nil {
 		return err
 	}
-	data, err := ioutil.ReadFile(svgPath)
+	if profile == nil {
+		return nil
+	}
+	return a.WriteFile(name+".icc", profile)
+}
+
+// SaveKritaLayer saves an image as a Krita tiled layer file.
+func SaveKritaLayer(img image.Image, outputPath string) (err error) {
+	f, err := os.Create(outputPath)
 	if err != nil {
 		return err
 	}
-	return writeZipFile(zf, filepath.Join("layers", layerName+".shapelayer", "content.svg"), data)
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	return EncodeKritaLayer(f, img)
 }
 
-// addPaintLayerToZip writes a paint layer's data.
-func (doc *KritaDocument) addPaintLayerToZip(zf *zip.Writer, layer *layers.PaintLayer, layerName string) error {
-	// Load and process the image (tiled format).
-	img, ok := layer.Image.(image.Image)
-	if !ok {
-		return errors.New("invalid image type")
+// LoadKritaLayer reads a Krita tiled layer stream of 8-bit RGBA pixels, the
+// inverse of SaveKritaLayer. See DecodePaintDevice.
+func LoadKritaLayer(r io.Reader, defaultPixel []byte) (*image.RGBA, image.Rectangle, error) {
+	img, bounds, err := DecodePaintDevice(r, layers.RGBA8, defaultPixel)
+	if err != nil {
+		return nil, image.Rectangle{}, err
 	}
 	rgba := image.NewRGBA(img.Bounds())
-	draw.Draw(rgba, img.Bounds(), img, img.Bounds().Min, draw.Src)
-	layerPath := filepath.Join(doc.TempDir, "layers", layerName)
-	if err := SaveKritaLayer(rgba, layerPath); err != nil {
-		return err
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba, bounds, nil
+}
+
+// DecodePaintDevice reads a Krita tiled layer stream with pixels in color
+// space cs. Both VERSION 1 (raw interleaved tiles) and VERSION 2 (LZF or
+// raw tiles) streams are accepted, as well as legacy streams that start
+// with a bare tile count. Tiles may sit at negative coordinates.
+//
+// The returned image covers every tile in layer coordinates; pixels not
+// covered by a tile are filled from defaultPixel, which holds one pixel in
+// cs (nil means transparent). The image is an *image.Alpha for
+// layers.Alpha, a *layers.FloatRGBA holding the stored values for the
+// float RGB color spaces, an *image.NRGBA for other 8-bit color spaces and
+// an *image.NRGBA64 otherwise, converted to sRGB. The rectangle
+// is the tight bounds of the pixels that differ from the default pixel.
+//
+// Streams with tiles other than 64x64, tiles off the 64-pixel grid or
+// tiles spanning more than maxDecodePixels pixels are rejected.
+func DecodePaintDevice(r io.Reader, cs layers.ColorSpace, defaultPixel []byte) (image.Image, image.Rectangle, error) {
+	if !cs.Valid() {
+		return nil, image.Rectangle{}, fmt.Errorf("unsupported color space %q", cs)
+	}
+	br := bufio.NewReader(r)
+	version, tileWidth, tileHeight, pixelSize := 1, 64, 64, cs.PixelSize()
+	numTiles := -1
+
+	line, err := readTileLine(br)
+	if err != nil {
+		return nil, image.Rectangle{}, err
 	}
-	defaultPixelPath := layerPath + ".defaultpixel"
-	if err := ioutil.WriteFile(defaultPixelPath, []byte{0, 0, 0, 0}, 0644); err != nil {
-		return err
+	if strings.HasPrefix(line, "VERSION ") {
+		if version, err = strconv.Atoi(strings.TrimPrefix(line, "VERSION ")); err != nil {
+			return nil, image.Rectangle{}, fmt.Errorf("invalid VERSION header %q", line)
+		}
+		for numTiles < 0 {
+			if line, err = readTileLine(br); err != nil {
+				return nil, image.Rectangle{}, err
+			}
+			key, value, _ := strings.Cut(line, " ")
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, image.Rectangle{}, fmt.Errorf("invalid tile header %q", line)
+			}
+			switch key {
+			case "TILEWIDTH":
+				tileWidth = n
+			case "TILEHEIGHT":
+				tileHeight = n
+			case "PIXELSIZE":
+				pixelSize = n
+			case "DATA":
+				numTiles = n
+			default:
+				return nil, image.Rectangle{}, fmt.Errorf("unknown tile header %q", line)
+			}
+		}
+	} else if numTiles, err = strconv.Atoi(line); err != nil {
+		return nil, image.Rectangle{}, fmt.Errorf("invalid tile stream header %q", line)
 	}
-	iccData, err := ioutil.ReadFile("layer3.icc")
-	if err != nil {
-		return err
+	if version != 1 && version != 2 {
+		return nil, image.Rectangle{}, fmt.Errorf("unsupported tile stream VERSION %d", version)
 	}
-	iccPath := layerPath + ".icc"
-	if err := ioutil.WriteFile(iccPath, iccData, 0644); err != nil {
-		return err
+	if pixelSize != cs.PixelSize() {
+		return nil, image.Rectangle{}, fmt.Errorf("PIXELSIZE %d does not match color space %q", pixelSize, cs)
 	}
-	filesToAdd := []string{layerPath, defaultPixelPath, iccPath}
-	for _, filePath := range filesToAdd {
-		data, err := ioutil.ReadFile(filePath)
-		if err != nil {
-			return err
+	if tileWidth != tileSize || tileHeight != tileSize {
+		return nil, image.Rectangle{}, fmt.Errorf("unsupported tile size %dx%d", tileWidth, tileHeight)
+	}
+	if numTiles < 0 || numTiles > maxDecodePixels/tilePixels {
+		return nil, image.Rectangle{}, fmt.Errorf("invalid tile count %d", numTiles)
+	}
+	if defaultPixel == nil {
+		defaultPixel = make([]byte, pixelSize)
+	}
+	if len(defaultPixel) != pixelSize {
+		return nil, image.Rectangle{}, fmt.Errorf("default pixel has %d bytes, want %d", len(defaultPixel), pixelSize)
+	}
+
+	tileBytes := tileWidth * tileHeight * pixelSize
+	tiles := make(map[image.Point][]byte, numTiles)
+	var extent image.Rectangle
+	for i := 0; i < numTiles; i++ {
+		if line, err = readTileLine(br); err != nil {
+			return nil, image.Rectangle{}, err
 		}
-		relPath := filepath.Join("layers", filepath.Base(filePath))
-		if err := writeZipFile(zf, relPath, data); err != nil {
-			return err
+		fields := strings.Split(line, ",")
+		if len(fields) != 4 {
+			return nil, image.Rectangle{}, fmt.Errorf("invalid tile header %q", line)
+		}
+		x, errX := strconv.Atoi(fields[0])
+		y, errY := strconv.Atoi(fields[1])
+		if errX != nil || errY != nil {
+			return nil, image.Rectangle{}, fmt.Errorf("invalid tile header %q", line)
+		}
+		if x%tileSize != 0 || y%tileSize != 0 || x < -maxTileCoord || x > maxTileCoord || y < -maxTileCoord || y > maxTileCoord {
+			return nil, image.Rectangle{}, fmt.Errorf("tile %d,%d off the tile grid", x, y)
+		}
+		pix := make([]byte, tileBytes)
+		if version == 1 {
+			if _, err := io.ReadFull(br, pix); err != nil {
+				return nil, image.Rectangle{}, fmt.Errorf("tile %d,%d: %w", x, y, err)
+			}
+		} else {
+			size, err := strconv.Atoi(fields[3])
+			if err != nil || fields[2] != "LZF" || size < 1 || size > tileBytes+1 {
+				return nil, image.Rectangle{}, fmt.Errorf("invalid tile header %q", line)
+			}
+			payload := make([]byte, size)
+			if _, err := io.ReadFull(br, payload); err != nil {
+				return nil, image.Rectangle{}, fmt.Errorf("tile %d,%d: %w", x, y, err)
+			}
+			if err := decodeTileData(payload, pix, pixelSize); err != nil {
+				return nil, image.Rectangle{}, fmt.Errorf("tile %d,%d: %w", x, y, err)
+			}
+		}
+		tiles[image.Pt(x, y)] = pix
+		extent = extent.Union(image.Rect(x, y, x+tileWidth, y+tileHeight))
+		if int64(extent.Dx())*int64(extent.Dy()) > maxDecodePixels {
+			return nil, image.Rectangle{}, fmt.Errorf("tiles span %v, more than %d pixels", extent, maxDecodePixels)
 		}
 	}
-	return nil
-}
 
-// SaveKritaLayer saves an image as a Krita tiled layer.
-func SaveKritaLayer(img image.Image, outputPath string) error {
-	w := img.Bounds().Dx()
-	h := img.Bounds().Dy()
-	nx := int(math.Ceil(float64(w) / 64.0))
-	ny := int(math.Ceil(float64(h) / 64.0))
-	var tileEntries []struct {
-		Header []byte
-		Data   []byte
-	}
-	for ty := 0; ty < ny; ty++ {
-		for tx := 0; tx < nx; tx++ {
-			left := tx * 64
-			top := ty * 64
-			tileRect := image.Rect(0, 0, 64, 64)
-			tileImg := image.NewRGBA(tileRect)
-			srcRect := image.Rect(left, top, int(math.Min(float64(left+64), float64(w))), int(math.Min(float64(top+64), float64(h))))
-			draw.Draw(tileImg, tileRect, img, srcRect.Min, draw.Src)
-			var blue, green, red, alpha []byte
-			for y := 0; y < 64; y++ {
-				for x := 0; x < 64; x++ {
-					c := tileImg.At(x, y)
-					r, g, b, a := c.RGBA()
-					red = append(red, uint8(r>>8))
-					green = append(green, uint8(g>>8))
-					blue = append(blue, uint8(b>>8))
-					alpha = append(alpha, uint8(a>>8))
+	// Set pixels directly; going through image.Image.Set would premultiply
+	// them and lose precision at low alpha.
+	var img image.Image
+	var set func(x, y int, src []byte)
+	switch cs {
+	case layers.Alpha:
+		alpha := image.NewAlpha(extent)
+		img, set = alpha, func(x, y int, src []byte) {
+			alpha.SetAlpha(x, y, color.Alpha{src[0]})
+		}
+	case layers.RGBAF16, layers.RGBAF32:
+		rgbaf := layers.NewFloatRGBA(extent)
+		img, set = rgbaf, func(x, y int, src []byte) {
+			rgbaf.SetFloat(x, y, decodeFloatPixel(cs, src))
+		}
+	case layers.RGBA8, layers.GrayA8, layers.CMYKA8, layers.LabA8:
+		nrgba := image.NewNRGBA(extent)
+		img, set = nrgba, func(x, y int, src []byte) {
+			c := decodePixel(cs, src)
+			nrgba.SetNRGBA(x, y, color.NRGBA{uint8(c.R >> 8), uint8(c.G >> 8), uint8(c.B >> 8), uint8(c.A >> 8)})
+		}
+	default:
+		nrgba64 := image.NewNRGBA64(extent)
+		img, set = nrgba64, func(x, y int, src []byte) {
+			nrgba64.SetNRGBA64(x, y, decodePixel(cs, src))
+		}
+	}
+	// Missing tiles hold the default pixel, which a new image already has
+	// when it decodes to transparent black.
+	blank := decodePixel(cs, defaultPixel) == (color.NRGBA64{})
+	var bounds image.Rectangle
+	for y := extent.Min.Y; y < extent.Max.Y; y += tileHeight {
+		for x := extent.Min.X; x < extent.Max.X; x += tileWidth {
+			pix, ok := tiles[image.Pt(x, y)]
+			if !ok && blank {
+				continue
+			}
+			for py := 0; py < tileHeight; py++ {
+				for px := 0; px < tileWidth; px++ {
+					if !ok {
+						set(x+px, y+py, defaultPixel)
+						continue
+					}
+					src := pix[(py*tileWidth+px)*pixelSize:]
+					set(x+px, y+py, src)
+					if !bytes.Equal(src[:pixelSize], defaultPixel) {
+						bounds = bounds.Union(image.Rect(x+px, y+py, x+px+1, y+py+1))
+					}
 				}
 			}
-			planeData := append(append(blue, green...), append(red, alpha...)...)
-			compressed, err := lzf.Compress(planeData)
-			if err != nil {
-				compressed = []byte{}
+		}
+	}
+	return img, bounds, nil
+}
+
+// Limits on the tile streams DecodePaintDevice accepts, which keep a
+// malformed header from requesting an image too large to allocate.
+const (
+	maxDecodePixels = 1 << 28 // 16384 x 16384
+	maxTileCoord    = 1 << 30
+)
+
+// readTileLine reads one newline-terminated header line of a tile stream.
+func readTileLine(br *bufio.Reader) (string, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// decodeTileData unpacks a VERSION 2 tile payload into interleaved pixels.
+// The first byte flags LZF-compressed planar data (1) or raw interleaved
+// data (0).
+func decodeTileData(payload, pix []byte, pixelSize int) error {
+	switch payload[0] {
+	case 0x00:
+		if len(payload)-1 < len(pix) {
+			return errors.New("short raw tile")
+		}
+		copy(pix, payload[1:])
+	case 0x01:
+		planar := make([]byte, len(pix))
+		n, err := lzf.Decompress(payload[1:], planar)
+		if err != nil {
+			return err
+		}
+		if n != len(planar) {
+			return fmt.Errorf("tile decompressed to %d bytes, want %d", n, len(planar))
+		}
+		numPixels := len(pix) / pixelSize
+		for i := 0; i < numPixels; i++ {
+			for c := 0; c < pixelSize; c++ {
+				pix[i*pixelSize+c] = planar[c*numPixels+i]
 			}
-			tileData := append([]byte{0x01}, compressed...)
-			headerLine := fmt.Sprintf("%d,%d,LZF,%d\n", left, top, len(tileData))
-			tileEntries = append(tileEntries, struct {
-				Header []byte
-				Data   []byte
-			}{Header: []byte(headerLine), Data: tileData})
-		}
-	}
-	var headerBuf bytes.Buffer
-	headerBuf.WriteString("VERSION 2\n")
-	headerBuf.WriteString("TILEWIDTH 64\n")
-	headerBuf.WriteString("TILEHEIGHT 64\n")
-	headerBuf.WriteString("PIXELSIZE 4\n")
-	headerBuf.WriteString(fmt.Sprintf("DATA %d\n", len(tileEntries)))
-	var outBuf bytes.Buffer
-	outBuf.Write(headerBuf.Bytes())
-	for _, entry := range tileEntries {
-		outBuf.Write(entry.Header)
-		outBuf.Write(entry.Data)
-	}
-	return ioutil.WriteFile(outputPath, outBuf.Bytes(), 0644)
-}
-
-func GenerateSVGContent(layer *layers.ShapeLayer, width, height int) (string, error) {
-
-	header := `<?xml version="1.0" standalone="no"?>
-<!DOCTYPE svg PUBLIC "-//W3C//DTD SVG 20010904//EN" "http://www.w3.org/TR/2001/REC-SVG-20010904/DTD/svg10.dtd">`
-	// Return a dummy SVG.
-	svg := fmt.Sprintf(`<svg width="%d" height="%d" viewBox="0 0 %d %d" xmlns="http://www.w3.org/2000/svg">
-  <!-- SVG content for layer %s -->
-</svg>`, width, height, width, height, layer.Name)
-	return header + "\n" + svg, nil
+		}
+	default:
+		return fmt.Errorf("unknown tile compression flag %#x", payload[0])
+	}
+	return nil
 }
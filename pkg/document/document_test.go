@@ -0,0 +1,350 @@
+package document_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cozy-creator/kritago/pkg/document"
+	"github.com/cozy-creator/kritago/pkg/layers"
+	"github.com/cozy-creator/kritago/pkg/xmlhelper"
+)
+
+// mainDoc writes doc and returns its parsed maindoc.xml together with the
+// archive entries.
+func mainDoc(t *testing.T, doc *document.KritaDocument) (*xmlhelper.XMLNode, map[string]string) {
+	t.Helper()
+	files := archiveFiles(t, doc)
+	root, err := xmlhelper.Parse(strings.NewReader(files["maindoc.xml"]))
+	if err != nil {
+		t.Fatalf("maindoc.xml: %v", err)
+	}
+	return root, files
+}
+
+// layerNodes returns the <layer> elements of a <layers> element.
+func layerNodes(t *testing.T, parent *xmlhelper.XMLNode) []*xmlhelper.XMLNode {
+	t.Helper()
+	list := parent.Child("layers")
+	if list == nil {
+		t.Fatalf("<%s name=%q> has no <layers>", parent.Tag, parent.Attrs["name"])
+	}
+	return list.Children
+}
+
+func TestGroupLayers(t *testing.T) {
+	doc := document.NewKritaDocument(16, 16)
+	inner := layers.NewGroupLayer("Inner", layers.NewPaintLayer(gradient(8), "Deep", 0, 0, layers.Opaque))
+	inner.Passthrough = true
+	outer := doc.AddGroupLayer("Outer", inner, layers.NewPaintLayer(gradient(8), "Child", 0, 0, layers.Opaque))
+	outer.Collapsed = true
+	outer.Opacity = 0.5
+	outer.BlendMode = layers.BlendMultiply
+	doc.AddLayer(layers.NewPaintLayer(gradient(8), "Bottom", 0, 0, layers.Opaque))
+
+	root, files := mainDoc(t, doc)
+	top := layerNodes(t, root.Child("IMAGE"))
+	if len(top) != 2 {
+		t.Fatalf("top level layers = %d, want 2", len(top))
+	}
+	// File names are numbered depth first, as Krita does.
+	tests := []struct {
+		node                     *xmlhelper.XMLNode
+		name, nodetype, filename string
+		collapsed, passthrough   string
+		opacity, compositeop     string
+	}{
+		{top[0], "Outer", "grouplayer", "layer2", "1", "0", "128", "multiply"},
+		{layerNodes(t, top[0])[0], "Inner", "grouplayer", "layer3", "0", "1", "255", "normal"},
+		{layerNodes(t, layerNodes(t, top[0])[0])[0], "Deep", "paintlayer", "layer4", "0", "", "255", "normal"},
+		{layerNodes(t, top[0])[1], "Child", "paintlayer", "layer5", "0", "", "255", "normal"},
+		{top[1], "Bottom", "paintlayer", "layer6", "0", "", "255", "normal"},
+	}
+	for _, tt := range tests {
+		a := tt.node.Attrs
+		if a["name"] != tt.name || a["nodetype"] != tt.nodetype || a["filename"] != tt.filename ||
+			a["collapsed"] != tt.collapsed || a["passthrough"] != tt.passthrough ||
+			a["opacity"] != tt.opacity || a["compositeop"] != tt.compositeop {
+			t.Errorf("%s: attributes = %v", tt.name, a)
+		}
+		if a["uuid"] == "" {
+			t.Errorf("%s: no uuid", tt.name)
+		}
+		if tt.nodetype == "paintlayer" {
+			if _, ok := files["Unnamed/layers/"+tt.filename]; !ok {
+				t.Errorf("%s: no pixel data at layers/%s", tt.name, tt.filename)
+			}
+		}
+	}
+}
+
+func TestWriteToCountsBytes(t *testing.T) {
+	doc := document.NewKritaDocument(16, 16)
+	doc.AddLayer(layers.NewPaintLayer(gradient(16), "Paint", 0, 0, layers.Opaque))
+	var buf bytes.Buffer
+	n, err := doc.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo returned %d, wrote %d bytes", n, buf.Len())
+	}
+	if _, err := document.Read(bytes.NewReader(buf.Bytes()), n); err != nil {
+		t.Errorf("Read: %v", err)
+	}
+}
+
+// TestSave checks that Save leaves either the finished document or nothing
+// behind, and that saves running at once do not interfere.
+func TestSave(t *testing.T) {
+	tests := []struct {
+		name   string
+		width  int
+		wantOK bool
+	}{
+		{"valid", 16, true},
+		{"invalid", 0, false},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "out.kra")
+		doc := document.NewKritaDocument(tt.width, 16)
+		doc.AddLayer(layers.NewPaintLayer(gradient(16), "Paint", 0, 0, layers.Opaque))
+		err := doc.Save(path)
+		if (err == nil) != tt.wantOK {
+			t.Errorf("%s: Save error = %v", tt.name, err)
+		}
+		entries, _ := os.ReadDir(dir)
+		if tt.wantOK && (len(entries) != 1 || entries[0].Name() != "out.kra") {
+			t.Errorf("%s: directory holds %v, want only out.kra", tt.name, entries)
+		}
+		if !tt.wantOK && len(entries) != 0 {
+			t.Errorf("%s: directory holds %v after a failed save", tt.name, entries)
+		}
+		if tt.wantOK {
+			if _, err := document.Open(path); err != nil {
+				t.Errorf("%s: Open: %v", tt.name, err)
+			}
+		}
+	}
+
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			doc := document.NewKritaDocument(16, 16)
+			doc.AddLayer(layers.NewPaintLayer(gradient(16), "Paint", 0, 0, layers.Opaque))
+			errs[i] = doc.Save(filepath.Join(dir, fmt.Sprintf("doc%d.kra", i)))
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("concurrent save %d: %v", i, err)
+		} else if _, err := document.Open(filepath.Join(dir, fmt.Sprintf("doc%d.kra", i))); err != nil {
+			t.Errorf("concurrent save %d: Open: %v", i, err)
+		}
+	}
+}
+
+func TestArchiveLayout(t *testing.T) {
+	for _, tt := range []struct {
+		name, dir string
+	}{
+		{"", "Unnamed"},
+		{"Poster", "Poster"},
+	} {
+		doc := document.NewKritaDocument(16, 16)
+		doc.Name = tt.name
+		doc.AddLayer(layers.NewPaintLayer(gradient(16), "Paint", 0, 0, layers.Opaque))
+		var buf bytes.Buffer
+		if _, err := doc.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f := zr.File[0]; f.Name != "mimetype" || f.Method != zip.Store {
+			t.Errorf("%s: first entry %q with method %d, want a stored mimetype", tt.dir, f.Name, f.Method)
+		}
+		// The mimetype is readable at a fixed offset, as file sniffers expect.
+		if got := buf.String()[38:57]; got != "application/x-krita" {
+			t.Errorf("%s: bytes at offset 38 = %q", tt.dir, got)
+		}
+		names := map[string]bool{}
+		for _, f := range zr.File {
+			names[f.Name] = true
+			if strings.Contains(f.Name, `\`) {
+				t.Errorf("%s: entry %q uses backslashes", tt.dir, f.Name)
+			}
+		}
+		for _, want := range []string{
+			"documentinfo.xml", "maindoc.xml", "mergedimage.png", "preview.png",
+			tt.dir + "/layers/layer2", tt.dir + "/layers/layer2.defaultpixel",
+			tt.dir + "/animation/index.xml", tt.dir + "/annotations/icc",
+		} {
+			if !names[want] {
+				t.Errorf("%s: no %s in %v", tt.dir, want, names)
+			}
+		}
+		root, _ := mainDoc(t, doc)
+		if got := root.Child("IMAGE").Attrs["name"]; got != tt.dir {
+			t.Errorf("maindoc.xml image name = %q, want %q", got, tt.dir)
+		}
+	}
+}
+
+func TestLayerPropertyAttributes(t *testing.T) {
+	tests := []struct {
+		name  string
+		set   func(l *layers.PaintLayer)
+		attrs map[string]string
+	}{
+		{"defaults", func(l *layers.PaintLayer) {}, map[string]string{
+			"visible": "1", "locked": "0", "colorlabel": "0", "collapsed": "0", "intimeline": "0",
+			"channelflags": "", "channellockflags": "1111",
+		}},
+		{"hidden", func(l *layers.PaintLayer) { l.Visible = false }, map[string]string{"visible": "0"}},
+		{"locked", func(l *layers.PaintLayer) { l.Locked = true }, map[string]string{"locked": "1"}},
+		{"color label", func(l *layers.PaintLayer) { l.ColorLabel = layers.LabelPurple }, map[string]string{"colorlabel": "7"}},
+		{"alpha locked", func(l *layers.PaintLayer) { l.AlphaLocked = true }, map[string]string{"channellockflags": "1110"}},
+		{"inherit alpha", func(l *layers.PaintLayer) { l.InheritAlpha = true }, map[string]string{"channelflags": "1110"}},
+		{"collapsed", func(l *layers.PaintLayer) { l.Collapsed = true }, map[string]string{"collapsed": "1"}},
+		{"in timeline", func(l *layers.PaintLayer) { l.InTimeline = true }, map[string]string{"intimeline": "1"}},
+	}
+	for _, tt := range tests {
+		doc := document.NewKritaDocument(16, 16)
+		layer := layers.NewPaintLayer(gradient(16), "Paint", 0, 0, layers.Opaque)
+		tt.set(layer)
+		doc.AddLayer(layer)
+		root, _ := mainDoc(t, doc)
+		node := layerNodes(t, root.Child("IMAGE"))[0]
+		for k, v := range tt.attrs {
+			if got, ok := node.Attrs[k]; !ok || got != v {
+				t.Errorf("%s: %s = %q, want %q", tt.name, k, got, v)
+			}
+		}
+	}
+
+	doc := document.NewKritaDocument(16, 16)
+	layer := layers.NewPaintLayer(gradient(16), "Paint", 0, 0, layers.Opaque)
+	layer.ColorLabel = layers.LabelGray + 1
+	doc.AddLayer(layer)
+	if _, err := doc.WriteTo(io.Discard); err == nil {
+		t.Error("color label outside the palette: no error")
+	}
+}
+
+func TestOpacity(t *testing.T) {
+	tests := []struct {
+		opacity layers.Opacity
+		krita   string // "" when the save must fail
+	}{
+		{0, "0"},
+		{0.5, "128"},
+		{layers.Opaque, "255"},
+		{layers.OpacityFromKrita(77), "77"},
+		{-0.1, ""},
+		{1.5, ""},
+	}
+	for _, tt := range tests {
+		doc := document.NewKritaDocument(16, 16)
+		doc.AddTextLayer("Text", "Text", 0, 0, tt.opacity, nil)
+		if tt.krita == "" {
+			if _, err := doc.WriteTo(io.Discard); err == nil {
+				t.Errorf("opacity %v: no error", tt.opacity)
+			}
+			continue
+		}
+		root, _ := mainDoc(t, doc)
+		if got := layerNodes(t, root.Child("IMAGE"))[0].Attrs["opacity"]; got != tt.krita {
+			t.Errorf("opacity %v written as %s, want %s", tt.opacity, got, tt.krita)
+		}
+	}
+}
+
+// TestLayerOffsets checks that every layer kind writes its offset the same
+// way.
+func TestLayerOffsets(t *testing.T) {
+	group := layers.NewGroupLayer("Group")
+	group.X, group.Y = 3, -4
+	for _, layer := range []layers.Layer{
+		layers.NewPaintLayer(gradient(8), "Paint", 3, -4, layers.Opaque),
+		layers.FromText("Text", "Text", 3, -4, layers.Opaque, nil),
+		layers.FromShapes(nil, "Shapes", 3, -4, layers.Opaque, nil),
+		group,
+	} {
+		doc := document.NewKritaDocument(16, 16)
+		doc.AddLayer(layer)
+		root, _ := mainDoc(t, doc)
+		node := layerNodes(t, root.Child("IMAGE"))[0]
+		if node.Attrs["x"] != "3" || node.Attrs["y"] != "-4" {
+			t.Errorf("%s: x, y = %q, %q", layer.GetName(), node.Attrs["x"], node.Attrs["y"])
+		}
+		if x, y := layer.Offset(); x != 3 || y != -4 {
+			t.Errorf("%s: Offset = %d, %d", layer.GetName(), x, y)
+		}
+	}
+}
+
+func TestDocumentProperties(t *testing.T) {
+	tests := []struct {
+		name  string
+		set   func(doc *document.KritaDocument)
+		doc   map[string]string // DOC attributes
+		image map[string]string // IMAGE attributes
+	}{
+		{"defaults", func(doc *document.KritaDocument) {},
+			map[string]string{"kritaVersion": "5.2.9", "syntaxVersion": "2.0"},
+			map[string]string{"name": "Unnamed", "description": "", "x-res": "300", "y-res": "300"}},
+		{"set", func(doc *document.KritaDocument) {
+			doc.Name, doc.Description, doc.Resolution = "asset-42", "Web banner", 72
+			doc.KritaVersion, doc.SyntaxVersion = "4.4.8", "2.0"
+		},
+			map[string]string{"kritaVersion": "4.4.8", "syntaxVersion": "2.0"},
+			map[string]string{"name": "asset-42", "description": "Web banner", "x-res": "72", "y-res": "72"}},
+	}
+	for _, tt := range tests {
+		doc := document.NewKritaDocument(16, 16)
+		tt.set(doc)
+		root, _ := mainDoc(t, doc)
+		for k, v := range tt.doc {
+			if got := root.Attrs[k]; got != v {
+				t.Errorf("%s: DOC %s = %q, want %q", tt.name, k, got, v)
+			}
+		}
+		for k, v := range tt.image {
+			if got := root.Child("IMAGE").Attrs[k]; got != v {
+				t.Errorf("%s: IMAGE %s = %q, want %q", tt.name, k, got, v)
+			}
+		}
+	}
+}
+
+func TestDocumentPropertiesValidated(t *testing.T) {
+	for name, set := range map[string]func(doc *document.KritaDocument){
+		"path in name":      func(doc *document.KritaDocument) { doc.Name = "a/b" },
+		"dot name":          func(doc *document.KritaDocument) { doc.Name = ".." },
+		"negative dpi":      func(doc *document.KritaDocument) { doc.Resolution = -72 },
+		"krita version":     func(doc *document.KritaDocument) { doc.KritaVersion = "5.x" },
+		"syntax version":    func(doc *document.KritaDocument) { doc.SyntaxVersion = "two" },
+		"zero width":        func(doc *document.KritaDocument) { doc.Width = 0 },
+		"alpha color space": func(doc *document.KritaDocument) { doc.ColorSpace = layers.Alpha },
+	} {
+		doc := document.NewKritaDocument(16, 16)
+		set(doc)
+		if _, err := doc.WriteTo(io.Discard); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
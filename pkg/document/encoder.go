@@ -0,0 +1,455 @@
+package document
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"github.com/cozy-creator/kritago/internal/lzf"
+	"github.com/cozy-creator/kritago/pkg/layers"
+)
+
+// Krita stores paint devices in square tiles of this many pixels.
+const (
+	tileSize   = 64
+	tilePixels = tileSize * tileSize
+)
+
+// EncodeKritaLayer writes an image to w as a Krita tiled layer stream of
+// 8-bit RGBA pixels with a transparent default pixel.
+func EncodeKritaLayer(w io.Writer, img image.Image) error {
+	return EncodePaintDevice(w, img, layers.RGBA8, nil)
+}
+
+// EncodePaintDevice writes an image to w as a Krita tiled layer stream with
+// pixels in color space cs. Pixels keep their image coordinates, so an
+// image whose bounds start at (100, 100) is placed there in the layer.
+// Tiles in which every pixel equals defaultPixel are left out, as Krita
+// fills them from the layer's .defaultpixel; nil means transparent.
+//
+// Rows of tiles are converted and compressed in parallel and written to w
+// in order as they complete, so the output is the same on every run and
+// only a few rows are held in memory at a time.
+func EncodePaintDevice(w io.Writer, img image.Image, cs layers.ColorSpace, defaultPixel color.Color) error {
+	return EncodeTileSource(w, layers.ImageSource{Image: img}, cs, defaultPixel)
+}
+
+// EncodeTileSource writes the pixels of src to w as a Krita tiled layer
+// stream, like EncodePaintDevice. Bands of tile rows are requested from src
+// as the encoder needs them, so memory use depends on the width of src but
+// not its height. Every tile overlapping src.Bounds() is written, except
+// for an ImageSource whose default tiles are left out. Sources spanning
+// more than maxDecodePixels pixels, such as an image.Uniform, are rejected,
+// as DecodePaintDevice could not read them back.
+func EncodeTileSource(w io.Writer, src layers.TileSource, cs layers.ColorSpace, defaultPixel color.Color) error {
+	if !cs.Valid() {
+		return fmt.Errorf("unsupported color space %q", cs)
+	}
+	// Measure in floats, as the sides of unbounded images overflow an int.
+	b := src.Bounds()
+	if (float64(b.Max.X)-float64(b.Min.X))*(float64(b.Max.Y)-float64(b.Min.Y)) > maxDecodePixels {
+		return fmt.Errorf("source bounds %v span more than %d pixels", b, maxDecodePixels)
+	}
+	e := newTileEncoder(src, cs, defaultPixel)
+	// The header gives the tile count up front. Finding the tiles that
+	// differ from the default pixel means reading every tile twice, which
+	// is only cheap for images already in memory.
+	var keep [][]bool
+	var count int
+	if _, ok := src.(layers.ImageSource); ok {
+		keep, count = e.scan()
+	} else {
+		keep, count = e.all()
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "VERSION 2\nTILEWIDTH %d\nTILEHEIGHT %d\nPIXELSIZE %d\nDATA %d\n",
+		tileSize, tileSize, e.pixelSize, count)
+	if err := e.writeRows(bw, keep); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// tileEncoder converts a tile source to Krita tiles. It is safe for
+// concurrent use; each goroutine brings its own tileBuffers.
+type tileEncoder struct {
+	src       layers.TileSource
+	bounds    image.Rectangle
+	cs        layers.ColorSpace
+	pixelSize int
+	fill      []byte // the default pixel in cs
+	// origin is the top left tile; rows and cols count tiles from it.
+	origin     image.Point
+	rows, cols int
+	workers    int
+}
+
+// tileBuffers is the per-goroutine scratch space of a tileEncoder.
+type tileBuffers struct {
+	planes []byte // one plane per byte of the pixel
+	pix    []byte // interleaved pixels, for the generic path
+	nrgba  *image.NRGBA
+	nrgba6 *image.NRGBA64
+	lzf    []byte
+}
+
+func newTileEncoder(src layers.TileSource, cs layers.ColorSpace, defaultPixel color.Color) *tileEncoder {
+	bounds := src.Bounds()
+	// Tiles sit on Krita's 64-pixel grid, so round the bounds outwards.
+	origin := image.Pt(floorTile(bounds.Min.X), floorTile(bounds.Min.Y))
+	e := &tileEncoder{
+		src:       src,
+		bounds:    bounds,
+		cs:        cs,
+		pixelSize: cs.PixelSize(),
+		fill:      encodeDefaultPixel(cs, defaultPixel),
+		origin:    origin,
+		workers:   runtime.GOMAXPROCS(0),
+	}
+	if !bounds.Empty() {
+		e.cols = (bounds.Max.X - origin.X + tileSize - 1) / tileSize
+		e.rows = (bounds.Max.Y - origin.Y + tileSize - 1) / tileSize
+	}
+	return e
+}
+
+func (e *tileEncoder) newBuffers() *tileBuffers {
+	n := tilePixels * e.pixelSize
+	return &tileBuffers{
+		planes: make([]byte, n),
+		pix:    make([]byte, n),
+		// One byte short of the planes, so compression fails unless it
+		// saves space.
+		lzf: make([]byte, n-1),
+	}
+}
+
+// tileAt returns the position of the tile in row and col.
+func (e *tileEncoder) tileAt(row, col int) image.Point {
+	return e.origin.Add(image.Pt(col*tileSize, row*tileSize))
+}
+
+// band returns the pixels of the tiles in row.
+func (e *tileEncoder) band(row int) (image.Image, error) {
+	top := e.origin.Y + row*tileSize
+	r := image.Rect(e.bounds.Min.X, top, e.bounds.Max.X, top+tileSize).Intersect(e.bounds)
+	img, err := e.src.Region(r)
+	if err != nil {
+		return nil, err
+	}
+	if !r.In(img.Bounds()) {
+		return nil, fmt.Errorf("tile source returned %v for region %v", img.Bounds(), r)
+	}
+	return img, nil
+}
+
+// parallel calls fn for each row received from rows on a pool of
+// goroutines, returning once rows is closed and every call has finished.
+func (e *tileEncoder) parallel(rows <-chan int, fn func(row int, b *tileBuffers)) {
+	var wg sync.WaitGroup
+	for i := 0; i < min(e.workers, e.rows); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b := e.newBuffers()
+			for row := range rows {
+				fn(row, b)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// all marks every tile to be kept.
+func (e *tileEncoder) all() (keep [][]bool, count int) {
+	keep = make([][]bool, e.rows)
+	for row := range keep {
+		keep[row] = make([]bool, e.cols)
+		for col := range keep[row] {
+			keep[row][col] = true
+		}
+	}
+	return keep, e.rows * e.cols
+}
+
+// scan reports which tiles of an ImageSource hold a pixel other than the
+// default pixel, by row and column, and how many there are.
+func (e *tileEncoder) scan() (keep [][]bool, count int) {
+	img := e.src.(layers.ImageSource).Image
+	keep = make([][]bool, e.rows)
+	rows := make(chan int)
+	go func() {
+		for row := 0; row < e.rows; row++ {
+			rows <- row
+		}
+		close(rows)
+	}()
+	e.parallel(rows, func(row int, b *tileBuffers) {
+		keep[row] = make([]bool, e.cols)
+		for col := range keep[row] {
+			keep[row][col] = e.readTile(img, e.tileAt(row, col), b)
+		}
+	})
+	for _, row := range keep {
+		for _, k := range row {
+			if k {
+				count++
+			}
+		}
+	}
+	return keep, count
+}
+
+// writeRows compresses the kept tiles and writes them to w in row order.
+func (e *tileEncoder) writeRows(w io.Writer, keep [][]bool) error {
+	// Each row is handed to the writer through its own channel. Rows take
+	// a slot in the window in order before they are encoded, which keeps
+	// workers from running more than a few rows ahead of the writer.
+	type result struct {
+		data []byte
+		err  error
+	}
+	results := make([]chan result, e.rows)
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+	window := make(chan struct{}, 2*e.workers)
+	done := make(chan struct{})
+	defer close(done)
+	rows := make(chan int)
+	go func() {
+		defer close(rows)
+		for row := 0; row < e.rows; row++ {
+			select {
+			case window <- struct{}{}:
+			case <-done:
+				return
+			}
+			rows <- row
+		}
+	}()
+	go e.parallel(rows, func(row int, b *tileBuffers) {
+		data, err := e.encodeRow(row, keep[row], b)
+		results[row] <- result{data, err}
+	})
+	for row := 0; row < e.rows; row++ {
+		res := <-results[row]
+		<-window
+		if res.err != nil {
+			return res.err
+		}
+		if _, err := w.Write(res.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeRow returns the tile headers and data of the kept tiles in row.
+func (e *tileEncoder) encodeRow(row int, keep []bool, b *tileBuffers) ([]byte, error) {
+	var out []byte
+	var img image.Image
+	for col, k := range keep {
+		if !k {
+			continue
+		}
+		if img == nil {
+			var err error
+			if img, err = e.band(row); err != nil {
+				return nil, err
+			}
+		}
+		p := e.tileAt(row, col)
+		e.readTile(img, p, b)
+		// Like Krita, store the tile raw when compression does not make
+		// it smaller. Raw tiles hold interleaved pixels, not planes.
+		flag, data := byte(0x01), b.lzf
+		n, err := lzf.Compress(b.planes, b.lzf)
+		if err == nil {
+			data = b.lzf[:n]
+		} else {
+			flag, data = 0x00, e.interleave(b)
+		}
+		out = strconv.AppendInt(out, int64(p.X), 10)
+		out = append(out, ',')
+		out = strconv.AppendInt(out, int64(p.Y), 10)
+		out = append(out, ",LZF,"...)
+		out = strconv.AppendInt(out, int64(len(data)+1), 10)
+		out = append(out, '\n', flag)
+		out = append(out, data...)
+	}
+	return out, nil
+}
+
+// readTile fills b.planes with the tile of img at origin, one plane per byte of
+// the pixel as Krita compresses them, and reports whether any pixel differs
+// from the default pixel. Pixels outside the image are the default pixel.
+func (e *tileEncoder) readTile(img image.Image, origin image.Point, b *tileBuffers) bool {
+	tile := image.Rect(origin.X, origin.Y, origin.X+tileSize, origin.Y+tileSize)
+	inside := tile.Intersect(e.bounds)
+	if e.cs == layers.RGBA8 {
+		switch src := img.(type) {
+		case *image.NRGBA:
+			e.fillPlanes(b.planes, tile, inside)
+			readNRGBA(b.planes, src.Pix, src.Stride, src.PixOffset(inside.Min.X, inside.Min.Y), tile, inside, false)
+			return e.differs(b.planes)
+		case *image.RGBA:
+			e.fillPlanes(b.planes, tile, inside)
+			readNRGBA(b.planes, src.Pix, src.Stride, src.PixOffset(inside.Min.X, inside.Min.Y), tile, inside, true)
+			return e.differs(b.planes)
+		}
+	}
+	e.readGeneric(img, b, origin, inside)
+	ps := e.pixelSize
+	for y := 0; y < tileSize; y++ {
+		for x := 0; x < tileSize; x++ {
+			i := y*tileSize + x
+			px := b.pix[i*ps : (i+1)*ps]
+			if !image.Pt(origin.X+x, origin.Y+y).In(inside) {
+				copy(px, e.fill)
+			}
+			for c, v := range px {
+				b.planes[c*tilePixels+i] = v
+			}
+		}
+	}
+	return e.differs(b.planes)
+}
+
+// interleave returns the pixels in b.planes interleaved, in b.pix.
+func (e *tileEncoder) interleave(b *tileBuffers) []byte {
+	ps := e.pixelSize
+	for i := 0; i < tilePixels; i++ {
+		for c := 0; c < ps; c++ {
+			b.pix[i*ps+c] = b.planes[c*tilePixels+i]
+		}
+	}
+	return b.pix
+}
+
+// fillPlanes sets the pixels of tile outside inside to the default pixel.
+func (e *tileEncoder) fillPlanes(planes []byte, tile, inside image.Rectangle) {
+	if inside == tile {
+		return
+	}
+	for y := tile.Min.Y; y < tile.Max.Y; y++ {
+		for x := tile.Min.X; x < tile.Max.X; x++ {
+			if image.Pt(x, y).In(inside) {
+				continue
+			}
+			i := (y-tile.Min.Y)*tileSize + x - tile.Min.X
+			for c, v := range e.fill {
+				planes[c*tilePixels+i] = v
+			}
+		}
+	}
+}
+
+// readNRGBA deinterleaves the inside part of an 8-bit RGBA pixel buffer
+// straight into B, G, R and A planes, unpremultiplying if needed.
+func readNRGBA(planes, pix []byte, stride, offset int, tile, inside image.Rectangle, premultiplied bool) {
+	b, g, r, a := planes[:tilePixels], planes[tilePixels:2*tilePixels], planes[2*tilePixels:3*tilePixels], planes[3*tilePixels:]
+	for y := inside.Min.Y; y < inside.Max.Y; y++ {
+		row := pix[offset+(y-inside.Min.Y)*stride:]
+		i := (y-tile.Min.Y)*tileSize + inside.Min.X - tile.Min.X
+		for x := 0; x < inside.Dx(); x, i = x+1, i+1 {
+			p := row[4*x : 4*x+4 : 4*x+4]
+			r[i], g[i], b[i], a[i] = p[0], p[1], p[2], p[3]
+			if premultiplied && p[3] != 0xff && p[3] != 0 {
+				// Round the way color.NRGBAModel does.
+				r[i] = uint8(uint32(p[0]) * 0xffff / uint32(p[3]) >> 8)
+				g[i] = uint8(uint32(p[1]) * 0xffff / uint32(p[3]) >> 8)
+				b[i] = uint8(uint32(p[2]) * 0xffff / uint32(p[3]) >> 8)
+			}
+		}
+	}
+}
+
+// readGeneric converts the tile of img at origin to interleaved pixels in
+// b.pix through the image.Image interface. Only pixels in inside are set.
+func (e *tileEncoder) readGeneric(img image.Image, b *tileBuffers, origin image.Point, inside image.Rectangle) {
+	ps := e.pixelSize
+	if src, ok := img.(*image.CMYK); ok && (e.cs == layers.CMYKA8 || e.cs == layers.CMYKA16) {
+		// Keep the source's ink separation instead of going via RGB.
+		for y := inside.Min.Y; y < inside.Max.Y; y++ {
+			for x := inside.Min.X; x < inside.Max.X; x++ {
+				c := src.CMYKAt(x, y)
+				dst := b.pix[((y-origin.Y)*tileSize+x-origin.X)*ps:]
+				if e.cs == layers.CMYKA8 {
+					dst[0], dst[1], dst[2], dst[3], dst[4] = c.C, c.M, c.Y, c.K, 0xff
+				} else {
+					put16(dst, widen(c.C), widen(c.M), widen(c.Y), widen(c.K), 0xffff)
+				}
+			}
+		}
+		return
+	}
+	if src, ok := img.(*layers.FloatRGBA); ok && (e.cs == layers.RGBAF16 || e.cs == layers.RGBAF32) {
+		// Keep values above 1, which the 16-bit path would clip.
+		for y := inside.Min.Y; y < inside.Max.Y; y++ {
+			for x := inside.Min.X; x < inside.Max.X; x++ {
+				encodeFloatPixel(e.cs, src.FloatAt(x, y), b.pix[((y-origin.Y)*tileSize+x-origin.X)*ps:])
+			}
+		}
+		return
+	}
+	tileRect := image.Rect(0, 0, tileSize, tileSize)
+	if e.cs == layers.RGBA8 {
+		if b.nrgba == nil {
+			b.nrgba = image.NewNRGBA(tileRect)
+		}
+		draw.Draw(b.nrgba, tileRect, img, origin, draw.Src)
+		for i := 0; i < tilePixels; i++ {
+			p := b.nrgba.Pix[4*i:]
+			b.pix[4*i], b.pix[4*i+1], b.pix[4*i+2], b.pix[4*i+3] = p[2], p[1], p[0], p[3]
+		}
+		return
+	}
+	if b.nrgba6 == nil {
+		b.nrgba6 = image.NewNRGBA64(tileRect)
+	}
+	draw.Draw(b.nrgba6, tileRect, img, origin, draw.Src)
+	for y := 0; y < tileSize; y++ {
+		for x := 0; x < tileSize; x++ {
+			encodePixel(e.cs, b.nrgba6.NRGBA64At(x, y), b.pix[(y*tileSize+x)*ps:])
+		}
+	}
+}
+
+// differs reports whether any pixel in planes is not the default pixel.
+func (e *tileEncoder) differs(planes []byte) bool {
+	for c, v := range e.fill {
+		plane := planes[c*tilePixels : (c+1)*tilePixels]
+		if bytes.Count(plane, []byte{v}) != tilePixels {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeDefaultPixel returns c stored in cs; a nil c is all zero bytes.
+func encodeDefaultPixel(cs layers.ColorSpace, c color.Color) []byte {
+	pix := make([]byte, cs.PixelSize())
+	if f, ok := c.(layers.FloatColor); ok && (cs == layers.RGBAF16 || cs == layers.RGBAF32) {
+		encodeFloatPixel(cs, f, pix)
+	} else if c != nil {
+		encodePixel(cs, color.NRGBA64Model.Convert(c).(color.NRGBA64), pix)
+	}
+	return pix
+}
+
+// floorTile returns the coordinate of the tile column or row holding v.
+func floorTile(v int) int {
+	if v < 0 {
+		return -((-v + tileSize - 1) / tileSize * tileSize)
+	}
+	return v / tileSize * tileSize
+}
@@ -0,0 +1,215 @@
+package document_test
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cozy-creator/kritago/pkg/document"
+	"github.com/cozy-creator/kritago/pkg/layers"
+)
+
+// gradient returns a size x size image with smooth, compressible content.
+func gradient(size int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x), uint8(y), uint8(x + y), 255})
+		}
+	}
+	return img
+}
+
+func benchmarkEncode(b *testing.B, img image.Image, cs layers.ColorSpace) {
+	b.SetBytes(int64(img.Bounds().Dx() * img.Bounds().Dy() * cs.PixelSize()))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := document.EncodePaintDevice(io.Discard, img, cs, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeNRGBA(b *testing.B) {
+	benchmarkEncode(b, gradient(4096), layers.RGBA8)
+}
+
+func BenchmarkEncodeRGBA(b *testing.B) {
+	src := gradient(4096)
+	img := image.NewRGBA(src.Bounds())
+	copy(img.Pix, src.Pix) // opaque, so premultiplied and straight agree
+	benchmarkEncode(b, img, layers.RGBA8)
+}
+
+func BenchmarkEncodeRGBA16(b *testing.B) {
+	benchmarkEncode(b, gradient(2048), layers.RGBA16)
+}
+
+// BenchmarkEncodeSparse encodes a large canvas holding one small sticker,
+// where almost every tile equals the default pixel.
+func BenchmarkEncodeSparse(b *testing.B) {
+	img := image.NewNRGBA(image.Rect(0, 0, 8192, 8192))
+	sticker := gradient(256)
+	for y := 0; y < 256; y++ {
+		copy(img.Pix[img.PixOffset(4000, 4000+y):], sticker.Pix[sticker.PixOffset(0, y):sticker.PixOffset(256, y)])
+	}
+	benchmarkEncode(b, img, layers.RGBA8)
+}
+
+// FuzzTileRoundTrip checks that tiles survive encoding and decoding
+// exactly, whether they end up LZF-compressed or stored raw.
+func FuzzTileRoundTrip(f *testing.F) {
+	f.Add(uint8(3), []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	f.Add(uint8(64), bytes.Repeat([]byte{0xff, 0, 0, 0xff}, 64*64))
+	f.Fuzz(func(t *testing.T, width uint8, pix []byte) {
+		w := int(width)%200 + 1
+		h := len(pix) / 4 / w
+		if h == 0 {
+			return
+		}
+		img := image.NewNRGBA(image.Rect(-5, 7, w-5, h+7))
+		copy(img.Pix, pix)
+		var buf bytes.Buffer
+		if err := document.EncodeKritaLayer(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		got, _, err := document.DecodePaintDevice(&buf, layers.RGBA8, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+			for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+				// Transparent pixels may lose their color channels.
+				want := img.NRGBAAt(x, y)
+				if want.A == 0 {
+					want = color.NRGBA{}
+				}
+				if c := got.At(x, y); c != color.Color(want) && !(want.A == 0 && c.(color.NRGBA).A == 0) {
+					t.Fatalf("pixel %d,%d = %v, want %v", x, y, c, want)
+				}
+			}
+		}
+	})
+}
+
+// tileOrigins parses a VERSION 2 tile stream and returns the origin of
+// each tile in it.
+func tileOrigins(t *testing.T, stream []byte) []image.Point {
+	t.Helper()
+	r := bytes.NewReader(stream)
+	var w, h, size, count int
+	if _, err := fmt.Fscanf(r, "VERSION 2\nTILEWIDTH %d\nTILEHEIGHT %d\nPIXELSIZE %d\nDATA %d\n", &w, &h, &size, &count); err != nil {
+		t.Fatalf("header: %v", err)
+	}
+	var origins []image.Point
+	for i := 0; i < count; i++ {
+		var p image.Point
+		var n int
+		if _, err := fmt.Fscanf(r, "%d,%d,LZF,%d\n", &p.X, &p.Y, &n); err != nil {
+			t.Fatalf("tile %d: %v", i, err)
+		}
+		r.Seek(int64(n), io.SeekCurrent)
+		origins = append(origins, p)
+	}
+	return origins
+}
+
+func TestEncodeSkipsDefaultTiles(t *testing.T) {
+	white := color.NRGBA{255, 255, 255, 255}
+	sticker := func(bounds image.Rectangle, bg color.NRGBA) *image.NRGBA {
+		img := image.NewNRGBA(bounds)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				img.SetNRGBA(x, y, bg)
+			}
+		}
+		img.SetNRGBA(130, 70, color.NRGBA{255, 0, 0, 255})
+		return img
+	}
+	tests := []struct {
+		name         string
+		img          image.Image
+		defaultPixel color.Color
+		want         []image.Point
+	}{
+		{"transparent", sticker(image.Rect(0, 0, 256, 256), color.NRGBA{}), nil, []image.Point{{128, 64}}},
+		{"white background", sticker(image.Rect(0, 0, 256, 256), white), white, []image.Point{{128, 64}}},
+		{"white on transparent default", sticker(image.Rect(0, 0, 128, 128).Add(image.Pt(64, 0)), white), nil,
+			[]image.Point{{64, 0}, {128, 0}, {64, 64}, {128, 64}}},
+		{"offset bounds", sticker(image.Rect(100, 60, 140, 80), color.NRGBA{}), nil, []image.Point{{128, 64}}},
+		{"empty", image.NewNRGBA(image.Rect(0, 0, 256, 256)), nil, nil},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := document.EncodePaintDevice(&buf, tt.img, layers.RGBA8, tt.defaultPixel); err != nil {
+			t.Fatal(err)
+		}
+		if got := tileOrigins(t, buf.Bytes()); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: tiles at %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestDefaultPixelFile checks the .defaultpixel written next to a layer.
+func TestDefaultPixelFile(t *testing.T) {
+	for _, tt := range []struct {
+		defaultPixel color.Color
+		want         string
+	}{
+		{nil, "\x00\x00\x00\x00"},
+		{color.NRGBA{255, 255, 255, 255}, "\xff\xff\xff\xff"},
+		{color.NRGBA{10, 20, 30, 255}, "\x1e\x14\x0a\xff"}, // BGRA
+	} {
+		doc := document.NewKritaDocument(16, 16)
+		layer := layers.NewPaintLayer(gradient(16), "Paint", 0, 0, layers.Opaque)
+		layer.DefaultPixel = tt.defaultPixel
+		doc.AddLayer(layer)
+		if got := archiveFiles(t, doc)["Unnamed/layers/layer2.defaultpixel"]; got != tt.want {
+			t.Errorf("default pixel %v written as %q, want %q", tt.defaultPixel, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeRejectsMalformedStreams(t *testing.T) {
+	for name, stream := range map[string]string{
+		"huge tiles":       "VERSION 2\nTILEWIDTH 100000000\nTILEHEIGHT 64\nPIXELSIZE 4\nDATA 1\n",
+		"tile count":       "VERSION 2\nTILEWIDTH 64\nTILEHEIGHT 64\nPIXELSIZE 4\nDATA 1000000000\n",
+		"distant tiles":    "VERSION 2\nTILEWIDTH 64\nTILEHEIGHT 64\nPIXELSIZE 4\nDATA 2\n0,0,LZF,1\n\x00" + "\n2000000000,2000000000,LZF,1\n\x00",
+		"unaligned tile":   "VERSION 2\nTILEWIDTH 64\nTILEHEIGHT 64\nPIXELSIZE 4\nDATA 1\n3,0,LZF,1\n\x00",
+		"oversize payload": "VERSION 2\nTILEWIDTH 64\nTILEHEIGHT 64\nPIXELSIZE 4\nDATA 1\n0,0,LZF,999999999\n",
+	} {
+		if _, _, err := document.DecodePaintDevice(strings.NewReader(stream), layers.RGBA8, nil); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+// TestEncodeRejectsUnboundedSources checks that saving a paint layer whose
+// image fills the plane fails instead of encoding forever.
+func TestEncodeRejectsUnboundedSources(t *testing.T) {
+	doc := document.NewKritaDocument(16, 16)
+	doc.AddLayer(layers.NewPaintLayer(image.NewUniform(color.White), "Paint", 0, 0, layers.Opaque))
+	if err := doc.Encode(io.Discard); err == nil {
+		t.Error("no error")
+	}
+}
+
+// FuzzDecodePaintDevice checks that malformed tile streams fail with an
+// error rather than a panic.
+func FuzzDecodePaintDevice(f *testing.F) {
+	var buf bytes.Buffer
+	if err := document.EncodeKritaLayer(&buf, gradient(70)); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(buf.Bytes())
+	f.Add([]byte("VERSION 1\nTILEWIDTH 64\nTILEHEIGHT 64\nPIXELSIZE 4\nDATA 1\n-64,64,LZF,0\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		document.DecodePaintDevice(bytes.NewReader(data), layers.RGBA8, nil)
+	})
+}
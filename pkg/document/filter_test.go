@@ -0,0 +1,112 @@
+package document_test
+
+import (
+	"image/color"
+	"reflect"
+	"testing"
+
+	"github.com/cozy-creator/kritago/pkg/document"
+	"github.com/cozy-creator/kritago/pkg/layers"
+)
+
+func TestFilterConfigs(t *testing.T) {
+	tests := []struct {
+		filter layers.FilterConfig
+		name   string
+		params map[string]string
+	}{
+		{layers.Blur(2, 2), "blur", map[string]string{"halfWidth": "2", "halfHeight": "2", "lockAspect": "true"}},
+		{layers.Blur(2, 3), "blur", map[string]string{"halfHeight": "3", "lockAspect": "false"}},
+		{layers.GaussianBlur(1.5), "gaussian blur", map[string]string{"horizRadius": "1.5", "vertRadius": "1.5"}},
+		{layers.Levels(10, 240, 1.2, 0, 255), "levels", map[string]string{"blackvalue": "10", "whitevalue": "240", "gammavalue": "1.2", "outwhitevalue": "255"}},
+		{layers.Curves([]layers.CurvePoint{{X: 0, Y: 0}, {X: 0.5, Y: 0.75}, {X: 1, Y: 1}}, nil), "perchannel", map[string]string{"nTransfers": "2", "curve0": "0,0;0.5,0.75;1,1;", "curve1": "0,0;1,1;"}},
+		{layers.HSVAdjustment(-30, 20, 5), "hsvadjustment", map[string]string{"h": "-30", "s": "20", "v": "5"}},
+		{layers.ColorBalance([3]int{1, 2, 3}, [3]int{}, [3]int{-4, 0, 0}, true), "colorbalance", map[string]string{"cyan_red_shadows": "1", "yellow_blue_shadows": "3", "cyan_red_highlights": "-4", "preserve_luminosity": "true"}},
+		{layers.Desaturate(layers.DesaturateAverage), "desaturate", map[string]string{"type": "3"}},
+	}
+	for _, tt := range tests {
+		if tt.filter.Name != tt.name || tt.filter.Version != 1 {
+			t.Errorf("%s: name, version = %q, %d", tt.name, tt.filter.Name, tt.filter.Version)
+		}
+		for k, v := range tt.params {
+			if tt.filter.Params[k] != v {
+				t.Errorf("%s: %s = %q, want %q", tt.name, k, tt.filter.Params[k], v)
+			}
+		}
+		got, err := layers.ParseFilterConfig(tt.name, tt.filter.XML())
+		if err != nil {
+			t.Errorf("%s: ParseFilterConfig: %v", tt.name, err)
+		} else if !reflect.DeepEqual(got, tt.filter) {
+			t.Errorf("%s: parsed %+v, want %+v", tt.name, got, tt.filter)
+		}
+	}
+}
+
+func TestParseFilterConfigRejectsOtherXML(t *testing.T) {
+	for _, data := range []string{"", "<params", "<filter/>"} {
+		if _, err := layers.ParseFilterConfig("blur", []byte(data)); err == nil {
+			t.Errorf("ParseFilterConfig(%q) succeeded", data)
+		}
+	}
+}
+
+// TestFilterNodes checks the maindoc.xml attributes and archive files of
+// adjustment layers and filter masks, and that reading them back keeps
+// their filters.
+func TestFilterNodes(t *testing.T) {
+	filter := layers.Levels(10, 240, 1.2, 0, 255)
+	doc := document.NewKritaDocument(16, 16)
+	adjustment := doc.AddAdjustmentLayer(filter, "Levels")
+	adjustment.X, adjustment.Y = 3, 4
+	paint := layers.NewPaintLayer(gradient(16), "Paint", 0, 0, layers.Opaque)
+	paint.Masks = []layers.Mask{layers.NewFilterMask(layers.Blur(2, 3), "Blur")}
+	doc.AddLayer(paint)
+
+	root, files := mainDoc(t, doc)
+	nodes := layerNodes(t, root.Child("IMAGE"))
+	mask := nodes[1].Child("masks").Children[0]
+	for _, tt := range []struct {
+		name  string
+		attrs map[string]string
+		want  map[string]string
+	}{
+		{"adjustment layer", nodes[0].Attrs, map[string]string{"nodetype": "adjustmentlayer", "filename": "layer2", "filtername": "levels", "filterversion": "1", "x": "3", "y": "4"}},
+		{"filter mask", mask.Attrs, map[string]string{"nodetype": "filtermask", "filename": "mask4", "filtername": "blur", "filterversion": "1"}},
+	} {
+		for k, v := range tt.want {
+			if tt.attrs[k] != v {
+				t.Errorf("%s %s = %q, want %q", tt.name, k, tt.attrs[k], v)
+			}
+		}
+	}
+	for _, name := range []string{"layer2", "mask4"} {
+		for _, ext := range []string{".filterconfig", ".pixelselection", ".pixelselection.defaultpixel"} {
+			if _, ok := files["Unnamed/layers/"+name+ext]; !ok {
+				t.Errorf("archive lacks %s%s", name, ext)
+			}
+		}
+	}
+
+	got := roundTrip(t, doc)
+	if a, ok := got.Layers[0].(*layers.AdjustmentLayer); !ok || !reflect.DeepEqual(a.Filter, filter) || a.X != 3 || a.Y != 4 {
+		t.Errorf("adjustment layer = %+v", got.Layers[0])
+	}
+	masks := got.Layers[1].GetMasks()
+	if m, ok := masks[0].(*layers.FilterMask); len(masks) != 1 || !ok || !reflect.DeepEqual(m.Filter, layers.Blur(2, 3)) {
+		t.Errorf("masks = %+v", masks)
+	}
+}
+
+// TestCompositeSkipsFilters checks that filters leave the merged image
+// unchanged, since they are not rendered.
+func TestCompositeSkipsFilters(t *testing.T) {
+	red := color.NRGBA{255, 0, 0, 255}
+	doc := document.NewKritaDocument(4, 4)
+	doc.AddAdjustmentLayer(layers.Desaturate(layers.DesaturateLightness), "Gray")
+	paint := layers.NewPaintLayer(solid(4, red), "Paint", 0, 0, layers.Opaque)
+	paint.Masks = []layers.Mask{layers.NewFilterMask(layers.GaussianBlur(2), "Blur")}
+	doc.AddLayer(paint)
+	if got := color.NRGBAModel.Convert(doc.Composite().At(1, 1)); got != red {
+		t.Errorf("composite = %v, want %v", got, red)
+	}
+}
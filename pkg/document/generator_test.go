@@ -0,0 +1,109 @@
+package document_test
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cozy-creator/kritago/pkg/document"
+	"github.com/cozy-creator/kritago/pkg/layers"
+)
+
+func TestGeneratorLayers(t *testing.T) {
+	black, white := color.NRGBA{0, 0, 0, 255}, color.NRGBA{255, 255, 255, 255}
+	red, blue := color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 0, 255, 255}
+	pattern := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	pattern.SetNRGBA(0, 0, red)
+	pattern.SetNRGBA(1, 0, blue)
+	stops := []layers.GradientStop{{Offset: 0, Color: black}, {Offset: 1, Color: white}}
+	type pixel struct {
+		at   image.Point
+		want color.NRGBA
+	}
+	tests := []struct {
+		layer  *layers.GeneratorLayer
+		name   string
+		params map[string]string
+		pixels []pixel
+	}{
+		{layers.NewColorFillLayer(color.NRGBA{10, 20, 30, 255}, "Fill"), "color",
+			map[string]string{"color": `<!DOCTYPE color><color channeldepth="U8"><RGB r="0.0392156862745098" g="0.0784313725490196" b="0.11764705882352941" space="sRGB-elle-V2-srgbtrc.icc"/></color>`},
+			[]pixel{{image.Pt(0, 0), color.NRGBA{10, 20, 30, 255}}, {image.Pt(15, 15), color.NRGBA{10, 20, 30, 255}}}},
+		{layers.NewPatternFillLayer(pattern, "Stripes", "stripes.pat", "Pattern"), "pattern",
+			map[string]string{"pattern": "Stripes", "fileName": "stripes.pat"},
+			[]pixel{{image.Pt(0, 0), red}, {image.Pt(1, 0), blue}, {image.Pt(14, 3), red}}},
+		{layers.NewGradientFillLayer(layers.GradientLinear, image.Pt(0, 0), image.Pt(8, 0), stops, "Linear"), "gradient",
+			map[string]string{"shape": "linear", "end_position_x": "8"},
+			[]pixel{{image.Pt(0, 5), color.NRGBA{16, 16, 16, 255}}, {image.Pt(3, 0), color.NRGBA{112, 112, 112, 255}}, {image.Pt(12, 0), white}}},
+		{layers.NewGradientFillLayer(layers.GradientRadial, image.Pt(4, 4), image.Pt(8, 4), stops, "Radial"), "gradient",
+			map[string]string{"shape": "radial", "start_position_x": "4"},
+			[]pixel{{image.Pt(4, 4), color.NRGBA{45, 45, 45, 255}}, {image.Pt(15, 15), white}}},
+		{layers.NewScreentoneLayer(black, white, 8, 0, "Dots"), "screentone",
+			map[string]string{"size_x": "8", "size_y": "8", "rotation": "0"},
+			[]pixel{{image.Pt(0, 0), white}, {image.Pt(4, 4), black}, {image.Pt(12, 12), black}}},
+		{layers.NewMultigridLayer(5, 3, 1.5, black, blue, "Grid"), "multigrid",
+			map[string]string{"dimensions": "5", "divisions": "3", "lineWidth": "1.5"},
+			[]pixel{{image.Pt(7, 7), blue}}},
+	}
+	for _, tt := range tests {
+		if tt.layer.Generator.Name != tt.name {
+			t.Errorf("%s: generator = %q, want %q", tt.layer.Name, tt.layer.Generator.Name, tt.name)
+		}
+		for k, v := range tt.params {
+			if tt.layer.Generator.Params[k] != v {
+				t.Errorf("%s: %s = %q, want %q", tt.layer.Name, k, tt.layer.Generator.Params[k], v)
+			}
+		}
+
+		doc := document.NewKritaDocument(16, 16)
+		doc.AddLayer(tt.layer)
+		root, files := mainDoc(t, doc)
+		attrs := layerNodes(t, root.Child("IMAGE"))[0].Attrs
+		if attrs["nodetype"] != "generatorlayer" || attrs["generatorname"] != tt.name || attrs["generatorversion"] != "1" {
+			t.Errorf("%s: layer attributes = %v", tt.layer.Name, attrs)
+		}
+		for _, file := range []string{"layer2", "layer2.filterconfig", "layer2.pixelselection"} {
+			if _, ok := files["Unnamed/layers/"+file]; !ok {
+				t.Errorf("%s: archive lacks %s", tt.layer.Name, file)
+			}
+		}
+		if !strings.Contains(files["Unnamed/layers/layer2.filterconfig"], `<params version="1">`) {
+			t.Errorf("%s: filterconfig = %q", tt.layer.Name, files["Unnamed/layers/layer2.filterconfig"])
+		}
+
+		// The preview provides the merged image, and the cached pixels
+		// provide it again after reading.
+		got := roundTrip(t, doc)
+		if g, ok := got.Layers[0].(*layers.GeneratorLayer); !ok || !reflect.DeepEqual(g.Generator, tt.layer.Generator) {
+			t.Errorf("%s: read %+v", tt.layer.Name, got.Layers[0])
+		}
+		for _, d := range []*document.KritaDocument{doc, got} {
+			composite := d.Composite()
+			for _, p := range tt.pixels {
+				if c := color.NRGBAModel.Convert(composite.At(p.at.X, p.at.Y)).(color.NRGBA); !near(c, p.want) {
+					t.Errorf("%s: pixel %v = %v, want %v", tt.layer.Name, p.at, c, p.want)
+				}
+			}
+		}
+	}
+}
+
+// TestGeneratorLayerOffset checks that previews are placed and cached in
+// layer coordinates.
+func TestGeneratorLayerOffset(t *testing.T) {
+	stops := []layers.GradientStop{{Offset: 0, Color: color.NRGBA{0, 0, 0, 255}}, {Offset: 1, Color: color.NRGBA{255, 255, 255, 255}}}
+	layer := layers.NewGradientFillLayer(layers.GradientLinear, image.Pt(0, 0), image.Pt(8, 0), stops, "Linear")
+	layer.X, layer.Y = -4, 2
+	doc := document.NewKritaDocument(16, 16)
+	doc.AddLayer(layer)
+	for _, d := range []*document.KritaDocument{doc, roundTrip(t, doc)} {
+		composite := d.Composite()
+		for x, want := range map[int]uint8{0: 143, 3: 239, 4: 255, 15: 255} {
+			if c := color.NRGBAModel.Convert(composite.At(x, 5)).(color.NRGBA); !near(c, color.NRGBA{want, want, want, 255}) {
+				t.Errorf("pixel (%d, 5) = %v, want gray %d", x, c, want)
+			}
+		}
+	}
+}
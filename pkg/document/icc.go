@@ -0,0 +1,111 @@
+package document
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/binary"
+	"errors"
+	"unicode/utf16"
+
+	"github.com/cozy-creator/kritago/pkg/layers"
+)
+
+// The profiles bundled with the package, kept in the profiles directory.
+// Krita ships profiles with the same names and uses the name as the profile
+// attribute in maindoc.xml: sRGB with the sRGB tone curve, sRGB with a
+// linear tone curve, the Krita default for floating point RGB, and D50 gray
+// with the sRGB tone curve.
+var (
+	//go:embed profiles/sRGB-elle-V2-srgbtrc.icc
+	srgbProfile []byte
+	//go:embed profiles/sRGB-elle-V2-g10.icc
+	linearSRGBProfile []byte
+	//go:embed profiles/Gray-D50-elle-V2-srgbtrc.icc
+	grayProfile []byte
+)
+
+// builtinProfileNames names the lcms built-in profiles Krita uses for color
+// models the package bundles no profile for.
+var builtinProfileNames = map[layers.ColorSpace]string{
+	layers.CMYKA8:  "Chemical proof",
+	layers.CMYKA16: "Chemical proof",
+	layers.LabA8:   "Lab identity built-in",
+	layers.LabA16:  "Lab identity built-in",
+}
+
+// DefaultICCProfile returns the sRGB profile embedded in documents that do
+// not supply their own.
+func DefaultICCProfile() []byte {
+	return append([]byte(nil), srgbProfile...)
+}
+
+// defaultProfile returns the profile written for cs when the caller
+// supplies none. It is nil for color models that use a profile built into
+// Krita.
+func defaultProfile(cs layers.ColorSpace) []byte {
+	switch cs {
+	case layers.RGBA8, layers.RGBA16:
+		return srgbProfile
+	case layers.RGBAF16, layers.RGBAF32:
+		return linearSRGBProfile
+	case layers.GrayA8, layers.GrayA16:
+		return grayProfile
+	}
+	return nil
+}
+
+// profileName returns the name Krita knows profile by, falling back to the
+// built-in profile of cs when profile is nil.
+func profileName(profile []byte, cs layers.ColorSpace) (string, error) {
+	if profile == nil {
+		return builtinProfileNames[cs], nil
+	}
+	return iccProfileName(profile)
+}
+
+// iccProfileName returns the description stored in an ICC profile, which
+// Krita uses to name the profile.
+func iccProfileName(profile []byte) (string, error) {
+	if len(profile) < 132 || string(profile[36:40]) != "acsp" {
+		return "", errors.New("icc: not an ICC profile")
+	}
+	count := int(binary.BigEndian.Uint32(profile[128:]))
+	for i := 0; i < count; i++ {
+		entry := 132 + 12*i
+		if entry+12 > len(profile) {
+			break
+		}
+		if string(profile[entry:entry+4]) != "desc" {
+			continue
+		}
+		off := int(binary.BigEndian.Uint32(profile[entry+4:]))
+		size := int(binary.BigEndian.Uint32(profile[entry+8:]))
+		if off < 0 || size < 12 || off+size > len(profile) {
+			return "", errors.New("icc: invalid desc tag")
+		}
+		tag := profile[off : off+size]
+		switch string(tag[:4]) {
+		case "desc":
+			n := int(binary.BigEndian.Uint32(tag[8:]))
+			if n < 1 || 12+n > len(tag) {
+				return "", errors.New("icc: invalid desc tag")
+			}
+			return string(bytes.TrimRight(tag[12:12+n], "\x00")), nil
+		case "mluc":
+			if len(tag) < 28 {
+				return "", errors.New("icc: invalid desc tag")
+			}
+			n := int(binary.BigEndian.Uint32(tag[20:]))
+			start := int(binary.BigEndian.Uint32(tag[24:]))
+			if start+n > len(tag) {
+				return "", errors.New("icc: invalid desc tag")
+			}
+			units := make([]uint16, n/2)
+			for j := range units {
+				units[j] = binary.BigEndian.Uint16(tag[start+2*j:])
+			}
+			return string(utf16.Decode(units)), nil
+		}
+	}
+	return "", errors.New("icc: profile has no description")
+}
@@ -0,0 +1,158 @@
+package document
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy-creator/kritago/pkg/xmlhelper"
+)
+
+// infoTimeLayout is the date format of documentinfo.xml.
+const infoTimeLayout = "2006-01-02T15:04:05"
+
+// DocumentInfo is the metadata stored in documentinfo.xml, shown in Krita's
+// Document Information dialog.
+type DocumentInfo struct {
+	Title          string
+	Description    string
+	Subject        string
+	Abstract       string
+	Keywords       []string
+	License        string
+	Language       string // e.g. "en-US"
+	InitialCreator string
+	EditingCycles  int
+	EditingTime    time.Duration
+	// CreationDate and Date (last modified) default to the save time.
+	CreationDate time.Time
+	Date         time.Time
+	Author       Author
+}
+
+// Author describes who made a document.
+type Author struct {
+	FullName  string
+	FirstName string
+	LastName  string
+	Initials  string
+	Title     string
+	Position  string
+	Company   string
+	Contacts  []Contact
+}
+
+// Contact is one way to reach an author. Krita's types are "email",
+// "telephone", "address", "homepage" and "fax".
+type Contact struct {
+	Type  string
+	Value string
+}
+
+// createDocumentInfo creates documentinfo.xml.
+func (doc *KritaDocument) createDocumentInfo() string {
+	info := doc.Info
+	now := time.Now()
+	if info.CreationDate.IsZero() {
+		info.CreationDate = now
+	}
+	if info.Date.IsZero() {
+		info.Date = now
+	}
+
+	root := &xmlhelper.XMLNode{
+		Tag:   "document-info",
+		Attrs: map[string]string{"xmlns": "http://www.calligra.org/DTD/document-info"},
+	}
+	about := &xmlhelper.XMLNode{Tag: "about"}
+	addText := func(parent *xmlhelper.XMLNode, tag, text string) {
+		parent.Children = append(parent.Children, &xmlhelper.XMLNode{Tag: tag, Text: text})
+	}
+	addText(about, "title", info.Title)
+	addText(about, "description", info.Description)
+	addText(about, "subject", info.Subject)
+	addText(about, "abstract", info.Abstract)
+	addText(about, "keyword", strings.Join(info.Keywords, "; "))
+	addText(about, "initial-creator", info.InitialCreator)
+	addText(about, "editing-cycles", strconv.Itoa(info.EditingCycles))
+	addText(about, "editing-time", strconv.FormatInt(int64(info.EditingTime/time.Second), 10))
+	addText(about, "date", info.Date.Format(infoTimeLayout))
+	addText(about, "creation-date", info.CreationDate.Format(infoTimeLayout))
+	addText(about, "language", info.Language)
+	addText(about, "license", info.License)
+	root.Children = append(root.Children, about)
+
+	author := &xmlhelper.XMLNode{Tag: "author"}
+	addText(author, "full-name", info.Author.FullName)
+	addText(author, "creator-first-name", info.Author.FirstName)
+	addText(author, "creator-last-name", info.Author.LastName)
+	addText(author, "initial", info.Author.Initials)
+	addText(author, "author-title", info.Author.Title)
+	addText(author, "position", info.Author.Position)
+	addText(author, "company", info.Author.Company)
+	for _, c := range info.Author.Contacts {
+		author.Children = append(author.Children, &xmlhelper.XMLNode{
+			Tag:   "contact",
+			Attrs: map[string]string{"type": c.Type},
+			Text:  c.Value,
+		})
+	}
+	root.Children = append(root.Children, author)
+
+	return `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + root.ToString("")
+}
+
+// parseDocumentInfo reads the metadata from a documentinfo.xml tree.
+func parseDocumentInfo(root *xmlhelper.XMLNode) DocumentInfo {
+	var info DocumentInfo
+	text := func(parent *xmlhelper.XMLNode, tag string) string {
+		if parent == nil {
+			return ""
+		}
+		if n := parent.Child(tag); n != nil {
+			return strings.TrimSpace(n.Text)
+		}
+		return ""
+	}
+	date := func(s string) time.Time {
+		t, _ := time.ParseInLocation(infoTimeLayout, s, time.Local)
+		return t
+	}
+
+	about := root.Child("about")
+	info.Title = text(about, "title")
+	info.Description = text(about, "description")
+	info.Subject = text(about, "subject")
+	info.Abstract = text(about, "abstract")
+	for _, k := range strings.Split(text(about, "keyword"), ";") {
+		if k = strings.TrimSpace(k); k != "" {
+			info.Keywords = append(info.Keywords, k)
+		}
+	}
+	info.InitialCreator = text(about, "initial-creator")
+	info.EditingCycles = atoiDefault(text(about, "editing-cycles"), 0)
+	info.EditingTime = time.Duration(atoiDefault(text(about, "editing-time"), 0)) * time.Second
+	info.Date = date(text(about, "date"))
+	info.CreationDate = date(text(about, "creation-date"))
+	info.Language = text(about, "language")
+	info.License = text(about, "license")
+
+	author := root.Child("author")
+	info.Author = Author{
+		FullName:  text(author, "full-name"),
+		FirstName: text(author, "creator-first-name"),
+		LastName:  text(author, "creator-last-name"),
+		Initials:  text(author, "initial"),
+		Title:     text(author, "author-title"),
+		Position:  text(author, "position"),
+		Company:   text(author, "company"),
+	}
+	if author != nil {
+		for _, n := range author.Children {
+			if n.Tag == "contact" {
+				info.Author.Contacts = append(info.Author.Contacts, Contact{Type: n.Attrs["type"], Value: strings.TrimSpace(n.Text)})
+			}
+		}
+	}
+	return info
+}
@@ -0,0 +1,69 @@
+package document_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cozy-creator/kritago/pkg/document"
+)
+
+func TestDocumentInfoRoundTrip(t *testing.T) {
+	created := time.Date(2024, 3, 1, 9, 30, 0, 0, time.Local)
+	modified := time.Date(2024, 3, 2, 18, 5, 7, 0, time.Local)
+	tests := []struct {
+		name string
+		info document.DocumentInfo
+	}{
+		{"full", document.DocumentInfo{
+			Title:          "Poster",
+			Description:    "Spring campaign",
+			Subject:        "Marketing",
+			Abstract:       "A poster",
+			Keywords:       []string{"spring", "sale"},
+			License:        "CC-BY-4.0",
+			Language:       "en-US",
+			InitialCreator: "Pipeline",
+			EditingCycles:  3,
+			EditingTime:    90 * time.Second,
+			CreationDate:   created,
+			Date:           modified,
+			Author: document.Author{
+				FullName: "Sam Doe", FirstName: "Sam", LastName: "Doe", Initials: "SD",
+				Title: "Dr", Position: "Artist", Company: "Studio",
+				Contacts: []document.Contact{{Type: "email", Value: "sam@example.com"}, {Type: "homepage", Value: "https://example.com"}},
+			},
+		}},
+		{"markup in text", document.DocumentInfo{
+			Title:        `Q&A <draft> "one"`,
+			Keywords:     []string{"a&b"},
+			CreationDate: created,
+			Date:         modified,
+		}},
+	}
+	for _, tt := range tests {
+		doc := document.NewKritaDocument(16, 16)
+		doc.Info = tt.info
+		got := roundTrip(t, doc).Info
+		if !got.CreationDate.Equal(tt.info.CreationDate) || !got.Date.Equal(tt.info.Date) {
+			t.Errorf("%s: dates = %v, %v", tt.name, got.CreationDate, got.Date)
+		}
+		got.CreationDate, got.Date = tt.info.CreationDate, tt.info.Date
+		if !reflect.DeepEqual(got, tt.info) {
+			t.Errorf("%s: info = %+v, want %+v", tt.name, got, tt.info)
+		}
+	}
+}
+
+// TestDocumentInfoDefaultDates checks that unset dates are stamped with the
+// save time.
+func TestDocumentInfoDefaultDates(t *testing.T) {
+	before := time.Now().Truncate(time.Second)
+	got := roundTrip(t, document.NewKritaDocument(16, 16)).Info
+	after := time.Now()
+	for name, d := range map[string]time.Time{"creation date": got.CreationDate, "date": got.Date} {
+		if d.Before(before) || d.After(after) {
+			t.Errorf("%s = %v, want between %v and %v", name, d, before, after)
+		}
+	}
+}
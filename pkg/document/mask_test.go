@@ -0,0 +1,92 @@
+package document_test
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+
+	"github.com/cozy-creator/kritago/pkg/document"
+	"github.com/cozy-creator/kritago/pkg/layers"
+)
+
+func TestTransparencyMaskArchive(t *testing.T) {
+	mask := image.NewAlpha(image.Rect(0, 0, 8, 8))
+	mask.Pix[0] = 200
+	m := layers.NewTransparencyMask(mask, "Mask")
+	m.DefaultAlpha = 255
+	doc := document.NewKritaDocument(16, 16)
+	layer := layers.NewPaintLayer(gradient(16), "Paint", 0, 0, layers.Opaque)
+	layer.Masks = []layers.Mask{m}
+	doc.AddLayer(layer)
+
+	root, files := mainDoc(t, doc)
+	masks := layerNodes(t, root.Child("IMAGE"))[0].Child("masks")
+	if masks == nil || len(masks.Children) != 1 {
+		t.Fatalf("masks = %+v", masks)
+	}
+	if a := masks.Children[0].Attrs; a["nodetype"] != "transparencymask" || a["filename"] != "mask3" || a["name"] != "Mask" {
+		t.Errorf("mask attributes = %v", a)
+	}
+	if data := files["Unnamed/layers/mask3.pixelselection"]; !strings.Contains(data, "PIXELSIZE 1\n") {
+		t.Errorf("mask tiles are not one byte per pixel: %.60q", data)
+	}
+	if got := files["Unnamed/layers/mask3.pixelselection.defaultpixel"]; got != "\xff" {
+		t.Errorf("mask default pixel = %q, want \"\\xff\"", got)
+	}
+}
+
+func TestCompositeTransparencyMasks(t *testing.T) {
+	red := color.NRGBA{255, 0, 0, 255}
+	gray := image.NewGray(image.Rect(0, 0, 2, 2))
+	gray.Pix = []uint8{255, 128, 0, 255}
+	alpha := image.NewAlpha(image.Rect(0, 0, 2, 2))
+	copy(alpha.Pix, gray.Pix)
+	tests := []struct {
+		name string
+		mask func() *layers.TransparencyMask
+		at   image.Point
+		want uint8 // composite alpha
+	}{
+		{"alpha kept", func() *layers.TransparencyMask { return layers.NewTransparencyMask(alpha, "M") }, image.Pt(0, 0), 255},
+		{"alpha halved", func() *layers.TransparencyMask { return layers.NewTransparencyMask(alpha, "M") }, image.Pt(1, 0), 128},
+		{"alpha hidden", func() *layers.TransparencyMask { return layers.NewTransparencyMask(alpha, "M") }, image.Pt(0, 1), 0},
+		{"gray level", func() *layers.TransparencyMask { return layers.NewTransparencyMask(gray, "M") }, image.Pt(1, 0), 128},
+		{"outside hidden", func() *layers.TransparencyMask { return layers.NewTransparencyMask(alpha, "M") }, image.Pt(3, 3), 0},
+		{"outside default", func() *layers.TransparencyMask {
+			m := layers.NewTransparencyMask(alpha, "M")
+			m.DefaultAlpha = 255
+			return m
+		}, image.Pt(3, 3), 255},
+		{"offset", func() *layers.TransparencyMask {
+			m := layers.NewTransparencyMask(alpha, "M")
+			m.X, m.Y = 2, 2
+			return m
+		}, image.Pt(3, 2), 128},
+		{"hidden mask", func() *layers.TransparencyMask {
+			m := layers.NewTransparencyMask(alpha, "M")
+			m.Visible = false
+			return m
+		}, image.Pt(0, 1), 255},
+	}
+	for _, tt := range tests {
+		for _, group := range []bool{false, true} {
+			doc := document.NewKritaDocument(4, 4)
+			var layer layers.Layer = layers.NewPaintLayer(solid(4, red), "Paint", 0, 0, layers.Opaque)
+			if group {
+				layer = layers.NewGroupLayer("Group", layer)
+			}
+			switch l := layer.(type) {
+			case *layers.PaintLayer:
+				l.Masks = []layers.Mask{tt.mask()}
+			case *layers.GroupLayer:
+				l.Masks = []layers.Mask{tt.mask()}
+			}
+			doc.AddLayer(layer)
+			got := color.NRGBAModel.Convert(doc.Composite().At(tt.at.X, tt.at.Y)).(color.NRGBA)
+			if d := int(got.A) - int(tt.want); d < -1 || d > 1 {
+				t.Errorf("%s (group %v): alpha = %d, want %d", tt.name, group, got.A, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package document
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"io"
+)
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// pngWriter writes an 8-bit RGBA PNG a band of rows at a time, copying the
+// rows straight from each band's Pix. Unlike png.Encode, it needs neither
+// the whole image in memory nor a pass through At for every pixel. Rows are
+// filtered with the heuristic image/png uses.
+type pngWriter struct {
+	w     io.Writer
+	bw    *bufio.Writer // collects compressed data into IDAT chunks
+	zw    *zlib.Writer
+	width int
+	// prev and cur are the previous and current raw rows; filtered holds
+	// the current row under each filter type, each led by its type byte.
+	prev, cur []byte
+	filtered  [5][]byte
+}
+
+func newPNGWriter(w io.Writer, width, height int) (*pngWriter, error) {
+	if width <= 0 || height <= 0 || int64(width)*4 > 1<<31-2 || height > 1<<31-1 {
+		return nil, errors.New("png: invalid image size")
+	}
+	if _, err := io.WriteString(w, pngSignature); err != nil {
+		return nil, err
+	}
+	var ihdr [13]byte
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(height))
+	ihdr[8] = 8 // bit depth
+	ihdr[9] = 6 // truecolor with alpha
+	if err := writePNGChunk(w, "IHDR", ihdr[:]); err != nil {
+		return nil, err
+	}
+	p := &pngWriter{
+		w:     w,
+		width: width,
+		prev:  make([]byte, 4*width),
+		cur:   make([]byte, 4*width),
+	}
+	for i := range p.filtered {
+		p.filtered[i] = make([]byte, 1+4*width)
+		p.filtered[i][0] = byte(i)
+	}
+	p.bw = bufio.NewWriterSize(idatWriter{w}, 1<<15)
+	p.zw = zlib.NewWriter(p.bw)
+	return p, nil
+}
+
+// writeBand writes the rows of band, which spans the image's width and
+// follows the rows written before it.
+func (p *pngWriter) writeBand(band *image.NRGBA) error {
+	for y := band.Rect.Min.Y; y < band.Rect.Max.Y; y++ {
+		i := band.PixOffset(band.Rect.Min.X, y)
+		copy(p.cur, band.Pix[i:i+4*p.width])
+		if _, err := p.zw.Write(p.filter()); err != nil {
+			return err
+		}
+		p.prev, p.cur = p.cur, p.prev
+	}
+	return nil
+}
+
+// close finishes the image data and writes the closing chunk.
+func (p *pngWriter) close() error {
+	if err := p.zw.Close(); err != nil {
+		return err
+	}
+	if err := p.bw.Flush(); err != nil {
+		return err
+	}
+	return writePNGChunk(p.w, "IEND", nil)
+}
+
+// filter returns the current row under the filter type that gives the
+// smallest sum of absolute differences.
+func (p *pngWriter) filter() []byte {
+	const bpp = 4
+	cur, prev := p.cur, p.prev
+	none, sub, up, avg, paeth := p.filtered[0][1:], p.filtered[1][1:], p.filtered[2][1:], p.filtered[3][1:], p.filtered[4][1:]
+	var sums [5]int
+	for i := range cur {
+		var left, upLeft int
+		if i >= bpp {
+			left, upLeft = int(cur[i-bpp]), int(prev[i-bpp])
+		}
+		above := int(prev[i])
+		none[i] = cur[i]
+		sub[i] = cur[i] - uint8(left)
+		up[i] = cur[i] - uint8(above)
+		avg[i] = cur[i] - uint8((left+above)/2)
+		paeth[i] = cur[i] - paethPredictor(left, above, upLeft)
+		sums[0] += absDiff(none[i])
+		sums[1] += absDiff(sub[i])
+		sums[2] += absDiff(up[i])
+		sums[3] += absDiff(avg[i])
+		sums[4] += absDiff(paeth[i])
+	}
+	best := 0
+	for f := range sums {
+		if sums[f] < sums[best] {
+			best = f
+		}
+	}
+	return p.filtered[best]
+}
+
+func paethPredictor(a, b, c int) uint8 {
+	pa, pb, pc := abs(b-c), abs(a-c), abs(a+b-2*c)
+	if pa <= pb && pa <= pc {
+		return uint8(a)
+	}
+	if pb <= pc {
+		return uint8(b)
+	}
+	return uint8(c)
+}
+
+// absDiff is the magnitude of a filtered byte read as a signed difference.
+func absDiff(v byte) int {
+	return abs(int(int8(v)))
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// idatWriter writes each buffer it is given as an IDAT chunk.
+type idatWriter struct{ w io.Writer }
+
+func (iw idatWriter) Write(b []byte) (int, error) {
+	if err := writePNGChunk(iw.w, "IDAT", b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func writePNGChunk(w io.Writer, typ string, data []byte) error {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+	copy(header[4:], typ)
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+	var footer [4]byte
+	binary.BigEndian.PutUint32(footer[:], crc.Sum32())
+	for _, b := range [][]byte{header[:], data, footer[:]} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
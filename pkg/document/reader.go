@@ -0,0 +1,867 @@
+package document
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/cozy-creator/kritago/pkg/asl"
+	"github.com/cozy-creator/kritago/pkg/layers"
+	"github.com/cozy-creator/kritago/pkg/shapes"
+	"github.com/cozy-creator/kritago/pkg/xmlhelper"
+)
+
+// Open reads the .kra file at path into a KritaDocument.
+func Open(path string) (*KritaDocument, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return Read(f, fi.Size())
+}
+
+// Read parses a .kra archive of the given size into a KritaDocument. Layer
+// styles are only read from ASL data written by this package; styles in
+// other layerstyles.asl files are skipped.
+func Read(r io.ReaderAt, size int64) (*KritaDocument, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	kr := &kraReader{files: map[string]*zip.File{}}
+	for _, f := range zr.File {
+		kr.files[f.Name] = f
+	}
+
+	mainDoc, err := kr.readXML("maindoc.xml")
+	if err != nil {
+		return nil, err
+	}
+	imageNode := mainDoc.Child("IMAGE")
+	if mainDoc.Tag != "DOC" || imageNode == nil {
+		return nil, errors.New("maindoc.xml: missing IMAGE element")
+	}
+	width, err := strconv.Atoi(imageNode.Attrs["width"])
+	if err != nil {
+		return nil, fmt.Errorf("maindoc.xml: invalid width: %w", err)
+	}
+	height, err := strconv.Atoi(imageNode.Attrs["height"])
+	if err != nil {
+		return nil, fmt.Errorf("maindoc.xml: invalid height: %w", err)
+	}
+	kr.root = imageNode.Attrs["name"]
+	kr.resolution = defaultResolution
+	if res, err := strconv.ParseFloat(imageNode.Attrs["x-res"], 64); err == nil && res > 0 {
+		kr.resolution = res
+	}
+
+	var info *DocumentInfo
+	if kr.has("documentinfo.xml") {
+		node, err := kr.readXML("documentinfo.xml")
+		if err != nil {
+			return nil, err
+		}
+		parsed := parseDocumentInfo(node)
+		info = &parsed
+	}
+
+	if kr.has("annotations/layerstyles.asl") {
+		data, err := kr.read("annotations/layerstyles.asl")
+		if err != nil {
+			return nil, err
+		}
+		// Styles the package cannot parse, like the Photoshop descriptors
+		// Krita writes, are left out rather than failing the whole read.
+		if styles, err := asl.ParseLayerStylesASL(data); err == nil {
+			kr.styles = styles
+		}
+	}
+
+	kr.colorSpace = layers.RGBA8
+	if cs := colorSpaceAttr(imageNode); cs != "" {
+		kr.colorSpace = cs
+	}
+	if !kr.colorSpace.Valid() {
+		return nil, fmt.Errorf("unsupported color space %q", kr.colorSpace)
+	}
+
+	opts := []Option{WithColorSpace(kr.colorSpace)}
+	kr.profile = defaultProfile(kr.colorSpace)
+	if kr.has("annotations/icc") {
+		if kr.profile, err = kr.read("annotations/icc"); err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithICCProfile(kr.profile))
+	}
+
+	doc := NewKritaDocument(width, height, opts...)
+	if info != nil {
+		doc.Info = *info
+	}
+	doc.Name = kr.root
+	doc.Description = imageNode.Attrs["description"]
+	doc.Resolution = kr.resolution
+	doc.KritaVersion = mainDoc.Attrs["kritaVersion"]
+	doc.SyntaxVersion = mainDoc.Attrs["syntaxVersion"]
+	if doc.Layers, err = kr.readLayers(imageNode.Child("layers")); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// kraReader resolves archive entries for a document being read.
+type kraReader struct {
+	files      map[string]*zip.File
+	root       string
+	resolution float64
+	styles     map[string]*layers.LayerStyle
+	colorSpace layers.ColorSpace
+	profile    []byte
+}
+
+// lookup finds an entry under the image's root directory (as Krita writes
+// it), at the archive root, or failing both under any other directory.
+func (kr *kraReader) lookup(name string) *zip.File {
+	if kr.root != "" {
+		if f, ok := kr.files[kr.root+"/"+name]; ok {
+			return f
+		}
+	}
+	if f, ok := kr.files[name]; ok {
+		return f
+	}
+	for path, f := range kr.files {
+		if strings.HasSuffix(path, "/"+name) {
+			return f
+		}
+	}
+	return nil
+}
+
+func (kr *kraReader) has(name string) bool {
+	return kr.lookup(name) != nil
+}
+
+func (kr *kraReader) read(name string) ([]byte, error) {
+	f := kr.lookup(name)
+	if f == nil {
+		return nil, fmt.Errorf("missing archive entry %s", name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func (kr *kraReader) readXML(name string) (*xmlhelper.XMLNode, error) {
+	data, err := kr.read(name)
+	if err != nil {
+		return nil, err
+	}
+	node, err := xmlhelper.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return node, nil
+}
+
+// readLayers reads the layers of a <layers> element, which may be nil.
+func (kr *kraReader) readLayers(layersNode *xmlhelper.XMLNode) ([]layers.Layer, error) {
+	out := []layers.Layer{}
+	if layersNode == nil {
+		return out, nil
+	}
+	for _, node := range layersNode.Children {
+		if node.Tag != "layer" {
+			continue
+		}
+		layer, err := kr.readLayer(node)
+		if err != nil {
+			return nil, fmt.Errorf("layer %q: %w", node.Attrs["name"], err)
+		}
+		out = append(out, layer)
+	}
+	return out, nil
+}
+
+// readLayer builds a layer from its maindoc.xml element. Node types the
+// package does not model are kept as a RawLayer.
+func (kr *kraReader) readLayer(node *xmlhelper.XMLNode) (layers.Layer, error) {
+	switch node.Attrs["nodetype"] {
+	case "paintlayer":
+		return kr.readPaintLayer(node)
+	case "shapelayer":
+		return kr.readShapeLayer(node)
+	case "grouplayer":
+		return kr.readGroupLayer(node)
+	case "adjustmentlayer":
+		return kr.readAdjustmentLayer(node)
+	case "generatorlayer":
+		return kr.readGeneratorLayer(node)
+	}
+	return kr.readRawLayer(node)
+}
+
+func (kr *kraReader) readRawLayer(node *xmlhelper.XMLNode) (*layers.RawLayer, error) {
+	files, err := kr.readRawFiles(node.Attrs["filename"])
+	if err != nil {
+		return nil, err
+	}
+	layer := &layers.RawLayer{Type: node.Attrs["nodetype"], Attrs: node.Attrs, Files: files}
+	kr.readBaseAttributes(&layer.BaseLayer, node)
+	if layer.Masks, err = kr.readMasks(node.Child("masks")); err != nil {
+		return nil, err
+	}
+	layer.X = atoiDefault(node.Attrs["x"], 0)
+	layer.Y = atoiDefault(node.Attrs["y"], 0)
+	return layer, nil
+}
+
+// readRawFiles reads the data files of the node stored under filename in
+// the layers directory, keyed by the suffix following filename.
+func (kr *kraReader) readRawFiles(filename string) (map[string][]byte, error) {
+	files := map[string][]byte{}
+	if filename == "" {
+		return files, nil
+	}
+	for _, dir := range []string{kr.root + "/layers/", "layers/"} {
+		prefix := dir + filename
+		for path := range kr.files {
+			suffix, ok := strings.CutPrefix(path, prefix)
+			if !ok || (suffix != "" && suffix[0] != '.') || files[suffix] != nil {
+				continue
+			}
+			data, err := kr.read(path)
+			if err != nil {
+				return nil, err
+			}
+			files[suffix] = data
+		}
+	}
+	return files, nil
+}
+
+// readBaseAttributes fills the properties shared by all layers from their
+// maindoc.xml element.
+func (kr *kraReader) readBaseAttributes(b *layers.BaseLayer, node *xmlhelper.XMLNode) {
+	b.Name = node.Attrs["name"]
+	b.Visible = node.Attrs["visible"] != "0"
+	b.Locked = node.Attrs["locked"] == "1"
+	b.Opacity = layers.OpacityFromKrita(atoiDefault(node.Attrs["opacity"], 255))
+	b.BlendMode = layers.BlendMode(node.Attrs["compositeop"])
+	b.ColorLabel = layers.ColorLabel(atoiDefault(node.Attrs["colorlabel"], 0))
+	b.InheritAlpha = kr.nodeColorSpace(node).IsAlphaOff(node.Attrs["channelflags"])
+	b.Collapsed = node.Attrs["collapsed"] == "1"
+	b.InTimeline = node.Attrs["intimeline"] == "1"
+	if u := node.Attrs["uuid"]; u != "" {
+		b.UUID = u
+	}
+}
+
+// legacyColorSpaces maps color space ids older Krita versions wrote to the
+// ids Krita uses now, which rewrites them the same way on open.
+var legacyColorSpaces = map[layers.ColorSpace]layers.ColorSpace{
+	"RgbAF16": layers.RGBAF16,
+	"RgbAF32": layers.RGBAF32,
+}
+
+// colorSpaceAttr returns the colorspacename attribute of node, with legacy
+// ids mapped to current ones.
+func colorSpaceAttr(node *xmlhelper.XMLNode) layers.ColorSpace {
+	cs := layers.ColorSpace(node.Attrs["colorspacename"])
+	if current, ok := legacyColorSpaces[cs]; ok {
+		return current
+	}
+	return cs
+}
+
+// nodeColorSpace returns the color space of a layer's pixels, which sets
+// the length of its channel flags.
+func (kr *kraReader) nodeColorSpace(node *xmlhelper.XMLNode) layers.ColorSpace {
+	if cs := colorSpaceAttr(node); cs != "" {
+		return cs
+	}
+	return kr.colorSpace
+}
+
+func (kr *kraReader) readGroupLayer(node *xmlhelper.XMLNode) (*layers.GroupLayer, error) {
+	children, err := kr.readLayers(node.Child("layers"))
+	if err != nil {
+		return nil, err
+	}
+	group := layers.NewGroupLayer(node.Attrs["name"], children...)
+	kr.readBaseAttributes(&group.BaseLayer, node)
+	if group.Masks, err = kr.readMasks(node.Child("masks")); err != nil {
+		return nil, err
+	}
+	group.X = atoiDefault(node.Attrs["x"], 0)
+	group.Y = atoiDefault(node.Attrs["y"], 0)
+	group.Passthrough = node.Attrs["passthrough"] == "1"
+	return group, nil
+}
+
+func (kr *kraReader) readPaintLayer(node *xmlhelper.XMLNode) (*layers.PaintLayer, error) {
+	filename := "layers/" + node.Attrs["filename"]
+	data, err := kr.read(filename)
+	if err != nil {
+		return nil, err
+	}
+	var defaultPixel []byte
+	if kr.has(filename + ".defaultpixel") {
+		if defaultPixel, err = kr.read(filename + ".defaultpixel"); err != nil {
+			return nil, err
+		}
+	}
+	cs, expected := kr.colorSpace, kr.profile
+	if name := colorSpaceAttr(node); name != "" && name != cs {
+		cs, expected = name, defaultProfile(name)
+	}
+	img, _, err := DecodePaintDevice(bytes.NewReader(data), cs, defaultPixel)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	layer := layers.NewPaintLayer(img, node.Attrs["name"], atoiDefault(node.Attrs["x"], 0), atoiDefault(node.Attrs["y"], 0), layers.Opaque)
+	if cs != kr.colorSpace {
+		layer.ColorSpace = cs
+	}
+	if len(bytes.Trim(defaultPixel, "\x00")) > 0 {
+		if cs == layers.RGBAF16 || cs == layers.RGBAF32 {
+			layer.DefaultPixel = decodeFloatPixel(cs, defaultPixel)
+		} else {
+			layer.DefaultPixel = decodePixel(cs, defaultPixel)
+		}
+	}
+	if kr.has(filename + ".icc") {
+		profile, err := kr.read(filename + ".icc")
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(profile, expected) {
+			layer.ICCProfile = profile
+		}
+	}
+	kr.readBaseAttributes(&layer.BaseLayer, node)
+	if ref := layerStyleRef(node); ref != "" {
+		layer.LayerStyleUUID, layer.LayerStyle = ref, kr.styles[ref]
+	}
+	if layer.Masks, err = kr.readMasks(node.Child("masks")); err != nil {
+		return nil, err
+	}
+	layer.AlphaLocked = cs.IsAlphaOff(node.Attrs["channellockflags"])
+	return layer, nil
+}
+
+func (kr *kraReader) readAdjustmentLayer(node *xmlhelper.XMLNode) (*layers.AdjustmentLayer, error) {
+	filter, err := kr.readFilterConfig(node, node.Attrs["filtername"])
+	if err != nil {
+		return nil, err
+	}
+	layer := layers.NewAdjustmentLayer(filter, node.Attrs["name"])
+	kr.readBaseAttributes(&layer.BaseLayer, node)
+	if layer.Masks, err = kr.readMasks(node.Child("masks")); err != nil {
+		return nil, err
+	}
+	layer.X = atoiDefault(node.Attrs["x"], 0)
+	layer.Y = atoiDefault(node.Attrs["y"], 0)
+	return layer, nil
+}
+
+func (kr *kraReader) readGeneratorLayer(node *xmlhelper.XMLNode) (*layers.GeneratorLayer, error) {
+	generator, err := kr.readFilterConfig(node, node.Attrs["generatorname"])
+	if err != nil {
+		return nil, err
+	}
+	// The cached rendering becomes the preview.
+	filename := "layers/" + node.Attrs["filename"]
+	var preview image.Image
+	if kr.has(filename) {
+		data, err := kr.read(filename)
+		if err != nil {
+			return nil, err
+		}
+		cs := kr.nodeColorSpace(node)
+		var defaultPixel []byte
+		if kr.has(filename + ".defaultpixel") {
+			if defaultPixel, err = kr.read(filename + ".defaultpixel"); err != nil {
+				return nil, err
+			}
+		}
+		if preview, _, err = DecodePaintDevice(bytes.NewReader(data), cs, defaultPixel); err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+	layer := layers.NewGeneratorLayer(generator, preview, node.Attrs["name"])
+	kr.readBaseAttributes(&layer.BaseLayer, node)
+	if layer.Masks, err = kr.readMasks(node.Child("masks")); err != nil {
+		return nil, err
+	}
+	layer.X = atoiDefault(node.Attrs["x"], 0)
+	layer.Y = atoiDefault(node.Attrs["y"], 0)
+	return layer, nil
+}
+
+// readFilterConfig reads the .filterconfig file of a filter mask,
+// adjustment layer or generator layer, whose filter or generator is name.
+func (kr *kraReader) readFilterConfig(node *xmlhelper.XMLNode, name string) (layers.FilterConfig, error) {
+	filename := "layers/" + node.Attrs["filename"] + ".filterconfig"
+	data, err := kr.read(filename)
+	if err != nil {
+		return layers.FilterConfig{}, err
+	}
+	filter, err := layers.ParseFilterConfig(name, data)
+	if err != nil {
+		return layers.FilterConfig{}, fmt.Errorf("%s: %w", filename, err)
+	}
+	return filter, nil
+}
+
+func (kr *kraReader) readShapeLayer(node *xmlhelper.XMLNode) (*layers.ShapeLayer, error) {
+	name := "layers/" + node.Attrs["filename"] + ".shapelayer/content.svg"
+	data, err := kr.read(name)
+	if err != nil {
+		return nil, err
+	}
+	svg, err := xmlhelper.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	x := atoiDefault(node.Attrs["x"], 0)
+	y := atoiDefault(node.Attrs["y"], 0)
+
+	var layer *layers.ShapeLayer
+	if textNode := findText(svg); textNode != nil {
+		layer = layers.FromText("", node.Attrs["name"], x, y, layers.Opaque, parseTextStyle(textNode))
+		layer.Content = parseTextSpans(textNode)
+	} else {
+		style := shapes.NewShapeStyle()
+		toPixels := func(transform string) string {
+			return pixelTransform(transform, layers.PointsPerInch/kr.resolution)
+		}
+		layer = layers.FromShapes(parseShapes(svg.Children, toPixels), node.Attrs["name"], x, y, layers.Opaque, &style)
+	}
+	if !svgModeled(svg) {
+		layer.RawSVG = data
+	}
+	kr.readBaseAttributes(&layer.BaseLayer, node)
+	if ref := layerStyleRef(node); ref != "" {
+		layer.LayerStyleUUID, layer.LayerStyle = ref, kr.styles[ref]
+	}
+	if layer.Masks, err = kr.readMasks(node.Child("masks")); err != nil {
+		return nil, err
+	}
+	return layer, nil
+}
+
+// layerStyleRef returns the UUID of the layer style a layer element refers
+// to, or "".
+func layerStyleRef(node *xmlhelper.XMLNode) string {
+	return strings.Trim(node.Attrs["layerstyle"], "{}")
+}
+
+// readMasks reads the masks of a <masks> element, which may be nil. Mask
+// types the package does not model are kept as a RawMask.
+func (kr *kraReader) readMasks(masksNode *xmlhelper.XMLNode) ([]layers.Mask, error) {
+	if masksNode == nil {
+		return nil, nil
+	}
+	var out []layers.Mask
+	for _, node := range masksNode.Children {
+		if node.Tag != "mask" {
+			continue
+		}
+		var mask layers.Mask
+		var err error
+		switch node.Attrs["nodetype"] {
+		case "transparencymask":
+			mask, err = kr.readTransparencyMask(node)
+		case "filtermask":
+			mask, err = kr.readFilterMask(node)
+		default:
+			mask, err = kr.readRawMask(node)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("mask %q: %w", node.Attrs["name"], err)
+		}
+		out = append(out, mask)
+	}
+	return out, nil
+}
+
+// readMaskAttributes fills the properties shared by all masks from their
+// maindoc.xml element.
+func readMaskAttributes(b *layers.BaseMask, node *xmlhelper.XMLNode) {
+	b.Name = node.Attrs["name"]
+	b.Visible = node.Attrs["visible"] != "0"
+	b.Locked = node.Attrs["locked"] == "1"
+	b.ColorLabel = layers.ColorLabel(atoiDefault(node.Attrs["colorlabel"], 0))
+	if u := node.Attrs["uuid"]; u != "" {
+		b.UUID = u
+	}
+}
+
+func (kr *kraReader) readTransparencyMask(node *xmlhelper.XMLNode) (*layers.TransparencyMask, error) {
+	filename := "layers/" + node.Attrs["filename"] + ".pixelselection"
+	data, err := kr.read(filename)
+	if err != nil {
+		return nil, err
+	}
+	var defaultPixel []byte
+	if kr.has(filename + ".defaultpixel") {
+		if defaultPixel, err = kr.read(filename + ".defaultpixel"); err != nil {
+			return nil, err
+		}
+	}
+	img, _, err := DecodePaintDevice(bytes.NewReader(data), layers.Alpha, defaultPixel)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	mask := layers.NewTransparencyMask(img, node.Attrs["name"])
+	readMaskAttributes(&mask.BaseMask, node)
+	mask.X = atoiDefault(node.Attrs["x"], 0)
+	mask.Y = atoiDefault(node.Attrs["y"], 0)
+	if len(defaultPixel) == 1 {
+		mask.DefaultAlpha = defaultPixel[0]
+	}
+	return mask, nil
+}
+
+func (kr *kraReader) readFilterMask(node *xmlhelper.XMLNode) (*layers.FilterMask, error) {
+	filter, err := kr.readFilterConfig(node, node.Attrs["filtername"])
+	if err != nil {
+		return nil, err
+	}
+	mask := layers.NewFilterMask(filter, node.Attrs["name"])
+	readMaskAttributes(&mask.BaseMask, node)
+	return mask, nil
+}
+
+func (kr *kraReader) readRawMask(node *xmlhelper.XMLNode) (*layers.RawMask, error) {
+	files, err := kr.readRawFiles(node.Attrs["filename"])
+	if err != nil {
+		return nil, err
+	}
+	mask := &layers.RawMask{Type: node.Attrs["nodetype"], Attrs: node.Attrs, Files: files}
+	readMaskAttributes(&mask.BaseMask, node)
+	return mask, nil
+}
+
+// findText returns the first <text> element in an SVG tree.
+func findText(n *xmlhelper.XMLNode) *xmlhelper.XMLNode {
+	if n.Tag == "text" {
+		return n
+	}
+	for _, c := range n.Children {
+		if t := findText(c); t != nil {
+			return t
+		}
+	}
+	return nil
+}
+
+// svgModeled reports whether a ShapeLayer can hold everything in a
+// content.svg: either a single <text> or shapes parseShapes reads, next to
+// an empty <defs>.
+func svgModeled(svg *xmlhelper.XMLNode) bool {
+	var text, other int
+	for _, c := range svg.Children {
+		switch {
+		case c.Tag == "defs":
+			if len(c.Children) > 0 {
+				return false
+			}
+		case c.Tag == "text":
+			text++
+		case shapeModeled(c):
+			other++
+		default:
+			return false
+		}
+	}
+	return text == 0 || text == 1 && other == 0
+}
+
+// shapeModeled reports whether parseShapes reads n and everything in it.
+func shapeModeled(n *xmlhelper.XMLNode) bool {
+	switch n.Tag {
+	case "rect", "circle", "ellipse", "line", "path", "polyline", "polygon":
+		return true
+	case "g":
+		for _, c := range n.Children {
+			if !shapeModeled(c) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// pixelTransform maps a top-level shape transform from Krita's point-based
+// user space back to pixels, undoing the mapping GenerateSVGContent adds.
+func pixelTransform(transform string, scale float64) string {
+	toUser := layers.UserSpaceTransform(scale)
+	if strings.HasPrefix(transform, toUser) {
+		return strings.TrimSpace(strings.TrimPrefix(transform, toUser))
+	}
+	return strings.TrimSpace(layers.UserSpaceTransform(1/scale) + " " + transform)
+}
+
+// parseShapes converts SVG elements back into shapes, passing the transform
+// of each element through mapTransform when it is non-nil. Unsupported
+// elements are skipped.
+func parseShapes(nodes []*xmlhelper.XMLNode, mapTransform func(string) string) []shapes.Shape {
+	var out []shapes.Shape
+	for _, n := range nodes {
+		attrs := svgAttrs(n)
+		if mapTransform != nil {
+			attrs["transform"] = mapTransform(attrs["transform"])
+		}
+		base := shapes.BaseShape{Style: parseShapeStyle(attrs), Transform: attrs["transform"]}
+		switch n.Tag {
+		case "rect":
+			r := &shapes.Rectangle{
+				BaseShape: base,
+				X:         parseFloat(attrs["x"]),
+				Y:         parseFloat(attrs["y"]),
+				Width:     parseFloat(attrs["width"]),
+				Height:    parseFloat(attrs["height"]),
+			}
+			if v, ok := attrs["rx"]; ok {
+				rx := parseFloat(v)
+				r.Rx = &rx
+			}
+			if v, ok := attrs["ry"]; ok {
+				ry := parseFloat(v)
+				r.Ry = &ry
+			}
+			out = append(out, r)
+		case "circle":
+			out = append(out, &shapes.Circle{
+				BaseShape: base,
+				CX:        parseFloat(attrs["cx"]),
+				CY:        parseFloat(attrs["cy"]),
+				R:         parseFloat(attrs["r"]),
+			})
+		case "ellipse":
+			out = append(out, &shapes.Ellipse{
+				BaseShape: base,
+				CX:        parseFloat(attrs["cx"]),
+				CY:        parseFloat(attrs["cy"]),
+				RX:        parseFloat(attrs["rx"]),
+				RY:        parseFloat(attrs["ry"]),
+			})
+		case "line":
+			out = append(out, &shapes.Line{
+				BaseShape: base,
+				X1:        parseFloat(attrs["x1"]),
+				Y1:        parseFloat(attrs["y1"]),
+				X2:        parseFloat(attrs["x2"]),
+				Y2:        parseFloat(attrs["y2"]),
+			})
+		case "path":
+			out = append(out, &shapes.Path{BaseShape: base, D: attrs["d"]})
+		case "polyline", "polygon":
+			d := "M " + strings.TrimSpace(attrs["points"])
+			if n.Tag == "polygon" {
+				d += " Z"
+			}
+			out = append(out, &shapes.Path{BaseShape: base, D: d})
+		case "g":
+			out = append(out, &shapes.ShapeGroup{Shapes: parseShapes(n.Children, nil), Transform: attrs["transform"]})
+		}
+	}
+	return out
+}
+
+// svgAttrs merges an element's presentation attributes with the
+// declarations in its style attribute, the latter taking precedence.
+func svgAttrs(n *xmlhelper.XMLNode) map[string]string {
+	attrs := make(map[string]string, len(n.Attrs))
+	for k, v := range n.Attrs {
+		attrs[k] = v
+	}
+	for _, decl := range strings.Split(n.Attrs["style"], ";") {
+		k, v, ok := strings.Cut(decl, ":")
+		if ok {
+			attrs[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return attrs
+}
+
+func parseShapeStyle(attrs map[string]string) shapes.ShapeStyle {
+	style := shapes.NewShapeStyle()
+	if v, ok := attrs["fill"]; ok {
+		style.Fill = v
+	}
+	if v, ok := attrs["stroke"]; ok {
+		style.Stroke = v
+	}
+	if v, ok := attrs["stroke-width"]; ok {
+		style.StrokeWidth = parseFloat(v)
+	}
+	if v, ok := attrs["stroke-opacity"]; ok {
+		style.StrokeOpacity = parseFloat(v)
+	}
+	if v, ok := attrs["fill-opacity"]; ok {
+		style.FillOpacity = parseFloat(v)
+	}
+	if v, ok := attrs["stroke-linecap"]; ok {
+		style.StrokeLinecap = v
+	}
+	if v, ok := attrs["stroke-linejoin"]; ok {
+		style.StrokeLinejoin = v
+	}
+	if v, ok := attrs["stroke-dasharray"]; ok {
+		style.StrokeDasharray = &v
+	}
+	return style
+}
+
+func parseTextStyle(n *xmlhelper.XMLNode) *layers.TextStyle {
+	attrs := svgAttrs(n)
+	style := layers.NewTextStyle()
+	if v, ok := attrs["font-family"]; ok {
+		style.FontFamily = v
+	}
+	if v, ok := attrs["font-size"]; ok {
+		style.FontSize = parseFloat(v)
+	}
+	if v, ok := attrs["fill"]; ok {
+		style.FillColor = v
+	}
+	if v, ok := attrs["stroke"]; ok {
+		style.StrokeColor = v
+	}
+	if v, ok := attrs["stroke-width"]; ok {
+		style.StrokeWidth = parseFloat(v)
+	}
+	if v, ok := attrs["stroke-opacity"]; ok {
+		style.StrokeOpacity = parseFloat(v)
+	}
+	if v, ok := attrs["stroke-linecap"]; ok {
+		style.StrokeLinecap = v
+	}
+	if v, ok := attrs["stroke-linejoin"]; ok {
+		style.StrokeLinejoin = v
+	}
+	if v, ok := attrs["letter-spacing"]; ok {
+		style.LetterSpacing = parseFloat(v)
+	}
+	if v, ok := attrs["word-spacing"]; ok {
+		style.WordSpacing = parseFloat(v)
+	}
+	if v, ok := attrs["line-height"]; ok && v != "normal" {
+		style.LineHeight = parseFloat(v)
+	}
+	if v, ok := attrs["text-align"]; ok {
+		style.TextAlign = v
+	}
+	if v, ok := attrs["text-align-last"]; ok {
+		style.TextAlignLast = v
+	}
+	if v, ok := attrs["text-rendering"]; ok {
+		style.TextRendering = v
+	}
+	if v, ok := attrs["dominant-baseline"]; ok {
+		style.DominantBaseline = v
+	}
+	if v, ok := attrs["text-anchor"]; ok {
+		style.TextAnchor = v
+	}
+	if v, ok := attrs["paint-order"]; ok {
+		style.PaintOrder = v
+	}
+	style.UseRichText = attrs["useRichText"] == "true"
+	return style
+}
+
+// parseTextSpans reads the lines of a <text> element, with nested <tspan>
+// elements becoming rich text runs.
+func parseTextSpans(n *xmlhelper.XMLNode) []layers.TextSpan {
+	// Text directly inside <text> next to spans makes it a single line.
+	mixed := strings.TrimSpace(n.Text) != ""
+	for _, c := range n.Children {
+		mixed = mixed || strings.TrimSpace(c.Tail) != ""
+	}
+	if mixed && len(n.Children) > 0 {
+		line := parseTextSpan(n)
+		line.X, line.Dy, line.Style = 0, nil, nil
+		return []layers.TextSpan{line}
+	}
+	var spans []layers.TextSpan
+	for _, c := range n.Children {
+		if c.Tag == "tspan" {
+			spans = append(spans, parseTextSpan(c))
+		}
+	}
+	if len(spans) == 0 && strings.TrimSpace(n.Text) != "" {
+		spans = append(spans, layers.TextSpan{Text: n.Text})
+	}
+	return spans
+}
+
+func parseTextSpan(n *xmlhelper.XMLNode) layers.TextSpan {
+	span := layers.TextSpan{Text: n.Text, X: parseFloat(n.Attrs["x"])}
+	if v, ok := n.Attrs["dy"]; ok {
+		dy := parseFloat(v)
+		span.Dy = &dy
+	}
+	attrs := svgAttrs(n)
+	style := &layers.SpanStyle{
+		FontFamily:     attrs["font-family"],
+		FontWeight:     attrs["font-weight"],
+		FontStyle:      attrs["font-style"],
+		FontSize:       parseFloat(attrs["font-size"]),
+		FillColor:      attrs["fill"],
+		StrokeColor:    attrs["stroke"],
+		StrokeWidth:    parseFloat(attrs["stroke-width"]),
+		BaselineShift:  attrs["baseline-shift"],
+		TextDecoration: attrs["text-decoration"],
+	}
+	if *style != (layers.SpanStyle{}) {
+		span.Style = style
+	}
+	// Text following a nested span becomes an unstyled run of its own.
+	for _, c := range n.Children {
+		if c.Tag == "tspan" {
+			span.Runs = append(span.Runs, parseTextSpan(c))
+		}
+		if c.Tail != "" {
+			span.Runs = append(span.Runs, layers.TextSpan{Text: c.Tail})
+		}
+	}
+	return span
+}
+
+// parseFloat parses an SVG number, ignoring a trailing unit.
+func parseFloat(s string) float64 {
+	s = strings.TrimSpace(s)
+	end := len(s)
+	for end > 0 && (s[end-1] < '0' || s[end-1] > '9') && s[end-1] != '.' {
+		end--
+	}
+	v, _ := strconv.ParseFloat(s[:end], 64)
+	return v
+}
+
+func atoiDefault(s string, def int) int {
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return def
+	}
+	return v
+}
@@ -0,0 +1,437 @@
+package document_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"image"
+	"image/color"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/cozy-creator/kritago/pkg/document"
+	"github.com/cozy-creator/kritago/pkg/layers"
+	"github.com/cozy-creator/kritago/pkg/shapes"
+)
+
+// roundTrip writes doc and reads it back.
+func roundTrip(t *testing.T, doc *document.KritaDocument) *document.KritaDocument {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := doc.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	got, err := document.Read(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	return got
+}
+
+func TestReadWriteRoundTrip(t *testing.T) {
+	doc := document.NewKritaDocument(200, 100)
+	doc.Name = "Poster"
+	doc.Description = "round trip"
+	doc.Info.Title = "Title"
+
+	// Added below one another, so the list ends up in this order.
+	doc.AddTextLayer("Hello\nWorld", "Text", 10, 20, layers.Opaque, nil)
+	rect := &shapes.Rectangle{BaseShape: shapes.BaseShape{Style: shapes.NewShapeStyle()}, X: 5, Y: 6, Width: 30, Height: 40}
+	doc.AddShapeLayer([]shapes.Shape{rect}, "Shapes", 0, 0, layers.Opaque, nil)
+
+	paint := layers.NewPaintLayer(gradient(70), "Paint", 3, 4, 0.5)
+	paint.BlendMode = layers.BlendMultiply
+	paint.InheritAlpha = true
+	paint.AlphaLocked = true
+	paint.ColorLabel = layers.LabelRed
+	paint.LayerStyle = layers.NewLayerStyle()
+	paint.LayerStyle.StrokeEnabled = true
+	mask := image.NewAlpha(image.Rect(0, 0, 10, 10))
+	mask.Pix[0] = 200
+	paint.Masks = []layers.Mask{layers.NewTransparencyMask(mask, "Mask")}
+	doc.AddLayer(paint)
+
+	group := doc.AddGroupLayer("Group", layers.NewPaintLayer(gradient(8), "Child", 0, 0, layers.Opaque))
+	group.Passthrough = true
+	doc.AddAdjustmentLayer(layers.Blur(2, 3), "Blur")
+	doc.AddLayer(layers.NewColorFillLayer(color.NRGBA{10, 20, 30, 255}, "Fill"))
+	doc.AddLayer(&layers.RawLayer{
+		BaseLayer: layers.BaseLayer{Name: "Clone", Visible: true, Opacity: layers.Opaque, UUID: "{00000000-0000-0000-0000-000000000001}"},
+		Type:      "clonelayer",
+		Attrs:     map[string]string{"clonefrom": "Paint", "clonetype": "1"},
+		Files:     map[string][]byte{".extra": []byte("payload")},
+		X:         7,
+	})
+
+	got := roundTrip(t, doc)
+	if got.Width != 200 || got.Height != 100 || got.Name != "Poster" || got.Description != "round trip" || got.Info.Title != "Title" {
+		t.Errorf("document properties = %dx%d %q %q %q", got.Width, got.Height, got.Name, got.Description, got.Info.Title)
+	}
+	var names []string
+	for _, l := range got.Layers {
+		names = append(names, l.GetName())
+	}
+	if want := "Text Shapes Paint Group Blur Fill Clone"; strings.Join(names, " ") != want {
+		t.Fatalf("layers = %v, want %s", names, want)
+	}
+
+	text := got.Layers[0].(*layers.ShapeLayer)
+	if spans := text.Content.([]layers.TextSpan); len(spans) != 2 || spans[0].Text != "Hello" || spans[1].Text != "World" {
+		t.Errorf("text spans = %+v", spans)
+	}
+	if x, y := text.Offset(); x != 10 || y != 20 {
+		t.Errorf("text offset = %d,%d", x, y)
+	}
+	if s := got.Layers[1].(*layers.ShapeLayer).Content.([]shapes.Shape); len(s) != 1 {
+		t.Errorf("shapes = %+v", s)
+	} else if r, ok := s[0].(*shapes.Rectangle); !ok || r.Width != 30 || r.Height != 40 {
+		t.Errorf("shape = %+v", s[0])
+	}
+
+	p := got.Layers[2].(*layers.PaintLayer)
+	if p.X != 3 || p.Y != 4 || p.Opacity.Krita() != 128 || p.BlendMode != layers.BlendMultiply ||
+		!p.InheritAlpha || !p.AlphaLocked || p.ColorLabel != layers.LabelRed || p.UUID != paint.UUID {
+		t.Errorf("paint layer = %+v", p.BaseLayer)
+	}
+	if p.LayerStyle == nil || !p.LayerStyle.StrokeEnabled {
+		t.Errorf("paint layer style = %+v", p.LayerStyle)
+	}
+	if c := p.Image.At(69, 69); c != color.Color(gradient(70).At(69, 69)) {
+		t.Errorf("paint pixel = %v", c)
+	}
+	if len(p.Masks) != 1 {
+		t.Fatalf("paint masks = %v", p.Masks)
+	}
+	if m := p.Masks[0].(*layers.TransparencyMask); m.GetName() != "Mask" || m.Image.(*image.Alpha).AlphaAt(0, 0).A != 200 {
+		t.Errorf("mask = %+v", m)
+	}
+
+	if g := got.Layers[3].(*layers.GroupLayer); !g.Passthrough || len(g.Layers) != 1 || g.Layers[0].GetName() != "Child" {
+		t.Errorf("group = %+v", g)
+	}
+	if a := got.Layers[4].(*layers.AdjustmentLayer); a.Filter.Name != "blur" || a.Filter.Params["halfHeight"] != "3" {
+		t.Errorf("adjustment filter = %+v", a.Filter)
+	}
+	if f := got.Layers[5].(*layers.GeneratorLayer); f.Generator.Name != "color" {
+		t.Errorf("generator = %+v", f.Generator)
+	}
+	clone, ok := got.Layers[6].(*layers.RawLayer)
+	if !ok {
+		t.Fatalf("clone layer read as %T", got.Layers[6])
+	}
+	if clone.Type != "clonelayer" || clone.Attrs["clonefrom"] != "Paint" || clone.X != 7 || string(clone.Files[".extra"]) != "payload" {
+		t.Errorf("clone layer = %+v", clone)
+	}
+
+	// A second pass writes back what was read.
+	again := roundTrip(t, got)
+	if clone := again.Layers[6].(*layers.RawLayer); clone.Attrs["clonetype"] != "1" || string(clone.Files[".extra"]) != "payload" {
+		t.Errorf("clone layer after second pass = %+v", clone)
+	}
+}
+
+// TestReadKeepsUnknownMasks checks that masks of kinds the package does not
+// model survive a read and write.
+func TestReadKeepsUnknownMasks(t *testing.T) {
+	doc := document.NewKritaDocument(16, 16)
+	layer := layers.NewPaintLayer(gradient(16), "Paint", 0, 0, layers.Opaque)
+	layer.Masks = []layers.Mask{&layers.RawMask{
+		BaseMask: layers.BaseMask{Name: "Selection", Visible: true},
+		Type:     "selectionmask",
+		Attrs:    map[string]string{"active": "1"},
+		Files:    map[string][]byte{".pixelselection": []byte("tiles")},
+	}}
+	doc.AddLayer(layer)
+
+	got := roundTrip(t, doc).Layers[0].(*layers.PaintLayer)
+	if len(got.Masks) != 1 {
+		t.Fatalf("masks = %v", got.Masks)
+	}
+	m, ok := got.Masks[0].(*layers.RawMask)
+	if !ok || m.Type != "selectionmask" || m.Attrs["active"] != "1" || string(m.Files[".pixelselection"]) != "tiles" {
+		t.Errorf("mask = %+v", got.Masks[0])
+	}
+}
+
+// TestReadSkipsForeignLayerStyles checks that layer styles the package
+// cannot parse do not keep the document from opening.
+func TestReadSkipsForeignLayerStyles(t *testing.T) {
+	doc := document.NewKritaDocument(16, 16)
+	layer := layers.NewPaintLayer(gradient(16), "Paint", 0, 0, layers.Opaque)
+	layer.LayerStyle = layers.NewLayerStyle()
+	doc.AddLayer(layer)
+	files := archiveFiles(t, doc)
+
+	// Swap in an ASL file with a descriptor layout the parser rejects.
+	for name := range files {
+		if strings.HasSuffix(name, "layerstyles.asl") {
+			files[name] = "\x00\x028BSL\x00\x03\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x10\x00\x00\x00\x10junk"
+		}
+	}
+	got := readArchive(t, files)
+	if p := got.Layers[0].(*layers.PaintLayer); p.LayerStyle != nil {
+		t.Errorf("layer style = %+v, want none", p.LayerStyle)
+	}
+}
+
+// archiveFiles writes doc and returns the entries of the archive by name.
+func archiveFiles(t *testing.T, doc *document.KritaDocument) map[string]string {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := doc.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(data)
+	}
+	return files
+}
+
+// readArchive builds a .kra archive from files and reads it.
+func readArchive(t *testing.T, files map[string]string) *document.KritaDocument {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := document.Read(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	return doc
+}
+
+func TestReadMixedContentText(t *testing.T) {
+	doc := readArchive(t, map[string]string{
+		"maindoc.xml": `<DOC><IMAGE width="10" height="10" name="T"><layers>` +
+			`<layer nodetype="shapelayer" filename="layer2" name="Text"/></layers></IMAGE></DOC>`,
+		"T/layers/layer2.shapelayer/content.svg": `<svg><text>` +
+			`<tspan x="0">Only <tspan style="font-weight: bold;">$5</tspan> today</tspan>` +
+			`<tspan x="0" dy="14">Next <tspan fill="#ff0000">line</tspan></tspan></text></svg>`,
+	})
+	lines := doc.Layers[0].(*layers.ShapeLayer).Content.([]layers.TextSpan)
+	if len(lines) != 2 {
+		t.Fatalf("lines = %+v", lines)
+	}
+	if got := lines[0].PlainText(); got != "Only $5 today" {
+		t.Errorf("first line = %q, want %q", got, "Only $5 today")
+	}
+	if runs := lines[0].Runs; len(runs) != 2 || runs[0].Style == nil || runs[0].Style.FontWeight != "bold" || runs[1].Style != nil {
+		t.Errorf("first line runs = %+v", runs)
+	}
+	if got := lines[1].PlainText(); got != "Next line" {
+		t.Errorf("second line = %q, want %q", got, "Next line")
+	}
+
+	doc = readArchive(t, map[string]string{
+		"maindoc.xml": `<DOC><IMAGE width="10" height="10" name="T"><layers>` +
+			`<layer nodetype="shapelayer" filename="layer2" name="Text"/></layers></IMAGE></DOC>`,
+		"T/layers/layer2.shapelayer/content.svg": `<svg><text>Only <tspan>$5</tspan> today</text></svg>`,
+	})
+	lines = doc.Layers[0].(*layers.ShapeLayer).Content.([]layers.TextSpan)
+	if len(lines) != 1 || lines[0].PlainText() != "Only $5 today" {
+		t.Errorf("lines = %+v", lines)
+	}
+}
+
+// TestChannelFlagsFollowColorSpace checks that channel flags have one flag
+// per channel of the layer's color space, with alpha last.
+func TestChannelFlagsFollowColorSpace(t *testing.T) {
+	for _, tt := range []struct {
+		cs    layers.ColorSpace
+		flags string // alpha off
+	}{
+		{layers.RGBA8, "1110"},
+		{layers.GrayA8, "10"},
+		{layers.CMYKA8, "11110"},
+	} {
+		doc := document.NewKritaDocument(16, 16, document.WithColorSpace(tt.cs))
+		layer := layers.NewPaintLayer(gradient(16), "Paint", 0, 0, layers.Opaque)
+		layer.InheritAlpha = true
+		layer.AlphaLocked = true
+		doc.AddLayer(layer)
+		group := doc.AddGroupLayer("Group")
+		group.InheritAlpha = true
+
+		maindoc := archiveFiles(t, doc)["maindoc.xml"]
+		for _, want := range []string{
+			`channelflags="` + tt.flags + `"`,
+			`channellockflags="` + tt.flags + `"`,
+		} {
+			if !strings.Contains(maindoc, want) {
+				t.Errorf("%s: maindoc.xml lacks %s", tt.cs, want)
+			}
+		}
+
+		got := roundTrip(t, doc)
+		p := got.Layers[0].(*layers.PaintLayer)
+		if !p.InheritAlpha || !p.AlphaLocked {
+			t.Errorf("%s: paint layer inherit alpha %v, alpha locked %v", tt.cs, p.InheritAlpha, p.AlphaLocked)
+		}
+		if g := got.Layers[1].(*layers.GroupLayer); !g.InheritAlpha {
+			t.Errorf("%s: group does not inherit alpha", tt.cs)
+		}
+	}
+}
+
+// TestReadFloatColorSpaceIDs checks that float documents use the color
+// space ids current Krita writes, and that the legacy ids still open.
+func TestReadFloatColorSpaceIDs(t *testing.T) {
+	for _, tt := range []struct {
+		cs layers.ColorSpace
+		id string // as written to maindoc.xml
+	}{
+		{layers.RGBAF16, "RGBAF16"},
+		{layers.RGBAF32, "RGBAF32"},
+		{layers.RGBAF16, "RgbAF16"},
+		{layers.RGBAF32, "RgbAF32"},
+	} {
+		doc := document.NewKritaDocument(16, 16, document.WithColorSpace(tt.cs))
+		layer := layers.NewPaintLayer(gradient(16), "Paint", 0, 0, layers.Opaque)
+		layer.ColorSpace = tt.cs
+		doc.AddLayer(layer)
+		files := archiveFiles(t, doc)
+		written := `colorspacename="` + string(tt.cs) + `"`
+		if strings.Count(files["maindoc.xml"], written) != 2 {
+			t.Fatalf("%s: maindoc.xml lacks %s", tt.id, written)
+		}
+		files["maindoc.xml"] = strings.ReplaceAll(files["maindoc.xml"], written, `colorspacename="`+tt.id+`"`)
+
+		got := readArchive(t, files)
+		if got.ColorSpace != tt.cs {
+			t.Errorf("%s: document color space = %q, want %q", tt.id, got.ColorSpace, tt.cs)
+		}
+		p := got.Layers[0].(*layers.PaintLayer)
+		if _, ok := p.Image.(*layers.FloatRGBA); !ok {
+			t.Errorf("%s: layer image is %T", tt.id, p.Image)
+		}
+	}
+}
+
+// TestReadKeepsKritaCompositeOps checks that documents using composite ops
+// the compositor has no formula for still save and keep their op.
+func TestReadKeepsKritaCompositeOps(t *testing.T) {
+	for _, mode := range []layers.BlendMode{layers.BlendLuminositySAI, layers.BlendCombineNormal, layers.BlendModuloContinuous} {
+		doc := document.NewKritaDocument(16, 16)
+		doc.AddLayer(layers.NewPaintLayer(gradient(16), "Paint", 0, 0, layers.Opaque))
+		files := archiveFiles(t, doc)
+		files["maindoc.xml"] = strings.Replace(files["maindoc.xml"], `compositeop="normal"`, `compositeop="`+string(mode)+`"`, 1)
+
+		got := roundTrip(t, readArchive(t, files))
+		if m := got.Layers[0].GetBlendMode(); m != mode {
+			t.Errorf("%s: blend mode = %q", mode, m)
+		}
+	}
+}
+
+// TestReadKeepsUnmodeledSVG checks that vector layers with content the
+// model cannot represent write their content.svg back unchanged.
+func TestReadKeepsUnmodeledSVG(t *testing.T) {
+	tests := []struct {
+		name, svg string
+		raw       bool
+	}{
+		{"shapes", `<svg><defs/><rect width="4" height="4"/><g><circle r="2"/></g></svg>`, false},
+		{"text", `<svg><defs/><text><tspan x="0">Hi</tspan></text></svg>`, false},
+		{"text and rect", `<svg><text><tspan x="0">Hi</tspan></text><rect width="4" height="4"/></svg>`, true},
+		{"image", `<svg><image width="4" height="4" xlink:href="data:image/png;base64,AA=="/></svg>`, true},
+		{"use", `<svg><rect id="r" width="4" height="4"/><use xlink:href="#r"/></svg>`, true},
+		{"gradient", `<svg><defs><linearGradient id="g"/></defs><rect fill="url(#g)" width="4" height="4"/></svg>`, true},
+		{"marker", `<svg><defs><marker id="m"/></defs><path d="M 0 0 L 4 4" marker-end="url(#m)"/></svg>`, true},
+	}
+	for _, tt := range tests {
+		doc := readArchive(t, map[string]string{
+			"maindoc.xml": `<DOC><IMAGE width="10" height="10" name="T"><layers>` +
+				`<layer nodetype="shapelayer" filename="layer2" name="Vector"/></layers></IMAGE></DOC>`,
+			"T/layers/layer2.shapelayer/content.svg": tt.svg,
+		})
+		layer := doc.Layers[0].(*layers.ShapeLayer)
+		if got := layer.RawSVG != nil; got != tt.raw {
+			t.Errorf("%s: kept raw content = %v, want %v", tt.name, got, tt.raw)
+			continue
+		}
+		if !tt.raw {
+			continue
+		}
+		written := 0
+		for name, data := range archiveFiles(t, doc) {
+			if strings.HasSuffix(name, ".shapelayer/content.svg") {
+				written++
+				if data != tt.svg {
+					t.Errorf("%s: wrote %s = %q, want %q", tt.name, name, data, tt.svg)
+				}
+			}
+		}
+		if written != 1 {
+			t.Errorf("%s: wrote %d content.svg files", tt.name, written)
+		}
+	}
+}
+
+// TestReadFractionalTextStyle checks that fractional text sizes survive
+// reading and writing.
+func TestReadFractionalTextStyle(t *testing.T) {
+	style := layers.NewTextStyle()
+	style.FontSize, style.StrokeWidth, style.LetterSpacing, style.WordSpacing = 10.5, 0.75, 1.25, 2.5
+	doc := document.NewKritaDocument(64, 64)
+	doc.AddLayer(layers.FromText("Hi", "Text", 0, 0, layers.Opaque, style))
+
+	got := roundTrip(t, doc).Layers[0].(*layers.ShapeLayer).Style.(*layers.TextStyle)
+	for _, tt := range []struct {
+		name      string
+		got, want float64
+	}{
+		{"font-size", got.FontSize, 10.5},
+		{"stroke-width", got.StrokeWidth, 0.75},
+		{"letter-spacing", got.LetterSpacing, 1.25},
+		{"word-spacing", got.WordSpacing, 2.5},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+// TestTextVersionFollowsKritaVersion checks that vector text is marked with
+// the text version of the Krita release the document targets.
+func TestTextVersionFollowsKritaVersion(t *testing.T) {
+	for _, tt := range []struct {
+		krita, want string
+	}{
+		{"", `krita:textVersion="3"`},
+		{"5.2.0", `krita:textVersion="3"`},
+		{"5.1.5", `krita:textVersion="2"`},
+		{"4.4.8", `krita:textVersion="2"`},
+	} {
+		doc := document.NewKritaDocument(64, 64)
+		doc.KritaVersion = tt.krita
+		doc.AddLayer(layers.FromText("Hi", "Text", 0, 0, layers.Opaque, nil))
+		for name, data := range archiveFiles(t, doc) {
+			if strings.HasSuffix(name, ".shapelayer/content.svg") && !strings.Contains(data, tt.want) {
+				t.Errorf("Krita %q: content.svg lacks %s", tt.krita, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,12 @@
+package document
+
+import "github.com/cozy-creator/kritago/pkg/layers"
+
+// defaultResolution is the document resolution in pixels per inch.
+const defaultResolution = 300.0
+
+// GenerateSVGContent renders a shape layer as the content.svg the current
+// Krita release stores for vector layers.
+func GenerateSVGContent(layer *layers.ShapeLayer, width, height int) (string, error) {
+	return layer.SVGContent(width, height, defaultResolution, "")
+}
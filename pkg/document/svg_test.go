@@ -0,0 +1,155 @@
+package document_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cozy-creator/kritago/pkg/document"
+	"github.com/cozy-creator/kritago/pkg/layers"
+	"github.com/cozy-creator/kritago/pkg/shapes"
+	"github.com/cozy-creator/kritago/pkg/xmlhelper"
+)
+
+// svgContent renders layer for a 300x150 canvas and parses the result.
+func svgContent(t *testing.T, layer *layers.ShapeLayer) *xmlhelper.XMLNode {
+	t.Helper()
+	svg, err := document.GenerateSVGContent(layer, 300, 150)
+	if err != nil {
+		t.Fatalf("GenerateSVGContent: %v", err)
+	}
+	root, err := xmlhelper.Parse(strings.NewReader(svg))
+	if err != nil {
+		t.Fatalf("parse %s: %v", svg, err)
+	}
+	return root
+}
+
+func TestShapeLayerSVG(t *testing.T) {
+	style := shapes.NewShapeStyle()
+	style.Fill = "#ff0000"
+	tests := []struct {
+		shape shapes.Shape
+		tag   string
+		attrs map[string]string
+	}{
+		{&shapes.Rectangle{X: 1, Y: 2, Width: 3, Height: 4}, "rect", map[string]string{"x": "1", "y": "2", "width": "3", "height": "4"}},
+		{&shapes.Circle{CX: 5, CY: 6, R: 7}, "circle", map[string]string{"cx": "5", "cy": "6", "r": "7"}},
+		{&shapes.Ellipse{CX: 1, CY: 2, RX: 3, RY: 4}, "ellipse", map[string]string{"rx": "3", "ry": "4"}},
+		{&shapes.Line{X1: 1, Y1: 2, X2: 3, Y2: 4}, "line", map[string]string{"x2": "3", "y2": "4", "marker-fill-method": "auto"}},
+		{&shapes.Path{D: "M 0 0 L 1 1"}, "path", map[string]string{"d": "M 0 0 L 1 1", "marker-fill-method": "auto"}},
+	}
+	for _, tt := range tests {
+		root := svgContent(t, layers.FromShapes([]shapes.Shape{tt.shape}, "Shapes", 0, 0, layers.Opaque, &style))
+		// A 300 pixel canvas at 300 dpi is 72 points wide.
+		if root.Attrs["width"] != "72pt" || root.Attrs["height"] != "36pt" || root.Attrs["viewBox"] != "0 0 72 36" {
+			t.Errorf("%s: svg attributes = %v", tt.tag, root.Attrs)
+		}
+		if len(root.Children) != 2 || root.Children[0].Tag != "defs" {
+			t.Fatalf("%s: elements = %+v", tt.tag, root.Children)
+		}
+		el := root.Children[1]
+		if el.Tag != tt.tag {
+			t.Errorf("element = %s, want %s", el.Tag, tt.tag)
+		}
+		want := map[string]string{"id": "shape0", "fill": "#ff0000", "transform": "matrix(0.24 0 0 0.24 0 0)"}
+		for k, v := range tt.attrs {
+			want[k] = v
+		}
+		for k, v := range want {
+			if el.Attrs[k] != v {
+				t.Errorf("%s %s = %q, want %q", tt.tag, k, el.Attrs[k], v)
+			}
+		}
+	}
+}
+
+// TestShapeLayerSVGGroups checks that shapes in groups get ids of their own
+// and the layer style, while shapes with a style keep it.
+func TestShapeLayerSVGGroups(t *testing.T) {
+	layerStyle := shapes.NewShapeStyle()
+	layerStyle.Fill = "#ff0000"
+	own := shapes.NewShapeStyle()
+	own.Fill = "#00ff00"
+	root := svgContent(t, layers.FromShapes([]shapes.Shape{
+		&shapes.ShapeGroup{Shapes: []shapes.Shape{
+			&shapes.Circle{R: 1},
+			&shapes.Circle{BaseShape: shapes.BaseShape{Style: own}, R: 2},
+		}},
+		&shapes.Rectangle{Width: 1, Height: 1},
+	}, "Shapes", 0, 0, layers.Opaque, &layerStyle))
+
+	if len(root.Children) != 3 {
+		t.Fatalf("elements = %+v", root.Children)
+	}
+	group, rect := root.Children[1], root.Children[2]
+	if group.Tag != "g" || group.Attrs["id"] != "shape0" || len(group.Children) != 2 {
+		t.Fatalf("group = %+v", group)
+	}
+	for i, want := range []struct{ id, fill string }{{"shape1", "#ff0000"}, {"shape2", "#00ff00"}} {
+		if c := group.Children[i]; c.Attrs["id"] != want.id || c.Attrs["fill"] != want.fill {
+			t.Errorf("group child %d = %v, want id %s and fill %s", i, c.Attrs, want.id, want.fill)
+		}
+	}
+	if rect.Attrs["id"] != "shape3" {
+		t.Errorf("rect id = %q, want shape3", rect.Attrs["id"])
+	}
+}
+
+func TestTextLayerSVG(t *testing.T) {
+	style := layers.NewTextStyle()
+	style.FontFamily, style.FontSize, style.LineHeight = "Noto Sans", 10, 1.5
+	style.FillColor, style.StrokeColor, style.LetterSpacing = "#112233", "#445566", 2
+	tests := []struct {
+		name  string
+		layer *layers.ShapeLayer
+		lines []string
+		rich  string
+	}{
+		{"plain", layers.FromText("One\nTwo\r\nThree", "Text", 0, 0, layers.Opaque, style), []string{"One", "Two", "Three"}, "false"},
+		{"single line", layers.FromText("One", "Text", 0, 0, layers.Opaque, style), []string{"One"}, "false"},
+		{"rich", layers.FromRichText([][]layers.TextSpan{
+			{layers.Run("Bold", &layers.SpanStyle{FontWeight: "bold"}), layers.Run(" text", nil)},
+			{layers.Run("Two", nil)},
+		}, "Text", 0, 0, layers.Opaque, style), []string{"Bold text", "Two"}, "true"},
+	}
+	for _, tt := range tests {
+		root := svgContent(t, tt.layer)
+		if len(root.Children) != 2 || root.Children[1].Tag != "text" {
+			t.Fatalf("%s: elements = %+v", tt.name, root.Children)
+		}
+		text := root.Children[1]
+		for k, v := range map[string]string{
+			"id": "shape0", "textVersion": "3", "useRichText": tt.rich, "transform": "translate(0, 10)",
+			"fill": "#112233", "stroke": "#445566", "letter-spacing": "2",
+		} {
+			if text.Attrs[k] != v {
+				t.Errorf("%s: text %s = %q, want %q", tt.name, k, text.Attrs[k], v)
+			}
+		}
+		for _, decl := range []string{"font-family: Noto Sans;", "font-size: 10;", "line-height: 1.5;"} {
+			if !strings.Contains(text.Attrs["style"], decl) {
+				t.Errorf("%s: text style %q lacks %q", tt.name, text.Attrs["style"], decl)
+			}
+		}
+		if len(text.Children) != len(tt.lines) {
+			t.Fatalf("%s: %d tspans, want %d", tt.name, len(text.Children), len(tt.lines))
+		}
+		for i, line := range text.Children {
+			if got := plainText(line); got != tt.lines[i] {
+				t.Errorf("%s: line %d = %q, want %q", tt.name, i, got, tt.lines[i])
+			}
+			if i > 0 && (line.Attrs["x"] != "0" || line.Attrs["dy"] != "15") {
+				t.Errorf("%s: line %d x, dy = %q, %q, want 0, 15", tt.name, i, line.Attrs["x"], line.Attrs["dy"])
+			}
+		}
+	}
+}
+
+// plainText returns the text of an element and its descendants.
+func plainText(n *xmlhelper.XMLNode) string {
+	text := n.Text
+	for _, c := range n.Children {
+		text += plainText(c) + c.Tail
+	}
+	return text
+}
@@ -0,0 +1,198 @@
+package layers
+
+// BlendMode is a Krita composite op id, written to maindoc.xml as a
+// layer's compositeop attribute.
+type BlendMode string
+
+// Blend modes, named after Krita's composite ops.
+const (
+	BlendNormal      BlendMode = "normal"
+	BlendErase       BlendMode = "erase"
+	BlendBehind      BlendMode = "behind"
+	BlendDissolve    BlendMode = "dissolve"
+	BlendAlphaDarken BlendMode = "alphadarken"
+	BlendGreater     BlendMode = "greater"
+
+	// Darken
+	BlendDarken                BlendMode = "darken"
+	BlendMultiply              BlendMode = "multiply"
+	BlendColorBurn             BlendMode = "burn"
+	BlendLinearBurn            BlendMode = "linear_burn"
+	BlendDarkerColor           BlendMode = "darker color"
+	BlendGammaDark             BlendMode = "gamma_dark"
+	BlendShadeIFSIllusions     BlendMode = "shade_ifs_illusions"
+	BlendFogDarkenIFSIllusions BlendMode = "fog_darken_ifs_illusions"
+	BlendEasyBurn              BlendMode = "easy burn"
+
+	// Lighten
+	BlendLighten                BlendMode = "lighten"
+	BlendScreen                 BlendMode = "screen"
+	BlendColorDodge             BlendMode = "dodge"
+	BlendLinearDodge            BlendMode = "linear_dodge"
+	BlendAdd                    BlendMode = "add"
+	BlendLighterColor           BlendMode = "lighter color"
+	BlendGammaLight             BlendMode = "gamma_light"
+	BlendGammaIllumination      BlendMode = "gamma_illumination"
+	BlendTintIFSIllusions       BlendMode = "tint_ifs_illusions"
+	BlendFogLightenIFSIllusions BlendMode = "fog_lighten_ifs_illusions"
+	BlendEasyDodge              BlendMode = "easy dodge"
+	BlendLuminositySAI          BlendMode = "luminosity_sai"
+
+	// Contrast
+	BlendOverlay               BlendMode = "overlay"
+	BlendHardOverlay           BlendMode = "hard overlay"
+	BlendSoftLight             BlendMode = "soft_light"
+	BlendSoftLightSVG          BlendMode = "soft_light_svg"
+	BlendSoftLightPegtopDelphi BlendMode = "soft_light_pegtop_delphi"
+	BlendSoftLightIFSIllusions BlendMode = "soft_light_ifs_illusions"
+	BlendHardLight             BlendMode = "hard_light"
+	BlendVividLight            BlendMode = "vivid_light"
+	BlendLinearLight           BlendMode = "linear light"
+	BlendPinLight              BlendMode = "pin_light"
+	BlendFlatLight             BlendMode = "flat_light"
+	BlendSuperLight            BlendMode = "super_light"
+	BlendPNormA                BlendMode = "pnorm_a"
+	BlendPNormB                BlendMode = "pnorm_b"
+	BlendHardMix               BlendMode = "hard mix"
+	BlendHardMixPhotoshop      BlendMode = "hard_mix_photoshop"
+	BlendHardMixSofter         BlendMode = "hard_mix_softer_photoshop"
+
+	// Arithmetic and comparison
+	BlendSubtract            BlendMode = "subtract"
+	BlendInverseSubtract     BlendMode = "inverse_subtract"
+	BlendDivide              BlendMode = "divide"
+	BlendDifference          BlendMode = "diff"
+	BlendExclusion           BlendMode = "exclusion"
+	BlendNegation            BlendMode = "negation"
+	BlendEquivalence         BlendMode = "equivalence"
+	BlendGrainMerge          BlendMode = "grain_merge"
+	BlendGrainExtract        BlendMode = "grain_extract"
+	BlendGeometricMean       BlendMode = "geometric_mean"
+	BlendAllanon             BlendMode = "allanon"
+	BlendParallel            BlendMode = "parallel"
+	BlendArcTangent          BlendMode = "arc_tangent"
+	BlendAdditiveSubtractive BlendMode = "additive_subtractive"
+	BlendInterpolation       BlendMode = "interpolation"
+	BlendInterpolation2X     BlendMode = "interpolation 2x"
+	BlendPenumbraA           BlendMode = "penumbra a"
+	BlendPenumbraB           BlendMode = "penumbra b"
+	BlendPenumbraC           BlendMode = "penumbra c"
+	BlendPenumbraD           BlendMode = "penumbra d"
+
+	// Modulo
+	BlendModulo                   BlendMode = "modulo"
+	BlendModuloContinuous         BlendMode = "modulo_continuous"
+	BlendDivisiveModulo           BlendMode = "divisive_modulo"
+	BlendDivisiveModuloContinuous BlendMode = "divisive_modulo_continuous"
+	BlendModuloShift              BlendMode = "modulo_shift"
+	BlendModuloShiftContinuous    BlendMode = "modulo_shift_continuous"
+
+	// Quadratic
+	BlendReflect BlendMode = "reflect"
+	BlendGlow    BlendMode = "glow"
+	BlendFreeze  BlendMode = "freeze"
+	BlendHeat    BlendMode = "heat"
+	BlendGleat   BlendMode = "gleat"
+	BlendHelow   BlendMode = "helow"
+	BlendReeze   BlendMode = "reeze"
+	BlendFrect   BlendMode = "frect"
+	BlendFhyrd   BlendMode = "fhyrd"
+
+	// HSY components
+	BlendHue           BlendMode = "hue"
+	BlendSaturation    BlendMode = "saturation"
+	BlendColor         BlendMode = "color"
+	BlendLuminosity    BlendMode = "luminize"
+	BlendIncSaturation BlendMode = "inc_saturation"
+	BlendDecSaturation BlendMode = "dec_saturation"
+	BlendIncLuminosity BlendMode = "inc_luminosity"
+	BlendDecLuminosity BlendMode = "dec_luminosity"
+
+	// HSL, HSV and HSI components
+	BlendHueHSL        BlendMode = "hue_hsl"
+	BlendSaturationHSL BlendMode = "saturation_hsl"
+	BlendColorHSL      BlendMode = "color_hsl"
+	BlendLightness     BlendMode = "lightness"
+	BlendHueHSV        BlendMode = "hue_hsv"
+	BlendSaturationHSV BlendMode = "saturation_hsv"
+	BlendColorHSV      BlendMode = "color_hsv"
+	BlendValue         BlendMode = "value"
+	BlendHueHSI        BlendMode = "hue_hsi"
+	BlendSaturationHSI BlendMode = "saturation_hsi"
+	BlendColorHSI      BlendMode = "color_hsi"
+	BlendIntensity     BlendMode = "intensity"
+
+	// Binary
+	BlendAnd            BlendMode = "and"
+	BlendOr             BlendMode = "or"
+	BlendXor            BlendMode = "xor"
+	BlendNand           BlendMode = "nand"
+	BlendNor            BlendMode = "nor"
+	BlendXnor           BlendMode = "xnor"
+	BlendImplication    BlendMode = "implication"
+	BlendNotImplication BlendMode = "not_implication"
+	BlendConverse       BlendMode = "converse"
+	BlendNotConverse    BlendMode = "not_converse"
+
+	// Misc
+	BlendCopy      BlendMode = "copy"
+	BlendCopyRed   BlendMode = "copy_red"
+	BlendCopyGreen BlendMode = "copy_green"
+	BlendCopyBlue  BlendMode = "copy_blue"
+
+	// Ops for special content, such as normal and height maps.
+	BlendTangentNormalMap BlendMode = "tangent_normalmap"
+	BlendCombineNormal    BlendMode = "combine_normal"
+	BlendBumpmap          BlendMode = "bumpmap"
+	BlendLambertLighting  BlendMode = "lambert_lighting"
+	BlendLambertGamma22   BlendMode = "lambert_lighting_gamma2.2"
+	BlendColorize         BlendMode = "colorize"
+	BlendDisplace         BlendMode = "displace"
+	BlendIn               BlendMode = "in"
+	BlendOut              BlendMode = "out"
+	BlendDestinationIn    BlendMode = "destination-in"
+	BlendDestinationAtop  BlendMode = "destination-atop"
+	BlendClear            BlendMode = "clear"
+	BlendPlus             BlendMode = "plus"
+	BlendMinus            BlendMode = "minus"
+)
+
+var blendModes = map[BlendMode]bool{}
+
+func init() {
+	for _, m := range []BlendMode{
+		BlendNormal, BlendErase, BlendBehind, BlendDissolve, BlendAlphaDarken, BlendGreater,
+		BlendDarken, BlendMultiply, BlendColorBurn, BlendLinearBurn, BlendDarkerColor, BlendGammaDark,
+		BlendShadeIFSIllusions, BlendFogDarkenIFSIllusions, BlendEasyBurn,
+		BlendLighten, BlendScreen, BlendColorDodge, BlendLinearDodge, BlendAdd, BlendLighterColor, BlendGammaLight,
+		BlendGammaIllumination, BlendTintIFSIllusions, BlendFogLightenIFSIllusions, BlendEasyDodge, BlendLuminositySAI,
+		BlendOverlay, BlendHardOverlay, BlendSoftLight, BlendSoftLightSVG, BlendSoftLightPegtopDelphi, BlendSoftLightIFSIllusions,
+		BlendHardLight, BlendVividLight, BlendLinearLight, BlendPinLight, BlendFlatLight, BlendSuperLight,
+		BlendPNormA, BlendPNormB, BlendHardMix, BlendHardMixPhotoshop, BlendHardMixSofter,
+		BlendSubtract, BlendInverseSubtract, BlendDivide, BlendDifference, BlendExclusion, BlendNegation, BlendEquivalence,
+		BlendGrainMerge, BlendGrainExtract, BlendGeometricMean, BlendAllanon, BlendParallel, BlendArcTangent,
+		BlendAdditiveSubtractive, BlendInterpolation, BlendInterpolation2X,
+		BlendPenumbraA, BlendPenumbraB, BlendPenumbraC, BlendPenumbraD,
+		BlendModulo, BlendModuloContinuous, BlendDivisiveModulo, BlendDivisiveModuloContinuous,
+		BlendModuloShift, BlendModuloShiftContinuous,
+		BlendReflect, BlendGlow, BlendFreeze, BlendHeat, BlendGleat, BlendHelow, BlendReeze, BlendFrect, BlendFhyrd,
+		BlendHue, BlendSaturation, BlendColor, BlendLuminosity,
+		BlendIncSaturation, BlendDecSaturation, BlendIncLuminosity, BlendDecLuminosity,
+		BlendHueHSL, BlendSaturationHSL, BlendColorHSL, BlendLightness,
+		BlendHueHSV, BlendSaturationHSV, BlendColorHSV, BlendValue,
+		BlendHueHSI, BlendSaturationHSI, BlendColorHSI, BlendIntensity,
+		BlendAnd, BlendOr, BlendXor, BlendNand, BlendNor, BlendXnor,
+		BlendImplication, BlendNotImplication, BlendConverse, BlendNotConverse,
+		BlendCopy, BlendCopyRed, BlendCopyGreen, BlendCopyBlue,
+		BlendTangentNormalMap, BlendCombineNormal, BlendBumpmap, BlendLambertLighting, BlendLambertGamma22,
+		BlendColorize, BlendDisplace, BlendIn, BlendOut, BlendDestinationIn, BlendDestinationAtop,
+		BlendClear, BlendPlus, BlendMinus,
+	} {
+		blendModes[m] = true
+	}
+}
+
+// Valid reports whether m is a composite op id Krita knows.
+func (m BlendMode) Valid() bool {
+	return blendModes[m]
+}
@@ -0,0 +1,122 @@
+package layers
+
+import (
+	"image"
+	"strings"
+)
+
+// ColorSpace is a Krita color space id, written to maindoc.xml as the
+// colorspacename attribute. It fixes the color model, channel depth and
+// the layout of pixels in the layer's tile data.
+type ColorSpace string
+
+// Color spaces Krita documents and paint layers can use.
+const (
+	RGBA8   ColorSpace = "RGBA"     // 8-bit integer RGB with alpha
+	RGBA16  ColorSpace = "RGBA16"   // 16-bit integer RGB with alpha
+	RGBAF16 ColorSpace = "RGBAF16"  // 16-bit float (half) RGB with alpha
+	RGBAF32 ColorSpace = "RGBAF32"  // 32-bit float RGB with alpha
+	GrayA8  ColorSpace = "GRAYA"    // 8-bit grayscale with alpha
+	GrayA16 ColorSpace = "GRAYAU16" // 16-bit grayscale with alpha
+	CMYKA8  ColorSpace = "CMYK"     // 8-bit CMYK with alpha
+	CMYKA16 ColorSpace = "CMYKA16"  // 16-bit CMYK with alpha
+	LabA8   ColorSpace = "LABAU8"   // 8-bit CIE Lab with alpha
+	LabA16  ColorSpace = "LABA"     // 16-bit CIE Lab with alpha
+
+	// Alpha is the single 8-bit channel of selections and masks. Documents
+	// and paint layers cannot use it.
+	Alpha ColorSpace = "ALPHA"
+)
+
+// pixelSizes holds the bytes per pixel of each color space.
+var pixelSizes = map[ColorSpace]int{
+	RGBA8:   4,
+	RGBA16:  8,
+	RGBAF16: 8,
+	RGBAF32: 16,
+	GrayA8:  2,
+	GrayA16: 4,
+	CMYKA8:  5,
+	CMYKA16: 10,
+	LabA8:   4,
+	LabA16:  8,
+	Alpha:   1,
+}
+
+// Valid reports whether cs is a color space the package can write pixel
+// data in.
+func (cs ColorSpace) Valid() bool {
+	_, ok := pixelSizes[cs]
+	return ok
+}
+
+// PixelSize returns the number of bytes per pixel, or 0 for an unknown
+// color space.
+func (cs ColorSpace) PixelSize() int {
+	return pixelSizes[cs]
+}
+
+// Channels returns the number of channels of cs, alpha included, or 0 for
+// an unknown color space.
+func (cs ColorSpace) Channels() int {
+	switch {
+	case cs.IsRGB(), cs == LabA8, cs == LabA16:
+		return 4
+	case cs == GrayA8, cs == GrayA16:
+		return 2
+	case cs == CMYKA8, cs == CMYKA16:
+		return 5
+	case cs == Alpha:
+		return 1
+	}
+	return 0
+}
+
+// AllChannelFlags returns maindoc.xml channel flags setting every channel
+// of cs.
+func (cs ColorSpace) AllChannelFlags() string {
+	return strings.Repeat("1", cs.Channels())
+}
+
+// AlphaOffFlags returns maindoc.xml channel flags setting every channel of
+// cs but alpha, which Krita lists last in every color space.
+func (cs ColorSpace) AlphaOffFlags() string {
+	if cs.Channels() == 0 {
+		return ""
+	}
+	return strings.Repeat("1", cs.Channels()-1) + "0"
+}
+
+// IsAlphaOff reports whether maindoc.xml channel flags clear the alpha
+// channel of cs. Flags of the wrong length for cs are ignored, except when
+// cs is unknown.
+func (cs ColorSpace) IsAlphaOff(flags string) bool {
+	n := len(flags)
+	if n == 0 || (cs.Channels() != 0 && n != cs.Channels()) {
+		return false
+	}
+	return flags[n-1] == '0'
+}
+
+// IsRGB reports whether cs uses the RGB color model.
+func (cs ColorSpace) IsRGB() bool {
+	return cs == RGBA8 || cs == RGBA16 || cs == RGBAF16 || cs == RGBAF32
+}
+
+// ColorSpaceOf returns the color space that keeps the precision and model
+// of img's pixel type, or "" for 8-bit RGB images and other types.
+func ColorSpaceOf(img image.Image) ColorSpace {
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64:
+		return RGBA16
+	case *image.Gray:
+		return GrayA8
+	case *image.Gray16:
+		return GrayA16
+	case *image.CMYK:
+		return CMYKA8
+	case *FloatRGBA:
+		return RGBAF32
+	}
+	return ""
+}
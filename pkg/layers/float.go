@@ -0,0 +1,120 @@
+package layers
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// FloatColor is a linear-light sRGB color with straight alpha, the way the
+// float RGB color spaces store pixels. Channels above 1 hold high dynamic
+// range values; they are clipped only when the color is converted to
+// another model.
+type FloatColor struct {
+	R, G, B, A float32
+}
+
+// RGBA returns the sRGB-encoded, alpha-premultiplied color, clipped to
+// [0, 1].
+func (c FloatColor) RGBA() (r, g, b, a uint32) {
+	alpha := clampUnit(float64(c.A))
+	ch := func(v float32) uint32 {
+		return uint32(math.Round(clampUnit(LinearToSRGB(float64(v))) * alpha * 0xffff))
+	}
+	return ch(c.R), ch(c.G), ch(c.B), uint32(math.Round(alpha * 0xffff))
+}
+
+// FloatModel converts colors to FloatColor.
+var FloatModel = color.ModelFunc(floatModel)
+
+func floatModel(c color.Color) color.Color {
+	if _, ok := c.(FloatColor); ok {
+		return c
+	}
+	n := color.NRGBA64Model.Convert(c).(color.NRGBA64)
+	ch := func(v uint16) float32 { return float32(SRGBToLinear(float64(v) / 0xffff)) }
+	return FloatColor{ch(n.R), ch(n.G), ch(n.B), float32(n.A) / 0xffff}
+}
+
+// FloatRGBA is an in-memory image of FloatColor pixels. Use it as a paint
+// layer's Image, or return it from a TileSource's Region, to keep values
+// above 1 when saving in RGBAF16 or RGBAF32; ColorSpaceOf picks RGBAF32
+// for it.
+type FloatRGBA struct {
+	// Pix holds the pixels' R, G, B and A channels in that order. The
+	// pixel at (x, y) starts at Pix[(y-Rect.Min.Y)*Stride + (x-Rect.Min.X)*4].
+	Pix []float32
+	// Stride is the Pix stride in floats between vertically adjacent
+	// pixels.
+	Stride int
+	Rect   image.Rectangle
+}
+
+// NewFloatRGBA returns a new FloatRGBA image with the given bounds.
+func NewFloatRGBA(r image.Rectangle) *FloatRGBA {
+	return &FloatRGBA{
+		Pix:    make([]float32, 4*r.Dx()*r.Dy()),
+		Stride: 4 * r.Dx(),
+		Rect:   r,
+	}
+}
+
+func (p *FloatRGBA) ColorModel() color.Model { return FloatModel }
+
+func (p *FloatRGBA) Bounds() image.Rectangle { return p.Rect }
+
+func (p *FloatRGBA) At(x, y int) color.Color { return p.FloatAt(x, y) }
+
+// FloatAt returns the pixel at (x, y), or a transparent color outside the
+// image.
+func (p *FloatRGBA) FloatAt(x, y int) FloatColor {
+	if !image.Pt(x, y).In(p.Rect) {
+		return FloatColor{}
+	}
+	s := p.Pix[p.PixOffset(x, y):]
+	return FloatColor{s[0], s[1], s[2], s[3]}
+}
+
+// PixOffset returns the index of the first element of Pix that corresponds
+// to the pixel at (x, y).
+func (p *FloatRGBA) PixOffset(x, y int) int {
+	return (y-p.Rect.Min.Y)*p.Stride + (x-p.Rect.Min.X)*4
+}
+
+func (p *FloatRGBA) Set(x, y int, c color.Color) {
+	p.SetFloat(x, y, FloatModel.Convert(c).(FloatColor))
+}
+
+// SetFloat sets the pixel at (x, y); points outside the image are ignored.
+func (p *FloatRGBA) SetFloat(x, y int, c FloatColor) {
+	if !image.Pt(x, y).In(p.Rect) {
+		return
+	}
+	s := p.Pix[p.PixOffset(x, y):]
+	s[0], s[1], s[2], s[3] = c.R, c.G, c.B, c.A
+}
+
+// SRGBToLinear applies the inverse sRGB transfer function to a channel
+// value.
+func SRGBToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// LinearToSRGB applies the sRGB transfer function to a linear-light
+// channel value.
+func LinearToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+func clampUnit(v float64) float64 {
+	if math.IsNaN(v) {
+		return 0
+	}
+	return math.Max(0, math.Min(1, v))
+}
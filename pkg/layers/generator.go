@@ -0,0 +1,335 @@
+package layers
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// GeneratorLayer is a fill layer whose pixels Krita renders from a
+// generator configuration, so the fill stays editable. Generator uses the
+// same format as filter configurations, with Name holding the generator
+// id. Preview is this package's rendering of the generator, in layer
+// coordinates; it provides the layer's pixels in the merged image and the
+// pixels cached in the archive, which Krita regenerates on load. It may be
+// unbounded, like an image.Uniform, in which case only the part on the
+// canvas is stored. A nil Preview leaves the layer out of the merged image.
+type GeneratorLayer struct {
+	BaseLayer
+	Generator FilterConfig
+	Preview   image.Image
+	X, Y      int
+}
+
+// NewGeneratorLayer creates a visible, opaque generator layer.
+func NewGeneratorLayer(generator FilterConfig, preview image.Image, name string) *GeneratorLayer {
+	return &GeneratorLayer{
+		BaseLayer: BaseLayer{
+			Name:    name,
+			Visible: true,
+			Opacity: Opaque,
+			UUID:    "{" + uuid.New().String() + "}",
+		},
+		Generator: generator,
+		Preview:   preview,
+	}
+}
+
+// Offset returns the generator layer's position.
+func (l *GeneratorLayer) Offset() (x, y int) { return l.X, l.Y }
+
+func (l *GeneratorLayer) NodeType() string { return "generatorlayer" }
+
+func (l *GeneratorLayer) MainDocAttributes() map[string]string {
+	attrs := l.BaseAttributes()
+	attrs["generatorname"] = l.Generator.Name
+	attrs["generatorversion"] = strconv.Itoa(l.Generator.Version)
+	attrs["x"] = fmt.Sprintf("%v", l.X)
+	attrs["y"] = fmt.Sprintf("%v", l.Y)
+	return attrs
+}
+
+// WriteToArchive writes the generator configuration, the selection the
+// fill covers and the rendered preview.
+func (l *GeneratorLayer) WriteToArchive(w ArchiveWriter, filename string) error {
+	if err := writeFilterFiles(w, filename, l.Generator); err != nil {
+		return err
+	}
+	preview := image.Image(image.NewNRGBA(image.Rectangle{}))
+	if l.Preview != nil {
+		width, height := w.CanvasSize()
+		canvas := image.Rect(0, 0, width, height).Sub(image.Pt(l.X, l.Y))
+		preview = boundedImage{l.Preview, canvas.Intersect(l.Preview.Bounds())}
+	}
+	return w.WritePaintDevice(filename, ImageSource{preview}, "", nil, nil)
+}
+
+// boundedImage is an image cut down to r, which lies within its bounds.
+type boundedImage struct {
+	image.Image
+	r image.Rectangle
+}
+
+func (b boundedImage) Bounds() image.Rectangle { return b.r }
+
+// everywhere is the bounds of generator previews that fill the plane, as
+// used by image.Uniform.
+var everywhere = image.Rect(-1e9, -1e9, 1e9, 1e9)
+
+// NewColorFillLayer creates a layer filled with c by Krita's "color"
+// generator.
+func NewColorFillLayer(c color.Color, name string) *GeneratorLayer {
+	generator := FilterConfig{Name: "color", Version: 1, Params: map[string]string{
+		"color": colorXML(c),
+	}}
+	return NewGeneratorLayer(generator, image.NewUniform(c), name)
+}
+
+// NewPatternFillLayer creates a layer tiled with a pattern by Krita's
+// "pattern" generator. Krita looks the pattern up among its resources by
+// patternName and fileName, so it must be installed there; pattern is used
+// for the preview.
+func NewPatternFillLayer(pattern image.Image, patternName, fileName, name string) *GeneratorLayer {
+	generator := FilterConfig{Name: "pattern", Version: 1, Params: map[string]string{
+		"pattern":              patternName,
+		"fileName":             fileName,
+		"transform_shear_x":    "0",
+		"transform_shear_y":    "0",
+		"transform_scale_x":    "1",
+		"transform_scale_y":    "1",
+		"transform_rotation_x": "0",
+		"transform_rotation_y": "0",
+		"transform_rotation_z": "0",
+		"transform_offset_x":   "0",
+		"transform_offset_y":   "0",
+	}}
+	var preview image.Image
+	if pattern != nil && !pattern.Bounds().Empty() {
+		preview = tiledImage{pattern}
+	}
+	return NewGeneratorLayer(generator, preview, name)
+}
+
+// tiledImage repeats an image across the plane.
+type tiledImage struct {
+	tile image.Image
+}
+
+func (t tiledImage) ColorModel() color.Model { return t.tile.ColorModel() }
+
+func (t tiledImage) Bounds() image.Rectangle { return everywhere }
+
+func (t tiledImage) At(x, y int) color.Color {
+	b := t.tile.Bounds()
+	return t.tile.At(b.Min.X+mod(x, b.Dx()), b.Min.Y+mod(y, b.Dy()))
+}
+
+// GradientShape is the shape of a gradient fill.
+type GradientShape string
+
+// Gradient shapes, named as Krita's gradient generator names them.
+const (
+	GradientLinear GradientShape = "linear"
+	GradientRadial GradientShape = "radial"
+)
+
+// GradientStop is a color at an offset along a gradient, from 0 to 1.
+type GradientStop struct {
+	Offset float64
+	Color  color.Color
+}
+
+// NewGradientFillLayer creates a layer filled by Krita's "gradient"
+// generator. A linear gradient runs from start to end; a radial one is
+// centered on start and reaches its last stop at end. Stops must be sorted
+// by offset. Beyond the ends the end colors extend.
+func NewGradientFillLayer(shape GradientShape, start, end image.Point, stops []GradientStop, name string) *GeneratorLayer {
+	var b strings.Builder
+	b.WriteString(`<!DOCTYPE gradient><gradient type="stop">`)
+	for _, s := range stops {
+		_, _, _, a := color.NRGBAModel.Convert(s.Color).RGBA()
+		fmt.Fprintf(&b, `<stop offset="%s" alpha="%s" type="color-stop">%s</stop>`,
+			formatFloat(s.Offset), formatFloat(float64(a)/0xffff), rgbElement(s.Color))
+	}
+	b.WriteString("</gradient>")
+	generator := FilterConfig{Name: "gradient", Version: 1, Params: map[string]string{
+		"shape":                          string(shape),
+		"repeat":                         "none",
+		"antialias_threshold":            "0",
+		"reverse":                        "false",
+		"dither":                         "false",
+		"start_position_x":               strconv.Itoa(start.X),
+		"start_position_y":               strconv.Itoa(start.Y),
+		"start_position_x_units":         "pixels",
+		"start_position_y_units":         "pixels",
+		"end_position_coordinate_system": "cartesian",
+		"end_position_x":                 strconv.Itoa(end.X),
+		"end_position_y":                 strconv.Itoa(end.Y),
+		"end_position_x_units":           "pixels",
+		"end_position_y_units":           "pixels",
+		"gradient":                       b.String(),
+	}}
+	preview := &gradientImage{shape: shape, start: start, end: end, stops: stops}
+	return NewGeneratorLayer(generator, preview, name)
+}
+
+// gradientImage renders a gradient fill across the plane.
+type gradientImage struct {
+	shape      GradientShape
+	start, end image.Point
+	stops      []GradientStop
+}
+
+func (g *gradientImage) ColorModel() color.Model { return color.NRGBAModel }
+
+func (g *gradientImage) Bounds() image.Rectangle { return everywhere }
+
+func (g *gradientImage) At(x, y int) color.Color {
+	if len(g.stops) == 0 {
+		return color.NRGBA{}
+	}
+	// Sample pixel centers.
+	px, py := float64(x)+0.5-float64(g.start.X), float64(y)+0.5-float64(g.start.Y)
+	dx, dy := float64(g.end.X-g.start.X), float64(g.end.Y-g.start.Y)
+	var t float64
+	if length := dx*dx + dy*dy; length > 0 {
+		if g.shape == GradientRadial {
+			t = math.Sqrt((px*px + py*py) / length)
+		} else {
+			t = (px*dx + py*dy) / length
+		}
+	}
+	first, last := g.stops[0], g.stops[len(g.stops)-1]
+	if t <= first.Offset {
+		return color.NRGBAModel.Convert(first.Color)
+	}
+	for i := 1; i < len(g.stops); i++ {
+		a, b := g.stops[i-1], g.stops[i]
+		if t > b.Offset {
+			continue
+		}
+		f := 0.0
+		if b.Offset > a.Offset {
+			f = (t - a.Offset) / (b.Offset - a.Offset)
+		}
+		return mixNRGBA(a.Color, b.Color, f)
+	}
+	return color.NRGBAModel.Convert(last.Color)
+}
+
+// NewScreentoneLayer creates a layer filled by Krita's "screentone"
+// generator with round dots of fg on bg, one per cell of cellSize pixels,
+// rotated by rotation degrees and covering half of each cell.
+func NewScreentoneLayer(fg, bg color.Color, cellSize, rotation float64, name string) *GeneratorLayer {
+	size := formatFloat(cellSize)
+	generator := FilterConfig{Name: "screentone", Version: 1, Params: map[string]string{
+		"pattern":            "0", // dots
+		"shape":              "0", // round
+		"interpolation":      "0", // linear
+		"foreground_color":   colorXML(fg),
+		"background_color":   colorXML(bg),
+		"foreground_opacity": "100",
+		"background_opacity": "100",
+		"invert":             "false",
+		"brightness":         "50",
+		"contrast":           "95",
+		"size_x":             size,
+		"size_y":             size,
+		"keep_size_square":   "true",
+		"position_x":         "0",
+		"position_y":         "0",
+		"shear_x":            "0",
+		"shear_y":            "0",
+		"rotation":           formatFloat(rotation),
+	}}
+	var preview image.Image
+	if cellSize > 0 {
+		preview = &screentoneImage{fg: fg, bg: bg, size: cellSize, rotation: rotation * math.Pi / 180}
+	}
+	return NewGeneratorLayer(generator, preview, name)
+}
+
+// screentoneImage renders round halftone dots at 50% coverage.
+type screentoneImage struct {
+	fg, bg   color.Color
+	size     float64
+	rotation float64 // radians
+}
+
+func (s *screentoneImage) ColorModel() color.Model { return color.NRGBAModel }
+
+func (s *screentoneImage) Bounds() image.Rectangle { return everywhere }
+
+func (s *screentoneImage) At(x, y int) color.Color {
+	sin, cos := math.Sincos(-s.rotation)
+	px, py := float64(x)+0.5, float64(y)+0.5
+	u := (px*cos - py*sin) / s.size
+	v := (px*sin + py*cos) / s.size
+	u -= math.Floor(u) + 0.5
+	v -= math.Floor(v) + 0.5
+	// A dot of radius r covers half the unit cell when pi*r*r = 0.5.
+	if u*u+v*v <= 0.5/math.Pi {
+		return color.NRGBAModel.Convert(s.fg)
+	}
+	return color.NRGBAModel.Convert(s.bg)
+}
+
+// NewMultigridLayer creates a layer filled by Krita's "multigrid"
+// generator, a quasiperiodic tiling of rhombi drawn from dimensions sets
+// of grid lines with divisions lines each, outlined in line on bg. The
+// tiling is not rendered here: the preview is a plain bg fill until Krita
+// regenerates the layer.
+func NewMultigridLayer(dimensions, divisions int, lineWidth float64, line, bg color.Color, name string) *GeneratorLayer {
+	generator := FilterConfig{Name: "multigrid", Version: 1, Params: map[string]string{
+		"dimensions":     strconv.Itoa(dimensions),
+		"divisions":      strconv.Itoa(divisions),
+		"offset":         "0.2",
+		"lineWidth":      formatFloat(lineWidth),
+		"lineColor":      colorXML(line),
+		"bgColor":        colorXML(bg),
+		"colorRatio":     "1",
+		"connectorType":  "0",
+		"connectorRatio": "0.5",
+	}}
+	return NewGeneratorLayer(generator, image.NewUniform(bg), name)
+}
+
+// colorProfileName is the profile colors in generator configurations are
+// given in.
+const colorProfileName = "sRGB-elle-V2-srgbtrc.icc"
+
+// colorXML returns c in the XML form Krita stores colors in properties.
+func colorXML(c color.Color) string {
+	return `<!DOCTYPE color><color channeldepth="U8">` + rgbElement(c) + "</color>"
+}
+
+// rgbElement returns the <RGB> element describing c's color channels.
+func rgbElement(c color.Color) string {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	return fmt.Sprintf(`<RGB r="%s" g="%s" b="%s" space="%s"/>`,
+		formatFloat(float64(n.R)/255), formatFloat(float64(n.G)/255), formatFloat(float64(n.B)/255), colorProfileName)
+}
+
+// mixNRGBA interpolates from a to b by f in straight alpha.
+func mixNRGBA(a, b color.Color, f float64) color.NRGBA {
+	na := color.NRGBAModel.Convert(a).(color.NRGBA)
+	nb := color.NRGBAModel.Convert(b).(color.NRGBA)
+	lerp := func(x, y uint8) uint8 {
+		return uint8(math.Round(float64(x) + (float64(y)-float64(x))*f))
+	}
+	return color.NRGBA{lerp(na.R, nb.R), lerp(na.G, nb.G), lerp(na.B, nb.B), lerp(na.A, nb.A)}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// mod returns x modulo n, in [0, n).
+func mod(x, n int) int {
+	return (x%n + n) % n
+}
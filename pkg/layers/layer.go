@@ -0,0 +1,283 @@
+package layers
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+)
+
+// Layer is implemented by every kind of layer a document can hold. Custom
+// layer kinds usually embed BaseLayer and add the node-specific methods.
+type Layer interface {
+	GetName() string
+	GetUUID() string
+	IsVisible() bool
+	GetOpacity() Opacity
+	GetBlendMode() BlendMode
+	GetColorLabel() ColorLabel
+	// Offset returns the layer's position on the canvas in pixels.
+	Offset() (x, y int)
+	// NodeType returns the maindoc.xml nodetype, e.g. "paintlayer".
+	NodeType() string
+	// MainDocAttributes returns the attributes of the layer's maindoc.xml
+	// element. The document adds filename, uuid and nodetype.
+	MainDocAttributes() map[string]string
+	// WriteToArchive writes the layer's data files, named after filename.
+	WriteToArchive(w ArchiveWriter, filename string) error
+	// GetMasks returns the masks attached to the layer.
+	GetMasks() []Mask
+}
+
+// Container is implemented by layers that hold child layers.
+type Container interface {
+	Layer
+	ChildLayers() []Layer
+}
+
+// ChannelFlagger is implemented by layers that write channel flags, which
+// depend on the number of channels of the layer's color space. BaseLayer
+// implements it.
+type ChannelFlagger interface {
+	// ChannelFlagAttributes returns the maindoc.xml channel flag
+	// attributes for a layer whose pixels are in color space cs.
+	ChannelFlagAttributes(cs ColorSpace) map[string]string
+}
+
+// StyledLayer is implemented by layers that can carry a layer style.
+type StyledLayer interface {
+	Layer
+	// GetLayerStyle returns the layer's style, or nil.
+	GetLayerStyle() *LayerStyle
+	// GetLayerStyleUUID returns the UUID maindoc.xml refers to the style
+	// by.
+	GetLayerStyleUUID() string
+}
+
+// ArchiveWriter is the part of a .kra archive a layer writes its data into.
+type ArchiveWriter interface {
+	// WriteFile stores data at name inside the document's layers directory.
+	WriteFile(name string, data []byte) error
+	// WritePaintDevice stores the pixels of src as Krita tiled pixel data
+	// in color space cs named name, together with its .defaultpixel and
+	// .icc files. An empty cs means the document's color space, a nil
+	// defaultPixel transparent and a nil profile the default profile for
+	// cs.
+	WritePaintDevice(name string, src TileSource, cs ColorSpace, defaultPixel color.Color, profile []byte) error
+	// CanvasSize returns the document size in pixels.
+	CanvasSize() (width, height int)
+	// Resolution returns the document resolution in pixels per inch.
+	Resolution() float64
+	// KritaVersion returns the Krita release the document targets.
+	KritaVersion() string
+}
+
+// BaseLayer holds the properties shared by all layer kinds and is embedded
+// in each of them.
+type BaseLayer struct {
+	Name       string
+	Visible    bool
+	Locked     bool
+	Opacity    Opacity
+	BlendMode  BlendMode // empty means BlendNormal
+	ColorLabel ColorLabel
+	// InheritAlpha clips the layer to the alpha of the layers below it.
+	InheritAlpha bool
+	Collapsed    bool // children folded in the layers docker
+	InTimeline   bool // pinned to the animation timeline
+	UUID         string
+	// Masks are attached to the layer, applied in order.
+	Masks []Mask
+}
+
+// Opacity is a layer's opacity, from 0 (transparent) to 1 (opaque).
+type Opacity float64
+
+// Opaque is full opacity.
+const Opaque Opacity = 1
+
+// OpacityFromKrita converts Krita's 0-255 opacity.
+func OpacityFromKrita(v int) Opacity {
+	return Opacity(v) / 255
+}
+
+// Krita returns the opacity on Krita's 0-255 scale.
+func (o Opacity) Krita() int {
+	return int(math.Round(float64(o) * 255))
+}
+
+// Valid reports whether o lies in [0, 1].
+func (o Opacity) Valid() bool {
+	return o >= 0 && o <= 1
+}
+
+// ColorLabel is one of Krita's layer color labels.
+type ColorLabel int
+
+// Krita's color label palette.
+const (
+	LabelNone ColorLabel = iota
+	LabelBlue
+	LabelGreen
+	LabelYellow
+	LabelOrange
+	LabelBrown
+	LabelRed
+	LabelPurple
+	LabelGray
+)
+
+// Valid reports whether c is in Krita's palette.
+func (c ColorLabel) Valid() bool {
+	return c >= LabelNone && c <= LabelGray
+}
+
+func (b *BaseLayer) GetName() string { return b.Name }
+
+func (b *BaseLayer) GetUUID() string { return b.UUID }
+
+func (b *BaseLayer) IsVisible() bool { return b.Visible }
+
+func (b *BaseLayer) GetOpacity() Opacity { return b.Opacity }
+
+func (b *BaseLayer) GetBlendMode() BlendMode {
+	if b.BlendMode == "" {
+		return BlendNormal
+	}
+	return b.BlendMode
+}
+
+func (b *BaseLayer) GetColorLabel() ColorLabel { return b.ColorLabel }
+
+func (b *BaseLayer) GetMasks() []Mask { return b.Masks }
+
+// BaseAttributes returns the maindoc.xml attributes common to all layers.
+func (b *BaseLayer) BaseAttributes() map[string]string {
+	return map[string]string{
+		"name":        b.Name,
+		"visible":     boolAttr(b.Visible),
+		"locked":      boolAttr(b.Locked),
+		"opacity":     fmt.Sprintf("%v", b.Opacity.Krita()),
+		"compositeop": string(b.GetBlendMode()),
+		"colorlabel":  fmt.Sprintf("%v", int(b.ColorLabel)),
+		"collapsed":   boolAttr(b.Collapsed),
+		"intimeline":  boolAttr(b.InTimeline),
+	}
+}
+
+// ChannelFlagAttributes returns the channel flag attributes of a layer
+// whose pixels are in color space cs, which sets the number of flags.
+func (b *BaseLayer) ChannelFlagAttributes(cs ColorSpace) map[string]string {
+	// Krita stores inherit alpha as a disabled alpha channel; an empty
+	// value means every channel is enabled.
+	flags := ""
+	if b.InheritAlpha {
+		flags = cs.AlphaOffFlags()
+	}
+	return map[string]string{"channelflags": flags}
+}
+
+// boolAttr formats a flag the way maindoc.xml stores it.
+func boolAttr(v bool) string {
+	if v {
+		return "1"
+	}
+	return "0"
+}
+
+// Offset returns the paint layer's position.
+func (l *PaintLayer) Offset() (x, y int) { return l.X, l.Y }
+
+func (l *PaintLayer) NodeType() string { return "paintlayer" }
+
+func (l *PaintLayer) MainDocAttributes() map[string]string {
+	attrs := l.BaseAttributes()
+	attrs["x"] = fmt.Sprintf("%v", l.X)
+	attrs["y"] = fmt.Sprintf("%v", l.Y)
+	if l.ColorSpace != "" {
+		attrs["colorspacename"] = string(l.ColorSpace)
+	}
+	if l.LayerStyle != nil {
+		attrs["layerstyle"] = "{" + l.LayerStyleUUID + "}"
+	}
+	return attrs
+}
+
+// ChannelFlagAttributes adds the channel lock flags, which lock alpha
+// when AlphaLocked is set, to the BaseLayer flags.
+func (l *PaintLayer) ChannelFlagAttributes(cs ColorSpace) map[string]string {
+	attrs := l.BaseLayer.ChannelFlagAttributes(cs)
+	attrs["channellockflags"] = cs.AllChannelFlags()
+	if l.AlphaLocked {
+		attrs["channellockflags"] = cs.AlphaOffFlags()
+	}
+	return attrs
+}
+
+func (l *PaintLayer) GetLayerStyle() *LayerStyle { return l.LayerStyle }
+
+func (l *PaintLayer) GetLayerStyleUUID() string { return l.LayerStyleUUID }
+
+// WriteToArchive writes the layer's pixels as a tiled paint device.
+func (l *PaintLayer) WriteToArchive(w ArchiveWriter, filename string) error {
+	src := l.Source
+	if src == nil {
+		if l.Image == nil {
+			return fmt.Errorf("paint layer %q has no image", l.Name)
+		}
+		src = ImageSource{l.Image}
+	}
+	return w.WritePaintDevice(filename, src, l.ColorSpace, l.DefaultPixel, l.ICCProfile)
+}
+
+// Offset returns the shape layer's position.
+func (l *ShapeLayer) Offset() (x, y int) { return l.X, l.Y }
+
+func (l *ShapeLayer) NodeType() string { return "shapelayer" }
+
+func (l *ShapeLayer) MainDocAttributes() map[string]string {
+	attrs := l.BaseAttributes()
+	attrs["x"] = fmt.Sprintf("%v", l.X)
+	attrs["y"] = fmt.Sprintf("%v", l.Y)
+	if l.LayerStyle != nil {
+		attrs["layerstyle"] = "{" + l.LayerStyleUUID + "}"
+	}
+	return attrs
+}
+
+func (l *ShapeLayer) GetLayerStyle() *LayerStyle { return l.LayerStyle }
+
+func (l *ShapeLayer) GetLayerStyleUUID() string { return l.LayerStyleUUID }
+
+// WriteToArchive writes the layer's content.svg.
+func (l *ShapeLayer) WriteToArchive(w ArchiveWriter, filename string) error {
+	width, height := w.CanvasSize()
+	svg, err := l.SVGContent(width, height, w.Resolution(), w.KritaVersion())
+	if err != nil {
+		return err
+	}
+	return w.WriteFile(filename+".shapelayer/content.svg", []byte(svg))
+}
+
+// Offset returns the group's position.
+func (g *GroupLayer) Offset() (x, y int) { return g.X, g.Y }
+
+func (g *GroupLayer) NodeType() string { return "grouplayer" }
+
+func (g *GroupLayer) MainDocAttributes() map[string]string {
+	attrs := g.BaseAttributes()
+	attrs["x"] = fmt.Sprintf("%v", g.X)
+	attrs["y"] = fmt.Sprintf("%v", g.Y)
+	attrs["passthrough"] = boolAttr(g.Passthrough)
+	return attrs
+}
+
+// WriteToArchive writes nothing; a group's children are written by the
+// document.
+func (g *GroupLayer) WriteToArchive(w ArchiveWriter, filename string) error {
+	return nil
+}
+
+// ChildLayers returns the group's children in stack order.
+func (g *GroupLayer) ChildLayers() []Layer {
+	return g.Layers
+}
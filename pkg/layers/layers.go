@@ -1,20 +1,25 @@
 package layers
 
 import (
-	"github.com/google/uuid"
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+
 	"github.com/cozy-creator/kritago/pkg/shapes"
+	"github.com/google/uuid"
 )
 
 // TextStyle holds text styling options.
 type TextStyle struct {
 	FontFamily       string
-	FontSize         int
+	FontSize         float64
 	FillColor        string
 	StrokeColor      string
-	StrokeWidth      int
+	StrokeWidth      float64
 	StrokeOpacity    float64
-	LetterSpacing    int
-	WordSpacing      int
+	LetterSpacing    float64
+	WordSpacing      float64
 	TextAlign        string
 	TextAlignLast    string
 	LineHeight       float64
@@ -51,11 +56,120 @@ func NewTextStyle() *TextStyle {
 	}
 }
 
-// TextSpan represents a span of text.
+// SVGAttributes returns the style as attributes of a Krita <text> element.
+// Font properties go into the style attribute, as Krita writes them.
+func (ts *TextStyle) SVGAttributes() map[string]string {
+	return map[string]string{
+		"fill":              ts.FillColor,
+		"stroke":            ts.StrokeColor,
+		"stroke-width":      fmt.Sprintf("%v", ts.StrokeWidth),
+		"stroke-opacity":    fmt.Sprintf("%v", ts.StrokeOpacity),
+		"stroke-linecap":    ts.StrokeLinecap,
+		"stroke-linejoin":   ts.StrokeLinejoin,
+		"letter-spacing":    fmt.Sprintf("%v", ts.LetterSpacing),
+		"word-spacing":      fmt.Sprintf("%v", ts.WordSpacing),
+		"paint-order":       ts.PaintOrder,
+		"text-rendering":    ts.TextRendering,
+		"dominant-baseline": ts.DominantBaseline,
+		"text-anchor":       ts.TextAnchor,
+		"style": fmt.Sprintf("text-align: %s;text-align-last: %s;font-family: %s;font-size: %v;line-height: %v;",
+			ts.TextAlign, ts.TextAlignLast, ts.FontFamily, ts.FontSize, ts.LineHeight),
+	}
+}
+
+// SpanStyle holds per-span formatting for rich text. Zero values inherit
+// from the enclosing span or the layer's TextStyle.
+type SpanStyle struct {
+	FontFamily     string
+	FontWeight     string  // e.g. "bold" or "700"
+	FontStyle      string  // e.g. "italic"
+	FontSize       float64 // in points
+	FillColor      string
+	StrokeColor    string
+	StrokeWidth    float64
+	BaselineShift  string // "super", "sub" or a length
+	TextDecoration string // e.g. "underline" or "line-through"
+}
+
+// SVGAttributes returns the span formatting as <tspan> attributes.
+func (ss *SpanStyle) SVGAttributes() map[string]string {
+	attrs := map[string]string{}
+	if ss.FillColor != "" {
+		attrs["fill"] = ss.FillColor
+	}
+	if ss.StrokeColor != "" {
+		attrs["stroke"] = ss.StrokeColor
+	}
+	if ss.StrokeWidth != 0 {
+		attrs["stroke-width"] = fmt.Sprintf("%v", ss.StrokeWidth)
+	}
+	if ss.BaselineShift != "" {
+		attrs["baseline-shift"] = ss.BaselineShift
+	}
+	if ss.TextDecoration != "" {
+		attrs["text-decoration"] = ss.TextDecoration
+	}
+	style := ""
+	if ss.FontFamily != "" {
+		style += "font-family: " + ss.FontFamily + ";"
+	}
+	if ss.FontWeight != "" {
+		style += "font-weight: " + ss.FontWeight + ";"
+	}
+	if ss.FontStyle != "" {
+		style += "font-style: " + ss.FontStyle + ";"
+	}
+	if ss.FontSize != 0 {
+		style += fmt.Sprintf("font-size: %v;", ss.FontSize)
+	}
+	if style != "" {
+		attrs["style"] = style
+	}
+	return attrs
+}
+
+// TextSpan represents a span of text. Top-level spans are lines positioned
+// by X and Dy; Runs nest inside a span and carry their own formatting.
 type TextSpan struct {
-	Text string
-	X    float64
-	Dy   *float64 // optional vertical offset
+	Text  string
+	X     float64
+	Dy    *float64   // optional vertical offset
+	Style *SpanStyle // optional rich text formatting
+	Runs  []TextSpan // rich text runs following Text
+}
+
+// Run returns a rich text run with the given formatting.
+func Run(text string, style *SpanStyle) TextSpan {
+	return TextSpan{Text: text, Style: style}
+}
+
+// PlainText returns the span's text including that of its runs.
+func (s TextSpan) PlainText() string {
+	text := s.Text
+	for _, run := range s.Runs {
+		text += run.PlainText()
+	}
+	return text
+}
+
+// ToSVGElement returns the span as a <tspan> element with its runs nested
+// inside it.
+func (s TextSpan) ToSVGElement() *shapes.SVGNode {
+	attrs := map[string]string{}
+	if s.Style != nil {
+		attrs = s.Style.SVGAttributes()
+	}
+	if s.X != 0 || s.Dy != nil {
+		attrs["x"] = fmt.Sprintf("%v", s.X)
+	}
+	if s.Dy != nil {
+		attrs["dy"] = fmt.Sprintf("%v", *s.Dy)
+	}
+	node := &shapes.SVGNode{Tag: "tspan", Attrs: attrs, Text: s.Text, Inline: true}
+	for _, run := range s.Runs {
+		node.Children = append(node.Children, run.ToSVGElement())
+	}
+	return node
 }
 
 // LayerStyle represents a Krita layer style.
@@ -90,75 +204,171 @@ func NewLayerStyle() *LayerStyle {
 type ShapeLayer struct {
 	// For text layers, Content holds []TextSpan.
 	// For shape layers, Content holds []shapes.Shape.
-	Content        interface{}
-	ContentType    string // "text" or "shape"
-	Name           string
-	Visible        bool
-	Opacity        int
-	X, Y           float64
+	Content     interface{}
+	ContentType string // "text" or "shape"
+	BaseLayer
+	X, Y int
 	// For text layers, Style is *TextStyle; for shape layers, it can be *shapes.ShapeStyle.
 	Style          interface{}
 	LayerStyle     *LayerStyle
-	UUID           string
 	LayerStyleUUID string
+	// RawSVG holds the content.svg a layer was read from when it has
+	// content Content cannot represent, such as text next to other shapes,
+	// images or gradients. It is written back unchanged in place of
+	// Content; set it to nil to write Content instead.
+	RawSVG []byte
 }
 
 // FromText creates a ShapeLayer from plain text.
-func FromText(text, name string, x, y float64, opacity int, style *TextStyle) *ShapeLayer {
+func FromText(text, name string, x, y int, opacity Opacity, style *TextStyle) *ShapeLayer {
+	if style == nil {
+		style = NewTextStyle()
+	}
 	lines := splitLines(text)
 	var spans []TextSpan
 	for i, line := range lines {
 		var dy *float64
 		if i > 0 {
-			val := float64(style.FontSize) * style.LineHeight
+			val := style.FontSize * style.LineHeight
 			dy = &val
 		}
 		spans = append(spans, TextSpan{Text: line, X: 0, Dy: dy})
 	}
 	return &ShapeLayer{
-		Content:        spans,
-		ContentType:    "text",
-		Name:           name,
-		Visible:        true,
-		Opacity:        opacity,
+		Content:     spans,
+		ContentType: "text",
+		BaseLayer: BaseLayer{
+			Name:    name,
+			Visible: true,
+			Opacity: opacity,
+			UUID:    "{" + uuid.New().String() + "}",
+		},
 		X:              x,
 		Y:              y,
 		Style:          style,
 		LayerStyle:     nil,
-		UUID:           "{" + uuid.New().String() + "}",
 		LayerStyleUUID: uuid.New().String(),
 	}
 }
 
+// FromRichText creates a text ShapeLayer with one line per entry of lines,
+// each made of formatted runs. Line spacing follows the largest font size
+// in each line. The layer gets a copy of style with UseRichText enabled.
+func FromRichText(lines [][]TextSpan, name string, x, y int, opacity Opacity, style *TextStyle) *ShapeLayer {
+	if style == nil {
+		style = NewTextStyle()
+	}
+	richStyle := *style
+	richStyle.UseRichText = true
+	var spans []TextSpan
+	for i, runs := range lines {
+		line := TextSpan{X: 0, Runs: runs}
+		if i > 0 {
+			size := style.FontSize
+			for _, run := range runs {
+				if run.Style != nil && run.Style.FontSize > size {
+					size = run.Style.FontSize
+				}
+			}
+			val := size * style.LineHeight
+			line.Dy = &val
+		}
+		spans = append(spans, line)
+	}
+	layer := FromText("", name, x, y, opacity, &richStyle)
+	layer.Content = spans
+	return layer
+}
+
 // FromShapes creates a ShapeLayer from a slice of shapes.
-func FromShapes(shapesArr []shapes.Shape, name string, x, y float64, opacity int, style *shapes.ShapeStyle) *ShapeLayer {
+func FromShapes(shapesArr []shapes.Shape, name string, x, y int, opacity Opacity, style *shapes.ShapeStyle) *ShapeLayer {
 	return &ShapeLayer{
-		Content:        shapesArr,
-		ContentType:    "shape",
-		Name:           name,
-		Visible:        true,
-		Opacity:        opacity,
+		Content:     shapesArr,
+		ContentType: "shape",
+		BaseLayer: BaseLayer{
+			Name:    name,
+			Visible: true,
+			Opacity: opacity,
+			UUID:    "{" + uuid.New().String() + "}",
+		},
 		X:              x,
 		Y:              y,
 		Style:          style,
 		LayerStyle:     nil,
-		UUID:           "{" + uuid.New().String() + "}",
 		LayerStyleUUID: uuid.New().String(),
 	}
 }
 
 // Helper to split a string into lines.
 func splitLines(s string) []string {
-	return []string{} // implement line splitting (e.g., using strings.Split)
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
 }
 
 // PaintLayer represents an image (pixel) layer.
 type PaintLayer struct {
-	// Either ImagePath (if loaded from disk) or an image.Image.
-	Image     interface{} // use image.Image from the standard library
-	ImagePath string
-	Name      string
-	Visible   bool
-	Opacity   int
-	X, Y      int
+	Image     image.Image
+	ImagePath string // file the image was loaded from, if any
+	// Source, if set, supplies the pixels instead of Image and is read
+	// lazily while saving.
+	Source TileSource
+	// ColorSpace is the layer's pixel format; empty means the document's.
+	ColorSpace ColorSpace
+	// DefaultPixel is the color of the layer outside Image, e.g. white for
+	// a background layer; nil means transparent. Tiles of Image that are
+	// entirely this color are not stored.
+	DefaultPixel color.Color
+	// ICCProfile overrides the default color profile for this layer.
+	ICCProfile []byte
+	BaseLayer
+	X, Y int
+	// AlphaLocked keeps painting from changing the layer's alpha.
+	AlphaLocked    bool
+	LayerStyle     *LayerStyle
+	LayerStyleUUID string
+}
+
+// NewPaintLayer creates a visible paint layer showing img.
+func NewPaintLayer(img image.Image, name string, x, y int, opacity Opacity) *PaintLayer {
+	return &PaintLayer{
+		Image: img,
+		BaseLayer: BaseLayer{
+			Name:    name,
+			Visible: true,
+			Opacity: opacity,
+			UUID:    "{" + uuid.New().String() + "}",
+		},
+		X:              x,
+		Y:              y,
+		LayerStyleUUID: uuid.New().String(),
+	}
+}
+
+// GroupLayer holds child layers, including other groups, in stack order
+// (topmost first).
+type GroupLayer struct {
+	Layers []Layer
+	BaseLayer
+	X, Y        int
+	Passthrough bool // composite children directly into the parent
+}
+
+// NewGroupLayer creates a visible, opaque group holding children.
+func NewGroupLayer(name string, children ...Layer) *GroupLayer {
+	return &GroupLayer{
+		Layers: children,
+		BaseLayer: BaseLayer{
+			Name:    name,
+			Visible: true,
+			Opacity: Opaque,
+			UUID:    "{" + uuid.New().String() + "}",
+		},
+	}
+}
+
+// AddLayer adds a child layer to the group below its existing children.
+func (g *GroupLayer) AddLayer(layer Layer) {
+	g.Layers = append(g.Layers, layer)
 }
@@ -0,0 +1,116 @@
+package layers
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+
+	"github.com/google/uuid"
+)
+
+// Mask is implemented by the nodes Krita attaches to a layer to change how
+// it composites, listed under the layer in the layers docker.
+type Mask interface {
+	GetName() string
+	GetUUID() string
+	IsVisible() bool
+	// NodeType returns the maindoc.xml nodetype, e.g. "transparencymask".
+	NodeType() string
+	// MainDocAttributes returns the attributes of the mask's maindoc.xml
+	// element. The document adds filename, uuid and nodetype.
+	MainDocAttributes() map[string]string
+	// WriteToArchive writes the mask's data files, named after filename.
+	WriteToArchive(w ArchiveWriter, filename string) error
+}
+
+// BaseMask holds the properties shared by all mask kinds and is embedded
+// in each of them.
+type BaseMask struct {
+	Name       string
+	Visible    bool
+	Locked     bool
+	ColorLabel ColorLabel
+	UUID       string
+}
+
+func (b *BaseMask) GetName() string { return b.Name }
+
+func (b *BaseMask) GetUUID() string { return b.UUID }
+
+func (b *BaseMask) IsVisible() bool { return b.Visible }
+
+// BaseAttributes returns the maindoc.xml attributes shared by all masks.
+func (b *BaseMask) BaseAttributes() map[string]string {
+	return map[string]string{
+		"name":       b.Name,
+		"visible":    boolAttr(b.Visible),
+		"locked":     boolAttr(b.Locked),
+		"colorlabel": fmt.Sprintf("%v", int(b.ColorLabel)),
+	}
+}
+
+// TransparencyMask hides parts of its layer: each mask pixel scales the
+// layer's alpha, 255 keeping it and 0 hiding it.
+type TransparencyMask struct {
+	BaseMask
+	// Image holds the mask values. The alpha of *image.Alpha and
+	// *image.Alpha16 images is used, and the gray level of other images.
+	Image image.Image
+	// X and Y position the mask like a layer in the same group.
+	X, Y int
+	// DefaultAlpha is the mask value outside Image.
+	DefaultAlpha uint8
+}
+
+// NewTransparencyMask creates a visible transparency mask from img that
+// hides everything outside it.
+func NewTransparencyMask(img image.Image, name string) *TransparencyMask {
+	return &TransparencyMask{
+		BaseMask: BaseMask{
+			Name:    name,
+			Visible: true,
+			UUID:    "{" + uuid.New().String() + "}",
+		},
+		Image: img,
+	}
+}
+
+func (m *TransparencyMask) NodeType() string { return "transparencymask" }
+
+func (m *TransparencyMask) MainDocAttributes() map[string]string {
+	attrs := m.BaseAttributes()
+	attrs["x"] = fmt.Sprintf("%v", m.X)
+	attrs["y"] = fmt.Sprintf("%v", m.Y)
+	return attrs
+}
+
+// WriteToArchive writes the mask as a one-channel selection, which Krita
+// reads from the .pixelselection file.
+func (m *TransparencyMask) WriteToArchive(w ArchiveWriter, filename string) error {
+	if m.Image == nil {
+		return fmt.Errorf("transparency mask %q has no image", m.Name)
+	}
+	src := ImageSource{AlphaView(m.Image)}
+	return w.WritePaintDevice(filename+".pixelselection", src, Alpha, color.Alpha{A: m.DefaultAlpha}, nil)
+}
+
+// AlphaView returns img with its mask values as alpha: alpha images are
+// returned as is, and others are viewed through their gray level.
+func AlphaView(img image.Image) image.Image {
+	switch img.(type) {
+	case *image.Alpha, *image.Alpha16:
+		return img
+	}
+	return grayAlpha{img}
+}
+
+// grayAlpha presents the gray level of an image as alpha.
+type grayAlpha struct {
+	image.Image
+}
+
+func (g grayAlpha) ColorModel() color.Model { return color.Alpha16Model }
+
+func (g grayAlpha) At(x, y int) color.Color {
+	return color.Alpha16{A: color.Gray16Model.Convert(g.Image.At(x, y)).(color.Gray16).Y}
+}
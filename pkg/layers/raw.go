@@ -0,0 +1,105 @@
+package layers
+
+import (
+	"fmt"
+	"sort"
+)
+
+// RawLayer is a layer of a kind the package does not model, such as a
+// clone or file layer, read from an existing document. It keeps the
+// layer's maindoc.xml attributes and data files and writes them back
+// unchanged, so saving a document that was read does not lose it. Changes
+// to the BaseLayer properties and the offset are written; the channel
+// flags are kept as read. A RawLayer does not contribute to the merged
+// image.
+type RawLayer struct {
+	BaseLayer
+	Type string // the maindoc.xml nodetype
+	// Attrs holds the layer's maindoc.xml attributes.
+	Attrs map[string]string
+	// Files holds the layer's data files by the suffix following the
+	// layer's file name, e.g. "" for the file itself and ".defaultpixel".
+	Files map[string][]byte
+	X, Y  int
+}
+
+// Offset returns the layer's position.
+func (l *RawLayer) Offset() (x, y int) { return l.X, l.Y }
+
+func (l *RawLayer) NodeType() string { return l.Type }
+
+func (l *RawLayer) MainDocAttributes() map[string]string {
+	attrs := make(map[string]string, len(l.Attrs))
+	for k, v := range l.Attrs {
+		attrs[k] = v
+	}
+	for k, v := range l.BaseAttributes() {
+		attrs[k] = v
+	}
+	attrs["x"] = fmt.Sprintf("%v", l.X)
+	attrs["y"] = fmt.Sprintf("%v", l.Y)
+	return attrs
+}
+
+// ChannelFlagAttributes returns the channel flags as read.
+func (l *RawLayer) ChannelFlagAttributes(cs ColorSpace) map[string]string {
+	attrs := map[string]string{}
+	for _, k := range []string{"channelflags", "channellockflags"} {
+		if v, ok := l.Attrs[k]; ok {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+// WriteToArchive writes the layer's data files under filename.
+func (l *RawLayer) WriteToArchive(w ArchiveWriter, filename string) error {
+	return writeRawFiles(w, filename, l.Files)
+}
+
+// RawMask is a mask of a kind the package does not model, such as a
+// selection, transform or colorize mask, read from an existing document.
+// Like a RawLayer, it is written back as read, with changes to the
+// BaseMask properties applied.
+type RawMask struct {
+	BaseMask
+	Type  string // the maindoc.xml nodetype
+	Attrs map[string]string
+	// Files holds the mask's data files by the suffix following the mask's
+	// file name.
+	Files map[string][]byte
+}
+
+func (m *RawMask) NodeType() string { return m.Type }
+
+func (m *RawMask) MainDocAttributes() map[string]string {
+	attrs := make(map[string]string, len(m.Attrs))
+	for k, v := range m.Attrs {
+		attrs[k] = v
+	}
+	for k, v := range m.BaseAttributes() {
+		attrs[k] = v
+	}
+	return attrs
+}
+
+// WriteToArchive writes the mask's data files under filename.
+func (m *RawMask) WriteToArchive(w ArchiveWriter, filename string) error {
+	return writeRawFiles(w, filename, m.Files)
+}
+
+// writeRawFiles writes files keyed by their suffix to filename, in a fixed
+// order.
+func writeRawFiles(w ArchiveWriter, filename string, files map[string][]byte) error {
+	suffixes := make([]string, 0, len(files))
+	for suffix := range files {
+		suffixes = append(suffixes, suffix)
+	}
+	sort.Strings(suffixes)
+	for _, suffix := range suffixes {
+		if err := w.WriteFile(filename+suffix, files[suffix]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package layers
+
+import "image"
+
+// TileSource supplies a paint layer's pixels on demand, so layers larger
+// than memory can be saved. The writer asks for one band of 64-pixel tile
+// rows at a time, possibly from several goroutines at once, and encodes it
+// before asking for more.
+type TileSource interface {
+	// Bounds returns the area the source covers, in layer coordinates.
+	// Every tile overlapping it is written, so keep it tight.
+	Bounds() image.Rectangle
+	// Region returns an image holding the pixels of r, a rectangle within
+	// Bounds, at their layer coordinates. The image may cover more than r
+	// and is only read until the next call from the same goroutine.
+	Region(r image.Rectangle) (image.Image, error)
+}
+
+// ImageSource is a TileSource backed by an image held in memory. Tiles of
+// an ImageSource that match the layer's default pixel are left out.
+type ImageSource struct {
+	image.Image
+}
+
+// Region returns the whole image.
+func (s ImageSource) Region(r image.Rectangle) (image.Image, error) {
+	return s.Image, nil
+}
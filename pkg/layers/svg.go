@@ -0,0 +1,171 @@
+package layers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cozy-creator/kritago/pkg/shapes"
+)
+
+// PointsPerInch is the unit of Krita's vector layer user space.
+const PointsPerInch = 72.0
+
+// textVersion returns the krita:textVersion of vector text written for
+// Krita release kritaVersion: "3" from Krita 5.2, which introduced its
+// current text layout, and "2" for older releases. An empty version means
+// the current release.
+func textVersion(kritaVersion string) string {
+	parts := strings.SplitN(kritaVersion, ".", 3)
+	major, _ := strconv.Atoi(parts[0])
+	minor := 0
+	if len(parts) > 1 {
+		minor, _ = strconv.Atoi(parts[1])
+	}
+	if kritaVersion != "" && (major < 5 || major == 5 && minor < 2) {
+		return "2"
+	}
+	return "3"
+}
+
+// markerDefaults are the marker attributes Krita writes on open shapes.
+var markerDefaults = map[string]string{
+	"krita:marker-fill-method": "auto",
+}
+
+// SVGContent renders the layer as the content.svg Krita stores for vector
+// layers, for a canvas of width x height pixels at resolution pixels per
+// inch. Shape coordinates are given in pixels and mapped onto Krita's
+// point-based user space; shapes without a style of their own take the
+// layer's *shapes.ShapeStyle. Text layers become a single <text> element
+// with one <tspan> per line, marked with the text version of Krita release
+// kritaVersion; empty means the current release. A layer with RawSVG
+// returns it as is.
+func (l *ShapeLayer) SVGContent(width, height int, resolution float64, kritaVersion string) (string, error) {
+	if l.RawSVG != nil {
+		return string(l.RawSVG), nil
+	}
+	scale := PointsPerInch / resolution
+	w := float64(width) * scale
+	h := float64(height) * scale
+	root := &shapes.SVGNode{
+		Tag: "svg",
+		Attrs: map[string]string{
+			"xmlns":          "http://www.w3.org/2000/svg",
+			"xmlns:xlink":    "http://www.w3.org/1999/xlink",
+			"xmlns:krita":    "http://krita.org/namespaces/svg/krita",
+			"xmlns:sodipodi": "http://sodipodi.sourceforge.net/DTD/sodipodi-0.dtd",
+			"width":          fmt.Sprintf("%vpt", w),
+			"height":         fmt.Sprintf("%vpt", h),
+			"viewBox":        fmt.Sprintf("0 0 %v %v", w, h),
+		},
+	}
+	root.Children = append(root.Children, &shapes.SVGNode{Tag: "defs"})
+
+	switch l.ContentType {
+	case "text":
+		spans, ok := l.Content.([]TextSpan)
+		if !ok {
+			return "", fmt.Errorf("text layer %q: content is %T, want []TextSpan", l.Name, l.Content)
+		}
+		style, _ := l.Style.(*TextStyle)
+		if style == nil {
+			style = NewTextStyle()
+		}
+		root.Children = append(root.Children, textElement(spans, style, textVersion(kritaVersion)))
+	case "shape":
+		shapeList, ok := l.Content.([]shapes.Shape)
+		if !ok {
+			return "", fmt.Errorf("shape layer %q: content is %T, want []shapes.Shape", l.Name, l.Content)
+		}
+		layerStyle, _ := l.Style.(*shapes.ShapeStyle)
+		toUser := UserSpaceTransform(scale)
+		ids := 0
+		for _, shape := range shapeList {
+			el := shape.ToSVGElement()
+			applyLayerStyle(el, shape, layerStyle)
+			assignShapeIDs(el, &ids)
+			el.Attrs["transform"] = strings.TrimSpace(toUser + " " + el.Attrs["transform"])
+			root.Children = append(root.Children, el)
+		}
+	}
+
+	header := `<?xml version="1.0" standalone="no"?>
+<!DOCTYPE svg PUBLIC "-//W3C//DTD SVG 20010904//EN" "http://www.w3.org/TR/2001/REC-SVG-20010904/DTD/svg10.dtd">
+<!-- Created using Krita: https://krita.org -->`
+	return header + "\n" + root.ToString("") + "\n", nil
+}
+
+// textElement builds the Krita 5 vector text element for a text layer. Text
+// is laid out in points with the first baseline one font size (the largest
+// on the first line) below the layer origin. Unless the style enables rich
+// text, runs are flattened to plain text lines.
+func textElement(spans []TextSpan, style *TextStyle, version string) *shapes.SVGNode {
+	attrs := style.SVGAttributes()
+	attrs["id"] = "shape0"
+	attrs["krita:textVersion"] = version
+	attrs["krita:useRichText"] = strconv.FormatBool(style.UseRichText)
+	baseline := style.FontSize
+	if len(spans) > 0 && style.UseRichText {
+		for _, run := range spans[0].Runs {
+			if run.Style != nil && run.Style.FontSize > baseline {
+				baseline = run.Style.FontSize
+			}
+		}
+	}
+	attrs["transform"] = fmt.Sprintf("translate(0, %v)", baseline)
+	text := &shapes.SVGNode{Tag: "text", Attrs: attrs, Inline: true}
+	for _, span := range spans {
+		if !style.UseRichText {
+			span = TextSpan{Text: span.PlainText(), X: span.X, Dy: span.Dy}
+		}
+		text.Children = append(text.Children, span.ToSVGElement())
+	}
+	return text
+}
+
+// UserSpaceTransform returns the transform mapping pixel coordinates onto
+// Krita's point-based user space, where scale is points per pixel.
+func UserSpaceTransform(scale float64) string {
+	return fmt.Sprintf("matrix(%v 0 0 %v 0 0)", scale, scale)
+}
+
+// applyLayerStyle gives unstyled shapes, including those nested in groups,
+// the layer's style.
+func applyLayerStyle(el *shapes.SVGNode, shape shapes.Shape, style *shapes.ShapeStyle) {
+	if style == nil {
+		return
+	}
+	if group, ok := shape.(*shapes.ShapeGroup); ok {
+		for i, child := range group.Shapes {
+			applyLayerStyle(el.Children[i], child, style)
+		}
+		return
+	}
+	if styled, ok := shape.(interface{ GetStyle() shapes.ShapeStyle }); ok && styled.GetStyle().IsZero() {
+		for k, v := range style.SVGAttributes() {
+			el.Attrs[k] = v
+		}
+	}
+}
+
+// assignShapeIDs numbers every element in document order the way Krita
+// does and adds the marker defaults to open shapes.
+func assignShapeIDs(el *shapes.SVGNode, next *int) {
+	if el.Attrs == nil {
+		el.Attrs = map[string]string{}
+	}
+	el.Attrs["id"] = fmt.Sprintf("shape%d", *next)
+	*next++
+	switch el.Tag {
+	case "path", "line", "polyline":
+		for k, v := range markerDefaults {
+			if _, ok := el.Attrs[k]; !ok {
+				el.Attrs[k] = v
+			}
+		}
+	}
+	for _, child := range el.Children {
+		assignShapeIDs(child, next)
+	}
+}
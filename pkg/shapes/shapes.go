@@ -1,6 +1,9 @@
 package shapes
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 // ShapeStyle represents styling options for shapes.
 type ShapeStyle struct {
@@ -27,26 +30,42 @@ func NewShapeStyle() ShapeStyle {
 	}
 }
 
+// IsZero reports whether the style is unset.
+func (s ShapeStyle) IsZero() bool {
+	return s == ShapeStyle{}
+}
+
+// SVGAttributes returns the style as SVG presentation attributes.
+func (s ShapeStyle) SVGAttributes() map[string]string {
+	attrs := map[string]string{
+		"fill":            s.Fill,
+		"stroke":          s.Stroke,
+		"stroke-width":    fmt.Sprintf("%v", s.StrokeWidth),
+		"stroke-opacity":  fmt.Sprintf("%v", s.StrokeOpacity),
+		"fill-opacity":    fmt.Sprintf("%v", s.FillOpacity),
+		"stroke-linecap":  s.StrokeLinecap,
+		"stroke-linejoin": s.StrokeLinejoin,
+	}
+	if s.StrokeDasharray != nil {
+		attrs["stroke-dasharray"] = *s.StrokeDasharray
+	}
+	return attrs
+}
+
 // BaseShape is embedded in all shape types.
 type BaseShape struct {
 	Style     ShapeStyle
 	Transform string
 }
 
+// GetStyle returns the shape's own style.
+func (bs *BaseShape) GetStyle() ShapeStyle {
+	return bs.Style
+}
+
 // GetSVGAttributes returns the common SVG attributes.
 func (bs *BaseShape) GetSVGAttributes() map[string]string {
-	attrs := map[string]string{
-		"fill":            bs.Style.Fill,
-		"stroke":          bs.Style.Stroke,
-		"stroke-width":    fmt.Sprintf("%v", bs.Style.StrokeWidth),
-		"stroke-opacity":  fmt.Sprintf("%v", bs.Style.StrokeOpacity),
-		"fill-opacity":    fmt.Sprintf("%v", bs.Style.FillOpacity),
-		"stroke-linecap":  bs.Style.StrokeLinecap,
-		"stroke-linejoin": bs.Style.StrokeLinejoin,
-	}
-	if bs.Style.StrokeDasharray != nil {
-		attrs["stroke-dasharray"] = *bs.Style.StrokeDasharray
-	}
+	attrs := bs.Style.SVGAttributes()
 	if bs.Transform != "" {
 		attrs["transform"] = bs.Transform
 	}
@@ -65,17 +84,26 @@ type SVGNode struct {
 	Attrs    map[string]string
 	Children []*SVGNode
 	Text     string
+	// Inline writes the children without indentation, as required inside
+	// text content where whitespace is significant.
+	Inline bool
 }
 
+var xmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "'", "&apos;")
+
 // ToString returns the XML string representation of an SVGNode.
 func (n *SVGNode) ToString(indent string) string {
 	attrs := ""
 	for k, v := range n.Attrs {
-		attrs += fmt.Sprintf(` %s="%s"`, k, v)
+		attrs += fmt.Sprintf(` %s="%s"`, k, xmlEscaper.Replace(v))
 	}
-	inner := n.Text
+	inner := xmlEscaper.Replace(n.Text)
 	for _, child := range n.Children {
-		inner += "\n" + indent + "  " + child.ToString(indent+"  ")
+		if n.Inline {
+			inner += child.ToString("")
+		} else {
+			inner += "\n" + indent + "  " + child.ToString(indent+"  ")
+		}
 	}
 	if inner == "" {
 		return fmt.Sprintf("<%s%s/>", n.Tag, attrs)
@@ -167,12 +195,17 @@ type ShapeGroup struct {
 	Transform string
 }
 
-func (sg *ShapeGroup) ToSVGElement() *SVGNode {
+// GetSVGAttributes returns the group's own attributes.
+func (sg *ShapeGroup) GetSVGAttributes() map[string]string {
 	attrs := map[string]string{}
 	if sg.Transform != "" {
 		attrs["transform"] = sg.Transform
 	}
-	group := &SVGNode{Tag: "g", Attrs: attrs}
+	return attrs
+}
+
+func (sg *ShapeGroup) ToSVGElement() *SVGNode {
+	group := &SVGNode{Tag: "g", Attrs: sg.GetSVGAttributes()}
 	for _, shape := range sg.Shapes {
 		group.Children = append(group.Children, shape.ToSVGElement())
 	}
@@ -1,27 +1,97 @@
 package xmlhelper
 
-import "fmt"
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
 
-// XMLNode is a simple XML element tree.
+// XMLNode is a simple XML element tree. Text holds the character data
+// before the first child, and each child's Tail the character data between
+// its end tag and the next child, so mixed content keeps its order.
 type XMLNode struct {
 	Tag      string
 	Attrs    map[string]string
 	Children []*XMLNode
 	Text     string
+	Tail     string
 }
 
+var xmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "'", "&apos;")
+
 // ToString returns an XML string representation.
 func (n *XMLNode) ToString(indent string) string {
 	attrs := ""
 	for k, v := range n.Attrs {
-		attrs += fmt.Sprintf(` %s="%s"`, k, v)
+		attrs += fmt.Sprintf(` %s="%s"`, k, xmlEscaper.Replace(v))
 	}
-	inner := n.Text
+	inner := xmlEscaper.Replace(n.Text)
 	for _, child := range n.Children {
-		inner += "\n" + indent + "  " + child.ToString(indent+"  ")
+		inner += "\n" + indent + "  " + child.ToString(indent+"  ") + xmlEscaper.Replace(child.Tail)
 	}
 	if inner == "" {
 		return fmt.Sprintf("<%s%s/>", n.Tag, attrs)
 	}
 	return fmt.Sprintf("<%s%s>%s</%s>", n.Tag, attrs, inner, n.Tag)
-}
\ No newline at end of file
+}
+
+// Child returns the first direct child with the given tag, or nil.
+func (n *XMLNode) Child(tag string) *XMLNode {
+	for _, c := range n.Children {
+		if c.Tag == tag {
+			return c
+		}
+	}
+	return nil
+}
+
+// Parse reads an XML document into an XMLNode tree. Tags and attributes are
+// keyed by their local name; namespace declarations are dropped.
+func Parse(r io.Reader) (*XMLNode, error) {
+	dec := xml.NewDecoder(r)
+	var root *XMLNode
+	var stack []*XMLNode
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			node := &XMLNode{Tag: t.Name.Local, Attrs: map[string]string{}}
+			for _, a := range t.Attr {
+				if a.Name.Space == "xmlns" || (a.Name.Space == "" && a.Name.Local == "xmlns") {
+					continue
+				}
+				node.Attrs[a.Name.Local] = a.Value
+			}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, node)
+			} else if root == nil {
+				root = node
+			}
+			stack = append(stack, node)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) == 0 {
+				break
+			}
+			if parent := stack[len(stack)-1]; len(parent.Children) > 0 {
+				parent.Children[len(parent.Children)-1].Tail += string(t)
+			} else {
+				parent.Text += string(t)
+			}
+		}
+	}
+	if root == nil {
+		return nil, errors.New("xmlhelper: no root element")
+	}
+	return root, nil
+}